@@ -0,0 +1,110 @@
+package yamux
+
+import (
+	"sync"
+)
+
+// acceptQueue holds the inbound streams waiting to be accepted
+type acceptQueue struct {
+	lock    sync.Mutex
+	streams []*Stream
+	limit   int
+	lifo    bool
+
+	// readyCh is notified when streams are waiting
+	readyCh chan struct{}
+
+	// pushCh is closed and replaced whenever a stream is queued, to
+	// wake up all waiters of popMatching
+	pushCh chan struct{}
+}
+
+func newAcceptQueue(limit int, order AcceptOrder) *acceptQueue {
+	return &acceptQueue{
+		limit:   limit,
+		lifo:    order == AcceptLIFO,
+		readyCh: make(chan struct{}, 1),
+		pushCh:  make(chan struct{}),
+	}
+}
+
+// push queues a stream. If the queue is full it returns false, unless
+// the queue is LIFO, where the oldest stream is dropped and returned
+// instead.
+func (q *acceptQueue) push(stream *Stream) (bool, *Stream) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var dropped *Stream
+	if len(q.streams) >= q.limit {
+		if !q.lifo {
+			return false, nil
+		}
+		dropped = q.streams[0]
+		copy(q.streams, q.streams[1:])
+		q.streams = q.streams[:len(q.streams)-1]
+	}
+	q.streams = append(q.streams, stream)
+	asyncNotify(q.readyCh)
+	close(q.pushCh)
+	q.pushCh = make(chan struct{})
+	return true, dropped
+}
+
+// pop removes the next stream to accept, or returns nil if none are
+// waiting
+func (q *acceptQueue) pop() *Stream {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	n := len(q.streams)
+	if n == 0 {
+		return nil
+	}
+	var stream *Stream
+	if q.lifo {
+		stream = q.streams[n-1]
+		q.streams[n-1] = nil
+		q.streams = q.streams[:n-1]
+	} else {
+		stream = q.streams[0]
+		q.streams[0] = nil
+		q.streams = q.streams[1:]
+	}
+
+	// Wake up the next waiter
+	if len(q.streams) > 0 {
+		asyncNotify(q.readyCh)
+	}
+	return stream
+}
+
+// popMatching removes the next stream to accept whose ID matches
+// pred. If none are waiting, it returns a channel that is closed once
+// another stream is queued.
+func (q *acceptQueue) popMatching(pred func(id uint32) bool) (*Stream, <-chan struct{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	n := len(q.streams)
+	for i := 0; i < n; i++ {
+		j := i
+		if q.lifo {
+			j = n - 1 - i
+		}
+		stream := q.streams[j]
+		if !pred(stream.id) {
+			continue
+		}
+		copy(q.streams[j:], q.streams[j+1:])
+		q.streams[n-1] = nil
+		q.streams = q.streams[:n-1]
+
+		// Wake up the next waiter
+		if len(q.streams) > 0 {
+			asyncNotify(q.readyCh)
+		}
+		return stream, nil
+	}
+	return nil, q.pushCh
+}
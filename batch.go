@@ -0,0 +1,140 @@
+package yamux
+
+import (
+	"sync"
+	"time"
+)
+
+// windowBatch collects the streams with window credit to return, so
+// the send loop can merge their updates into one frame per stream, see
+// BatchWindowUpdates.
+type windowBatch struct {
+	lock    sync.Mutex
+	streams map[uint32]*Stream
+
+	// delayed holds the streams with credit below the update
+	// threshold. They are moved to streams once interval passed since
+	// the first of them was added, see WindowUpdateInterval.
+	delayed  map[uint32]*Stream
+	interval time.Duration
+	timer    *time.Timer
+
+	// readyCh is notified when streams are added
+	readyCh chan struct{}
+}
+
+func newWindowBatch(interval time.Duration) *windowBatch {
+	return &windowBatch{
+		streams:  make(map[uint32]*Stream),
+		delayed:  make(map[uint32]*Stream),
+		interval: interval,
+		readyCh:  make(chan struct{}, 1),
+	}
+}
+
+// add marks a stream as having credit to return
+func (b *windowBatch) add(stream *Stream) {
+	b.lock.Lock()
+	b.streams[stream.id] = stream
+	delete(b.delayed, stream.id)
+	b.lock.Unlock()
+	asyncNotify(b.readyCh)
+}
+
+// addDelayed marks a stream as having credit to return within the
+// interval, unless it is returned earlier
+func (b *windowBatch) addDelayed(stream *Stream) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.streams[stream.id]; ok {
+		return
+	}
+	b.delayed[stream.id] = stream
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.interval, b.expire)
+	}
+}
+
+// retry marks a stream whose update couldn't be computed as due again
+// after windowRetryDelay
+func (b *windowBatch) retry(stream *Stream) {
+	b.lock.Lock()
+	b.streams[stream.id] = stream
+	delete(b.delayed, stream.id)
+	b.lock.Unlock()
+	time.AfterFunc(windowRetryDelay, func() { asyncNotify(b.readyCh) })
+}
+
+// expire makes the delayed streams due
+func (b *windowBatch) expire() {
+	b.lock.Lock()
+	for id, stream := range b.delayed {
+		b.streams[id] = stream
+		delete(b.delayed, id)
+	}
+	b.timer = nil
+	b.lock.Unlock()
+	asyncNotify(b.readyCh)
+}
+
+// take returns the marked streams, clearing the batch
+func (b *windowBatch) take() []*Stream {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.streams) == 0 {
+		return nil
+	}
+	streams := make([]*Stream, 0, len(b.streams))
+	for id, stream := range b.streams {
+		streams = append(streams, stream)
+		delete(b.streams, id)
+	}
+	return streams
+}
+
+// flushWindowUpdates queues the batched window updates on sched. It is
+// called by the send loop, which writes them before anything else.
+func (s *Session) flushWindowUpdates(sched *sendScheduler) {
+	for _, stream := range s.batch.take() {
+		hdr, busy := stream.batchedWindowUpdate()
+		if busy {
+			s.batch.retry(stream)
+		} else if hdr != nil {
+			sched.push(sendReady{Hdr: hdr})
+		}
+	}
+}
+
+// batchedWindowUpdate returns the window update returning all credit
+// of the stream that is due, or nil if there is none. It doesn't wait
+// for the recvLock, which the recv loop holds while reading a frame off
+// the connection, and reports busy instead so the send loop can move
+// on.
+func (s *Stream) batchedWindowUpdate() (header, bool) {
+	s.stateLock.Lock()
+	state := s.state
+	s.stateLock.Unlock()
+	if state == StreamClosed || state == StreamReset {
+		return nil, false
+	}
+
+	if !tryLock(&s.recvLock) {
+		return nil, true
+	}
+	max := s.session.config.MaxStreamWindowSize
+	var bufLen uint32
+	if s.recvBuf != nil {
+		bufLen = uint32(s.recvBuf.Len())
+	}
+	delta := (max - bufLen) - s.recvWindow
+	if s.creditHeld() || delta == 0 || s.belowMinWindowUpdate(delta) {
+		s.recvLock.Unlock()
+		return nil, false
+	}
+	s.recvWindow += delta
+	s.recvLock.Unlock()
+
+	hdr := header(make([]byte, headerSize))
+	hdr.encode(typeWindowUpdate, 0, s.id, delta)
+	return hdr, false
+}
@@ -3,6 +3,7 @@ package yamux
 import (
 	"io"
 	"io/ioutil"
+	"sync/atomic"
 	"testing"
 )
 
@@ -106,8 +107,56 @@ func BenchmarkSendRecvLarge(b *testing.B) {
 	benchmarkSendRecv(b, sendSize, recvSize)
 }
 
+func BenchmarkSendRecvLargeReadAhead(b *testing.B) {
+	const sendSize = 512 * 1024 * 1024 //512 MB
+	const recvSize = 4 * 1024          //4 KB
+	conf := testConf()
+	conf.ReadAheadFactor = 0.125
+	benchmarkSendRecvConfig(b, conf, sendSize, recvSize)
+}
+
+func BenchmarkSendRecvLargeRingBuffer(b *testing.B) {
+	const sendSize = 512 * 1024 * 1024 //512 MB
+	const recvSize = 4 * 1024          //4 KB
+	conf := testConf()
+	conf.RecvBufferStrategy = RecvBufferRing
+	benchmarkSendRecvConfig(b, conf, sendSize, recvSize)
+}
+
+func BenchmarkWindowUpdates(b *testing.B) {
+	conf := testConf()
+	conf.ReadAheadFactor = 0.01
+	benchmarkWindowUpdates(b, conf)
+}
+
+func BenchmarkWindowUpdatesBatched(b *testing.B) {
+	conf := testConf()
+	conf.ReadAheadFactor = 0.01
+	conf.BatchWindowUpdates = true
+	benchmarkWindowUpdates(b, conf)
+}
+
+// benchmarkWindowUpdates reports the window updates sent per op of a
+// bursty reader
+func benchmarkWindowUpdates(b *testing.B, conf *Config) {
+	const sendSize = 4 * 1024 * 1024 //4 MB
+	const recvSize = 1024            //1 KB
+	var updates uint64
+	conf.TraceFunc = func(e TraceEvent) {
+		if e.Kind == TraceWindowUpdateSent {
+			atomic.AddUint64(&updates, 1)
+		}
+	}
+	benchmarkSendRecvConfig(b, conf, sendSize, recvSize)
+	b.ReportMetric(float64(atomic.LoadUint64(&updates))/float64(b.N), "updates/op")
+}
+
 func benchmarkSendRecv(b *testing.B, sendSize, recvSize int) {
-	client, server := testClientServer()
+	benchmarkSendRecvConfig(b, testConf(), sendSize, recvSize)
+}
+
+func benchmarkSendRecvConfig(b *testing.B, conf *Config, sendSize, recvSize int) {
+	client, server := testClientServerConfig(conf)
 	defer func() {
 		client.Close()
 		server.Close()
@@ -207,8 +256,19 @@ func BenchmarkSendRecvParallel4096(b *testing.B) {
 	benchmarkSendRecvParallel(b, payloadSize)
 }
 
+func BenchmarkSendRecvParallelRecvWorkers(b *testing.B) {
+	const payloadSize = 4096
+	conf := testConf()
+	conf.RecvWorkers = 4
+	benchmarkSendRecvParallelConfig(b, conf, payloadSize)
+}
+
 func benchmarkSendRecvParallel(b *testing.B, sendSize int) {
-	client, server := testClientServer()
+	benchmarkSendRecvParallelConfig(b, testConf(), sendSize)
+}
+
+func benchmarkSendRecvParallelConfig(b *testing.B, conf *Config, sendSize int) {
+	client, server := testClientServerConfig(conf)
 	defer func() {
 		client.Close()
 		server.Close()
@@ -0,0 +1,243 @@
+package yamux
+
+import (
+	"bytes"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// recvBuffer holds the data received on a stream until it is read
+type recvBuffer interface {
+	io.Reader
+	io.ReaderFrom
+	Len() int
+	Cap() int
+	Grow(n int)
+}
+
+// newRecvBuffer returns an empty receive buffer for the strategy, able
+// to hold n bytes without growing. Its memory comes from pool if set.
+func newRecvBuffer(strategy RecvBufferStrategy, pool BufferPool, n int) recvBuffer {
+	var b []byte
+	if pool != nil {
+		// bytes.Buffer.ReadFrom grows unless MinRead bytes are free,
+		// which would replace the buffer of the pool right away
+		if strategy != RecvBufferRing {
+			n += bytes.MinRead
+		}
+		b = pool.Get(n)[:0]
+	} else {
+		b = make([]byte, 0, n)
+	}
+	if strategy == RecvBufferRing {
+		return &ringBuffer{buf: b[:cap(b)]}
+	}
+	return bytes.NewBuffer(b)
+}
+
+// releaseRecvBuffer returns the memory of a receive buffer that is no
+// longer used to pool, dropping any data left in it
+func releaseRecvBuffer(pool BufferPool, buf recvBuffer) {
+	switch b := buf.(type) {
+	case *bytes.Buffer:
+		b.Reset()
+		pool.Put(b.Bytes())
+	case *ringBuffer:
+		pool.Put(b.buf[:0])
+	}
+}
+
+// BufferPool provides the memory of stream receive buffers, see
+// Config.BufferPool. It must be safe for concurrent use by the
+// sessions sharing it.
+type BufferPool interface {
+	// Get returns an empty buffer with a capacity of at least n
+	Get(n int) []byte
+
+	// Put hands back a buffer that is no longer used
+	Put(b []byte)
+
+	// Stats returns the usage counters of the pool
+	Stats() BufferPoolStats
+}
+
+// BufferPoolStats holds the usage counters of a BufferPool
+type BufferPoolStats struct {
+	// Gets and Puts count the calls of Get and Put, and Misses the
+	// Gets that had to allocate a buffer
+	Gets   uint64
+	Puts   uint64
+	Misses uint64
+
+	// Retained is the number of bytes held in idle buffers
+	Retained int64
+}
+
+// minPooledBuffer is the smallest buffer NewBufferPool keeps
+const minPooledBuffer = 512
+
+// bufferPool is the BufferPool returned by NewBufferPool. It keeps
+// idle buffers in classes of power of two capacities.
+type bufferPool struct {
+	maxRetained int64
+
+	lock  sync.Mutex
+	free  [bits.UintSize][][]byte
+	stats BufferPoolStats
+}
+
+// NewBufferPool returns a BufferPool that keeps up to maxRetained
+// bytes of idle buffers for reuse, dropping buffers handed back beyond
+// that, or any amount if maxRetained is zero. Buffers are allocated in
+// powers of two of at least 512 bytes.
+func NewBufferPool(maxRetained int64) BufferPool {
+	return &bufferPool{maxRetained: maxRetained}
+}
+
+// Get implements BufferPool
+func (p *bufferPool) Get(n int) []byte {
+	if n < minPooledBuffer {
+		n = minPooledBuffer
+	}
+	class := bits.Len(uint(n - 1))
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.stats.Gets++
+	if free := p.free[class]; len(free) > 0 {
+		b := free[len(free)-1]
+		free[len(free)-1] = nil
+		p.free[class] = free[:len(free)-1]
+		p.stats.Retained -= int64(cap(b))
+		return b
+	}
+	p.stats.Misses++
+	return make([]byte, 0, 1<<uint(class))
+}
+
+// Put implements BufferPool
+func (p *bufferPool) Put(b []byte) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.stats.Puts++
+	size := int64(cap(b))
+	if size < minPooledBuffer || p.maxRetained > 0 && p.stats.Retained+size > p.maxRetained {
+		return
+	}
+	class := bits.Len(uint(size)) - 1
+	p.free[class] = append(p.free[class], b[:0])
+	p.stats.Retained += size
+}
+
+// Stats implements BufferPool
+func (p *bufferPool) Stats() BufferPoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.stats
+}
+
+// ringBuffer is a receive buffer that wraps around, so reading part of
+// the buffered data never moves the rest of it. It only copies when it
+// grows.
+type ringBuffer struct {
+	buf  []byte
+	head int // index of the first buffered byte
+	n    int // number of buffered bytes
+}
+
+func newRingBuffer(n int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, n)}
+}
+
+// Len returns the number of buffered bytes
+func (r *ringBuffer) Len() int {
+	return r.n
+}
+
+// Cap returns the capacity of the buffer
+func (r *ringBuffer) Cap() int {
+	return len(r.buf)
+}
+
+// Grow makes room for n more bytes
+func (r *ringBuffer) Grow(n int) {
+	if r.n+n <= len(r.buf) {
+		return
+	}
+	size := 2 * len(r.buf)
+	if size < r.n+n {
+		size = r.n + n
+	}
+	buf := make([]byte, size)
+	buffered := r.read(buf)
+	r.buf = buf
+	r.head = 0
+	r.n = buffered
+}
+
+// Read reads buffered bytes into b
+func (r *ringBuffer) Read(b []byte) (int, error) {
+	if r.n == 0 {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return r.read(b), nil
+}
+
+// read moves up to len(b) buffered bytes into b
+func (r *ringBuffer) read(b []byte) int {
+	n := 0
+	for n < len(b) && r.n > 0 {
+		end := r.head + r.n
+		if end > len(r.buf) {
+			end = len(r.buf)
+		}
+		c := copy(b[n:], r.buf[r.head:end])
+		n += c
+		r.n -= c
+		r.head += c
+		if r.head == len(r.buf) || r.n == 0 {
+			r.head = 0
+		}
+	}
+	return n
+}
+
+// ReadFrom reads from rd until io.EOF, growing the buffer as needed
+func (r *ringBuffer) ReadFrom(rd io.Reader) (int64, error) {
+	var total int64
+	for {
+		// Data frames are read through a LimitedReader, so there is
+		// no need to grow beyond what's left of the frame
+		if lr, ok := rd.(*io.LimitedReader); ok {
+			if lr.N <= 0 {
+				return total, nil
+			}
+			r.Grow(int(lr.N))
+		} else if r.n == len(r.buf) {
+			r.Grow(512)
+		}
+
+		// Fill the free space up to the end of the buffer first
+		tail := r.head + r.n
+		if tail >= len(r.buf) {
+			tail -= len(r.buf)
+		}
+		end := len(r.buf)
+		if tail < r.head {
+			end = r.head
+		}
+		n, err := rd.Read(r.buf[tail:end])
+		r.n += n
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package yamux
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRingBuffer(t *testing.T) {
+	r := newRingBuffer(8)
+	var expect []byte
+	next := byte(0)
+	write := func(n int) {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = next
+			next++
+		}
+		expect = append(expect, data...)
+		if _, err := r.ReadFrom(&io.LimitedReader{R: bytes.NewReader(data), N: int64(n)}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	read := func(n int) {
+		buf := make([]byte, n)
+		m, err := r.Read(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(buf[:m], expect[:m]) {
+			t.Fatalf("bad: %v %v", buf[:m], expect[:m])
+		}
+		expect = expect[m:]
+		if r.Len() != len(expect) {
+			t.Fatalf("bad: %d %d", r.Len(), len(expect))
+		}
+	}
+
+	// Wrap around without growing
+	write(6)
+	read(4)
+	write(5)
+	if r.Cap() != 8 {
+		t.Fatalf("should not grow: %d", r.Cap())
+	}
+	read(7)
+
+	// Grow while wrapped
+	write(6)
+	write(10)
+	if r.Cap() < 16 {
+		t.Fatalf("should grow: %d", r.Cap())
+	}
+	read(3)
+	read(100)
+
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool(3 * 1024)
+
+	b := pool.Get(100)
+	if len(b) != 0 || cap(b) != minPooledBuffer {
+		t.Fatalf("bad: %d %d", len(b), cap(b))
+	}
+	b2 := pool.Get(1025)
+	if cap(b2) != 2048 {
+		t.Fatalf("bad: %d", cap(b2))
+	}
+	pool.Put(b)
+	pool.Put(b2)
+	if s := pool.Stats(); s != (BufferPoolStats{Gets: 2, Puts: 2, Misses: 2, Retained: 2560}) {
+		t.Fatalf("bad: %+v", s)
+	}
+
+	// Idle buffers are reused
+	if b := pool.Get(1500); cap(b) != 2048 {
+		t.Fatalf("bad: %d", cap(b))
+	}
+	if s := pool.Stats(); s.Misses != 2 || s.Retained != 512 {
+		t.Fatalf("bad: %+v", s)
+	}
+
+	// Buffers beyond the cap and small ones are dropped
+	pool.Put(make([]byte, 4096))
+	pool.Put(make([]byte, 100))
+	if s := pool.Stats(); s.Puts != 4 || s.Retained != 512 {
+		t.Fatalf("bad: %+v", s)
+	}
+}
@@ -0,0 +1,120 @@
+package yamux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// castagnoli is the CRC32C table used for data frame checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumWriter computes the checksum of a data frame payload while
+// writing it. It is owned by the send loop.
+type checksumWriter struct {
+	hdr header
+	w   io.Writer
+	sum uint32
+}
+
+// newChecksumWriter is used to construct a checksumWriter for w
+func newChecksumWriter(w io.Writer) *checksumWriter {
+	return &checksumWriter{
+		hdr: header(make([]byte, headerSize)),
+		w:   w,
+	}
+}
+
+// header returns a copy of the data frame header hdr with the CHK flag
+// set and the length including the checksum, and resets the sum.
+func (c *checksumWriter) header(hdr header) header {
+	c.hdr.encode(hdr.MsgType(), hdr.Flags()|flagCHK, hdr.StreamID(), hdr.Length()+sizeOfChecksum)
+	c.sum = 0
+	return c.hdr
+}
+
+// Write writes the payload and adds it to the checksum
+func (c *checksumWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.sum = crc32.Update(c.sum, castagnoli, b[:n])
+	return n, err
+}
+
+// writeSum writes the checksum of the payload written so far
+func (c *checksumWriter) writeSum() error {
+	var buf [sizeOfChecksum]byte
+	binary.BigEndian.PutUint32(buf[:], c.sum)
+	_, err := c.w.Write(buf[:])
+	return err
+}
+
+// verifyChecksum reads the payload of a data frame with the CHK flag
+// and verifies its checksum. It returns the header and body of the
+// frame without the checksum.
+func (s *Session) verifyChecksum(hdr header, body io.Reader) (header, io.Reader, error) {
+	if !s.hasExtension(extChecksum) {
+		s.logger.Printf("[ERR] yamux: received checksum without negotiating it")
+		return nil, nil, ErrUnexpectedFlag
+	}
+
+	length := hdr.Length()
+	if length < sizeOfChecksum || length-sizeOfChecksum > s.config.MaxStreamWindowSize {
+		s.logger.Printf("[ERR] yamux: invalid checksummed frame length %d", length)
+		return nil, nil, ErrUnexpectedFlag
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(body, payload); err != nil {
+		return nil, nil, err
+	}
+	length -= sizeOfChecksum
+	sum := binary.BigEndian.Uint32(payload[length:])
+	payload = payload[:length]
+
+	stripped := header(make([]byte, headerSize))
+	stripped.encode(hdr.MsgType(), hdr.Flags()&^flagCHK, hdr.StreamID(), length)
+	if crc32.Checksum(payload, castagnoli) != sum {
+		return stripped, nil, ErrChecksumMismatch
+	}
+	return stripped, bytes.NewReader(payload), nil
+}
+
+// checksumMismatch handles a data frame that failed verification
+// according to the ChecksumMismatchPolicy. It returns an error if the
+// session should be closed.
+func (s *Session) checksumMismatch(hdr header) error {
+	id := hdr.StreamID()
+	s.logger.Printf("[ERR] yamux: checksum mismatch (stream: %d)", id)
+	if s.config.ChecksumMismatchPolicy == ChecksumMismatchReset && id != 0 {
+		s.resetStream(id)
+		return nil
+	}
+
+	if err := s.sendNoWait(s.goAway(goAwayProtoErr)); err != nil {
+		s.logger.Printf("[WARN] yamux: failed to send go away: %v", err)
+	}
+	return ErrChecksumMismatch
+}
+
+// resetStream resets a stream on our side and sends a RST to the peer
+func (s *Session) resetStream(id uint32) {
+	lockCounted(&s.streamLock, &s.streamLockContended)
+	stream := s.streams[id]
+	s.streamLock.Unlock()
+
+	if stream != nil {
+		stream.stateLock.Lock()
+		stream.state = StreamReset
+		stream.endHandshake()
+		stream.stateLock.Unlock()
+		stream.notifyWaiting()
+		s.closeStream(id)
+	}
+
+	hdr := header(make([]byte, headerSize))
+	hdr.encode(typeWindowUpdate, flagRST, id, 0)
+	if err := s.sendNoWait(hdr); err != nil {
+		s.logger.Printf("[WARN] yamux: failed to send RST: %v", err)
+	}
+}
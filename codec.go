@@ -0,0 +1,105 @@
+package yamux
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+)
+
+// FrameCodec transforms the payload of data frames on the wire, e.g.
+// to compress them. Flow control is based on the decoded sizes, so
+// the codec is transparent to the application. Encoding trades CPU
+// time for bandwidth and is only worth it on constrained links.
+type FrameCodec interface {
+	// ID identifies the encoding during negotiation. Both peers
+	// must configure a codec with the same ID for it to be used.
+	ID() uint8
+
+	// Encode returns the encoded form of a payload
+	Encode(b []byte) ([]byte, error)
+
+	// Decode returns the decoded form of a payload. It must fail if
+	// the decoded payload would be larger than limit.
+	Decode(b []byte, limit int) ([]byte, error)
+}
+
+// FlateCodec is a FrameCodec compressing payloads with DEFLATE
+type FlateCodec struct {
+	// Level is the compression level, see compress/flate
+	Level int
+}
+
+// ID implements FrameCodec
+func (c *FlateCodec) ID() uint8 {
+	return 1
+}
+
+// Encode implements FrameCodec
+func (c *FlateCodec) Encode(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode implements FrameCodec
+func (c *FlateCodec) Decode(b []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, ErrRecvWindowExceeded
+	}
+	return out, nil
+}
+
+// encodePayload encodes a data frame payload if a codec was
+// negotiated and encoding makes it smaller. It returns the payload
+// to send and whether it is encoded.
+func (s *Session) encodePayload(b []byte) ([]byte, bool) {
+	if len(b) == 0 || !s.hasExtension(extCompression) {
+		return b, false
+	}
+	enc, err := s.config.FrameCodec.Encode(b)
+	if err != nil {
+		s.logger.Printf("[WARN] yamux: failed to encode payload: %v", err)
+		return b, false
+	}
+	if len(enc) >= len(b) {
+		return b, false
+	}
+	return enc, true
+}
+
+// decodePayload reads and decodes an encoded data frame payload,
+// returning a reader for the decoded payload and its length.
+func (s *Session) decodePayload(body io.Reader, length uint32) (io.Reader, uint32, error) {
+	codec := s.config.FrameCodec
+	if codec == nil || !s.hasExtension(extCompression) {
+		s.logger.Printf("[ERR] yamux: received encoded payload without negotiated codec")
+		return nil, 0, ErrUnexpectedFlag
+	}
+
+	enc := make([]byte, length)
+	if _, err := io.ReadFull(body, enc); err != nil {
+		return nil, 0, err
+	}
+	dec, err := codec.Decode(enc, int(s.config.MaxStreamWindowSize))
+	if err != nil {
+		s.logger.Printf("[ERR] yamux: failed to decode payload: %v", err)
+		return nil, 0, err
+	}
+	return bytes.NewReader(dec), uint32(len(dec)), nil
+}
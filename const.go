@@ -3,6 +3,7 @@ package yamux
 import (
 	"encoding/binary"
 	"fmt"
+	"time"
 )
 
 type timeoutError struct {
@@ -13,6 +14,26 @@ func (e timeoutError) Error() string   { return e.error }
 func (e timeoutError) Timeout() bool   { return true }
 func (e timeoutError) Temporary() bool { return true }
 
+// StreamsExhaustedError is returned by Open once the session ran out of
+// stream IDs. It matches ErrStreamsExhausted with errors.Is.
+type StreamsExhaustedError struct {
+	// Streams is the number of open streams at the time
+	Streams int
+
+	// Max is the number of streams we can open over the lifetime of
+	// a session, all of which were opened
+	Max uint32
+}
+
+func (e *StreamsExhaustedError) Error() string {
+	return fmt.Sprintf("stream ids exhausted (open streams: %d, max: %d)", e.Streams, e.Max)
+}
+
+// Is makes errors.Is match ErrStreamsExhausted
+func (e *StreamsExhaustedError) Is(target error) bool {
+	return target == ErrStreamsExhausted
+}
+
 var (
 	// ErrInvalidVersion means we received a frame with an
 	// invalid version
@@ -26,9 +47,13 @@ var (
 	// an operation
 	ErrSessionShutdown = fmt.Errorf("session shutdown")
 
-	// ErrStreamsExhausted is returned if we have no more
-	// stream ids to issue
-	ErrStreamsExhausted = fmt.Errorf("streams exhausted")
+	// ErrStreamIDExhausted is matched by the StreamsExhaustedError
+	// returned if we have no more stream ids to issue
+	ErrStreamIDExhausted = fmt.Errorf("stream ids exhausted")
+
+	// ErrStreamsExhausted is an alias of ErrStreamIDExhausted
+	// kept for compatibility
+	ErrStreamsExhausted = ErrStreamIDExhausted
 
 	// ErrDuplicateStream is used if a duplicate stream is
 	// opened inbound
@@ -43,6 +68,26 @@ var (
 	// ErrStreamClosed is returned when using a closed stream
 	ErrStreamClosed = fmt.Errorf("stream closed")
 
+	// ErrStreamRejected is returned by WaitEstablished if the peer
+	// reset the stream instead of acknowledging it
+	ErrStreamRejected = fmt.Errorf("stream rejected")
+
+	// ErrPeerOverloaded is returned when using a stream the peer
+	// reset because its load was too high, see LoadMaxStreams
+	ErrPeerOverloaded = fmt.Errorf("stream refused, peer overloaded")
+
+	// ErrStreamClosedForWriting is returned when writing to a stream
+	// after closing it for writing
+	ErrStreamClosedForWriting = fmt.Errorf("stream closed for writing")
+
+	// ErrStreamNotApproved is returned when reading or writing a
+	// stream that awaits Approve, see RequireStreamApproval
+	ErrStreamNotApproved = fmt.Errorf("stream not approved")
+
+	// ErrStreamIdle is returned when using a stream that was reset
+	// because it exceeded its idle timeout, see SetIdleTimeout
+	ErrStreamIdle = fmt.Errorf("stream idle timeout")
+
 	// ErrUnexpectedFlag is set when we get an unexpected flag
 	ErrUnexpectedFlag = fmt.Errorf("unexpected flag")
 
@@ -59,6 +104,50 @@ var (
 
 	// ErrKeepAliveTimeout is sent if a missed keepalive caused the stream close
 	ErrKeepAliveTimeout = fmt.Errorf("keepalive timeout")
+
+	// ErrReorderWindowExceeded is used when a sequenced frame arrives
+	// too far ahead of its predecessors to be buffered
+	ErrReorderWindowExceeded = fmt.Errorf("reorder window exceeded")
+
+	// ErrStreamHeaderTooLarge is used when a stream header exceeds
+	// the maximum size
+	ErrStreamHeaderTooLarge = fmt.Errorf("stream header too large")
+
+	// ErrPingsUnanswered is sent if more than MaxOutstandingPings
+	// pings timed out since the peer last answered one
+	ErrPingsUnanswered = fmt.Errorf("too many unanswered pings")
+
+	// ErrLivenessCheckFailed is sent if the peer did not echo
+	// an active liveness check in time
+	ErrLivenessCheckFailed = fmt.Errorf("liveness check failed")
+
+	// ErrFrameReadTimeout is used if the peer stalled in the
+	// middle of sending a frame
+	ErrFrameReadTimeout = fmt.Errorf("frame read timeout")
+
+	// ErrSendBufferFull is returned by Write if MaxSendBuffer is
+	// reached and FailFastOnSendBufferFull is set
+	ErrSendBufferFull = fmt.Errorf("send buffer full")
+
+	// ErrRTTExceeded is sent if keepalive measured an RTT above MaxRTT
+	// too many times in a row
+	ErrRTTExceeded = fmt.Errorf("keepalive rtt exceeded")
+
+	// ErrSessionStalled is used if the Watchdog finds the send or
+	// recv loop stalled
+	ErrSessionStalled = fmt.Errorf("session stalled")
+
+	// ErrUnknownStream is used with StrictProtocol if the peer sends
+	// a window update for a stream that was never opened
+	ErrUnknownStream = fmt.Errorf("window update for unknown stream")
+
+	// ErrFrameTooLarge is used if the peer sends a data frame larger
+	// than MaxFrameSize
+	ErrFrameTooLarge = fmt.Errorf("frame too large")
+
+	// ErrChecksumMismatch is used if the checksum of a received data
+	// frame doesn't match its payload
+	ErrChecksumMismatch = fmt.Errorf("checksum mismatch")
 )
 
 const (
@@ -101,11 +190,123 @@ const (
 
 	// RST is used to hard close a given stream.
 	flagRST
+
+	// EXT is sent on StreamID 0 to carry session level extension
+	// negotiation. Peers without extension support ignore it.
+	flagEXT
+
+	// SEQ indicates the header is followed by a 4 byte frame
+	// sequence number. Only sent once extReorder is negotiated.
+	flagSEQ
+
+	// HDR is sent with the SYN of a data frame to indicate the
+	// payload is the stream header rather than stream data.
+	flagHDR
+
+	// CMP indicates the data frame payload was encoded with the
+	// negotiated FrameCodec.
+	flagCMP
+
+	// CHK indicates the data frame payload is followed by a CRC32C
+	// checksum. Only sent once extChecksum is negotiated.
+	flagCHK
+)
+
+const (
+	// flagSpare selects the flag bits without a meaning to yamux,
+	// which can be exposed with ExposeSpareFlags
+	flagSpare uint16 = 0xFE00
+)
+
+const (
+	// extReorder enables per frame sequence numbers so the receiver
+	// can restore the order of slightly reordered frames.
+	extReorder uint32 = 1 << iota
+
+	// extCompression enables encoding data frame payloads with a
+	// FrameCodec. The codec ID is advertised in the top byte.
+	extCompression
+
+	// extChecksum enables CRC32C checksums on data frame payloads.
+	extChecksum
+
+	// extToken enables exchanging the parts of the session token in
+	// data frames on the session StreamID with the EXT flag set.
+	extToken
+
+	// extGoAwayMessage enables sending a reason before a GoAway in a
+	// data frame on the session StreamID with the EXT and FIN flags
+	// set.
+	extGoAwayMessage
+
+	// extPause enables pausing the peer on a stream with a window
+	// update carrying the EXT flag.
+	extPause
+)
+
+const (
+	// extCodecShift is the position of the codec ID in the
+	// extension advertisement
+	extCodecShift = 24
+
+	// extMask selects the extension bits of an advertisement
+	extMask uint32 = 1<<extCodecShift - 1
 )
 
 const (
 	// initialStreamWindow is the initial stream window size
 	initialStreamWindow uint32 = 256 * 1024
+
+	// defaultStreamHeaderSize is the default limit for stream headers
+	defaultStreamHeaderSize uint32 = 4 * 1024
+
+	// defaultMaxUnapprovedData is the default limit for data received
+	// on a stream awaiting approval
+	defaultMaxUnapprovedData uint32 = 16 * 1024
+
+	// defaultApprovalTimeout is the default time a stream may await
+	// approval
+	defaultApprovalTimeout = 10 * time.Second
+
+	// writeFlushDelay is how long small writes are buffered with
+	// SetNoDelay(false)
+	writeFlushDelay = 5 * time.Millisecond
+
+	// maxPendingAcks is how many writes queued by WriteWithAck may
+	// await their result
+	maxPendingAcks = 64
+
+	// writeRetryBackoff and maxWriteRetryBackoff bound the delay
+	// before retrying a write, see WriteErrorClassifier
+	writeRetryBackoff    = time.Millisecond
+	maxWriteRetryBackoff = 100 * time.Millisecond
+
+	// windowRetryDelay is how long a batched window update waits
+	// before it is retried when the stream's receive buffer is busy
+	windowRetryDelay = time.Millisecond
+
+	// goAwayQuietPeriod is how long the peer must not open streams
+	// for WaitGoAwayDrained to consider it done
+	goAwayQuietPeriod = 250 * time.Millisecond
+)
+
+const (
+	// rstOverloaded is the length of a RST window update refusing a
+	// stream because of the session load. Peers unaware of it add it
+	// to the send window of the reset stream, which is harmless.
+	rstOverloaded uint32 = 1
+
+	// rstBacklog is the length of a RST window update refusing a
+	// stream because the accept backlog is full
+	rstBacklog uint32 = 2
+)
+
+const (
+	// pauseStream and resumeStream are the lengths of a window update
+	// with the EXT flag on a stream, see extPause. They don't carry
+	// any credit.
+	pauseStream uint32 = iota + 1
+	resumeStream
 )
 
 const (
@@ -127,6 +328,8 @@ const (
 	sizeOfLength   = 4
 	headerSize     = sizeOfVersion + sizeOfType + sizeOfFlags +
 		sizeOfStreamID + sizeOfLength
+	sizeOfSeq      = 4
+	sizeOfChecksum = 4
 )
 
 type header []byte
@@ -156,6 +359,10 @@ func (h header) String() string {
 		h.Version(), h.MsgType(), h.Flags(), h.StreamID(), h.Length())
 }
 
+func (h header) setFlags(flags uint16) {
+	binary.BigEndian.PutUint16(h[2:4], flags)
+}
+
 func (h header) encode(msgType uint8, flags uint16, streamID uint32, length uint32) {
 	h[0] = protoVersion
 	h[1] = msgType
@@ -34,6 +34,21 @@ func TestConst(t *testing.T) {
 	if flagRST != 8 {
 		t.Fatalf("bad: %v", flagRST)
 	}
+	if flagEXT != 16 {
+		t.Fatalf("bad: %v", flagEXT)
+	}
+	if flagSEQ != 32 {
+		t.Fatalf("bad: %v", flagSEQ)
+	}
+	if flagHDR != 64 {
+		t.Fatalf("bad: %v", flagHDR)
+	}
+	if flagCMP != 128 {
+		t.Fatalf("bad: %v", flagCMP)
+	}
+	if flagCHK != 256 {
+		t.Fatalf("bad: %v", flagCHK)
+	}
 
 	if goAwayNormal != 0 {
 		t.Fatalf("bad: %v", goAwayNormal)
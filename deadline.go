@@ -11,6 +11,7 @@ type pipeDeadline struct {
 	mu     sync.Mutex // Guards timer and cancel
 	timer  *time.Timer
 	cancel chan struct{} // Must be non-nil
+	t      time.Time     // The deadline last set
 }
 
 func makePipeDeadline() pipeDeadline {
@@ -31,6 +32,7 @@ func (d *pipeDeadline) set(t time.Time) {
 		<-d.cancel // Wait for the timer callback to finish and close cancel
 	}
 	d.timer = nil
+	d.t = t
 
 	// Time is zero, then there is no deadline.
 	closed := isClosedChan(d.cancel)
@@ -58,6 +60,13 @@ func (d *pipeDeadline) set(t time.Time) {
 	}
 }
 
+// get returns the deadline last set, the zero value if there is none.
+func (d *pipeDeadline) get() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.t
+}
+
 // wait returns a channel that is closed when the deadline is exceeded.
 func (d *pipeDeadline) wait() chan struct{} {
 	d.mu.Lock()
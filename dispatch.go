@@ -0,0 +1,101 @@
+package yamux
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// recvJob is a stream frame handed to a recv worker
+type recvJob struct {
+	hdr     header
+	payload []byte
+}
+
+// recvWorkers delivers stream frames on a pool of goroutines, so the
+// recv goroutine can parse the next header while the previous payload
+// is being copied into its stream.
+type recvWorkers struct {
+	jobs []chan recvJob
+	wg   sync.WaitGroup
+}
+
+// startRecvWorkers starts the recv workers if more than one is
+// configured. Otherwise frames are handled by the recv goroutine.
+func (s *Session) startRecvWorkers() {
+	n := s.config.RecvWorkers
+	if n <= 1 {
+		return
+	}
+	w := &recvWorkers{jobs: make([]chan recvJob, n)}
+	w.wg.Add(n)
+	for i := range w.jobs {
+		w.jobs[i] = make(chan recvJob, 64)
+		go s.recvWorker(w.jobs[i], &w.wg)
+	}
+	s.workers = w
+}
+
+// stopRecvWorkers waits for the recv workers to handle the frames
+// they were handed and stops them. It must only be called by the recv
+// goroutine once it stopped reading.
+func (s *Session) stopRecvWorkers() {
+	if s.workers == nil {
+		return
+	}
+	for _, jobs := range s.workers.jobs {
+		close(jobs)
+	}
+	s.workers.wg.Wait()
+}
+
+// dispatchStreamMessage handles data and window update frames. With
+// recv workers, the payload is read here and the frame is handed to the
+// worker of its stream, which keeps the frames of a stream in order.
+// Frames opening a stream are handled inline, so streams are accepted
+// in the order they were opened.
+func (s *Session) dispatchStreamMessage(hdr header, body io.Reader) error {
+	id := hdr.StreamID()
+	if s.workers == nil || id == 0 || hdr.Flags()&(flagSYN|flagHDR) != 0 {
+		return s.handleStreamMessage(hdr, body)
+	}
+
+	var payload []byte
+	if hdr.MsgType() == typeData && hdr.Length() > 0 {
+		// Nothing larger can fit in the window, so don't buffer it
+		if hdr.Length() > s.config.MaxStreamWindowSize+sizeOfChecksum {
+			s.logger.Printf("[ERR] yamux: receive window exceeded (stream: %d, recv: %d)", id, hdr.Length())
+			return ErrRecvWindowExceeded
+		}
+		payload = make([]byte, hdr.Length())
+		if _, err := io.ReadFull(body, payload); err != nil {
+			return err
+		}
+	}
+
+	job := recvJob{hdr: append(header(nil), hdr...), payload: payload}
+	select {
+	case s.workers.jobs[id%uint32(len(s.workers.jobs))] <- job:
+		return nil
+	case <-s.shutdownCh:
+		return ErrSessionShutdown
+	}
+}
+
+// recvWorker is a long running goroutine that handles the stream frames
+// handed to it until jobs is closed. The session is closed on an error
+// without waiting: Close waits for the recv goroutine, which waits for
+// the workers to finish.
+func (s *Session) recvWorker(jobs chan recvJob, wg *sync.WaitGroup) {
+	defer wg.Done()
+	failed := false
+	for job := range jobs {
+		if failed {
+			continue
+		}
+		if err := s.handleStreamMessage(job.hdr, bytes.NewReader(job.payload)); err != nil {
+			go s.exitErr(err)
+			failed = true
+		}
+	}
+}
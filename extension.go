@@ -0,0 +1,206 @@
+package yamux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+const (
+	// sessionTokenSize is the size of the part of the session token
+	// contributed by each side
+	sessionTokenSize = 16
+
+	// maxGoAwayMessageSize is the maximum size of a GoAway message
+	maxGoAwayMessageSize = 256
+)
+
+// localExtensions returns the set of protocol extensions enabled
+// by the given configuration.
+func localExtensions(config *Config) uint32 {
+	var ext uint32
+	if config.ReorderWindow > 0 {
+		ext |= extReorder
+	}
+	if config.EnableChecksum {
+		ext |= extChecksum
+	}
+	if config.FrameCodec != nil {
+		ext |= extCompression | uint32(config.FrameCodec.ID())<<extCodecShift
+	}
+	if config.ExchangeSessionToken {
+		ext |= extToken
+	}
+	if config.EnableGoAwayMessage {
+		ext |= extGoAwayMessage
+	}
+	if config.EnableStreamPause {
+		ext |= extPause
+	}
+	return ext
+}
+
+// extensionsHeader builds the frame advertising our extensions. It is
+// a window update on the session StreamID with the EXT flag set, which
+// peers without extension support log and discard.
+func extensionsHeader(ext uint32) header {
+	hdr := header(make([]byte, headerSize))
+	hdr.encode(typeWindowUpdate, flagEXT, 0, ext)
+	return hdr
+}
+
+// hasExtension checks if an extension was negotiated with the peer
+func (s *Session) hasExtension(ext uint32) bool {
+	return atomic.LoadUint32(&s.extensions)&ext == ext
+}
+
+// handleExtensions is invoked for the remote extension advertisement.
+// Only extensions enabled on both sides are put in use.
+func (s *Session) handleExtensions(hdr header, body io.Reader) error {
+	local, remote := localExtensions(s.config), hdr.Length()
+	ext := local & remote & extMask
+
+	// Compression needs both sides to use the same codec
+	if local>>extCodecShift != remote>>extCodecShift {
+		ext &^= extCompression
+	}
+	atomic.StoreUint32(&s.extensions, ext)
+	if ext&extToken == extToken {
+		return s.sendToken()
+	}
+	return nil
+}
+
+// sendToken sends our random part of the session token. It is queued
+// in the background to not hold up the recv loop.
+func (s *Session) sendToken() error {
+	part := make([]byte, sessionTokenSize)
+	if err := s.readRandom(part, rand.Read); err != nil {
+		s.logger.Printf("[ERR] yamux: failed to generate session token: %v", err)
+		return err
+	}
+	s.token.Store(part)
+
+	hdr := header(make([]byte, headerSize))
+	hdr.encode(typeData, flagEXT, 0, sessionTokenSize)
+	go func() {
+		if err := s.waitForSend(hdr, bytes.NewReader(part)); err != nil {
+			s.logger.Printf("[WARN] yamux: failed to send session token: %v", err)
+		}
+	}()
+	return nil
+}
+
+// handleToken is invoked for the remote part of the session token
+func (s *Session) handleToken(hdr header, body io.Reader) error {
+	if !s.hasExtension(extToken) || hdr.Length() != sessionTokenSize {
+		s.logger.Printf("[ERR] yamux: unexpected session token (length: %d)", hdr.Length())
+		return ErrUnexpectedFlag
+	}
+	remote := make([]byte, sessionTokenSize)
+	if _, err := io.ReadFull(body, remote); err != nil {
+		return err
+	}
+
+	// The client's part comes first
+	local, _ := s.token.Load().([]byte)
+	if len(local) != sessionTokenSize {
+		s.logger.Printf("[ERR] yamux: session token received twice")
+		return ErrUnexpectedFlag
+	}
+	token := append(local, remote...)
+	if !s.client {
+		token = append(remote, local...)
+	}
+	s.token.Store(token)
+	return nil
+}
+
+// Token returns the session token if ExchangeSessionToken is enabled
+// on both sides. Each side contributes a random part, so the token is
+// unique to the session and identical on both sides. It is nil until
+// the exchange completed shortly after the session was established.
+func (s *Session) Token() []byte {
+	token, _ := s.token.Load().([]byte)
+	if len(token) != 2*sessionTokenSize {
+		return nil
+	}
+	return append([]byte(nil), token...)
+}
+
+// GoAwayWithMessage is like GoAway, and sends msg as the reason
+// before it if EnableGoAwayMessage is in use with the peer. Messages
+// are UTF-8 and truncated to 256 bytes.
+func (s *Session) GoAwayWithMessage(msg string) error {
+	if s.hasExtension(extGoAwayMessage) && msg != "" {
+		if len(msg) > maxGoAwayMessageSize {
+			msg = msg[:maxGoAwayMessageSize]
+			for !utf8.ValidString(msg) {
+				msg = msg[:len(msg)-1]
+			}
+		}
+		hdr := header(make([]byte, headerSize))
+		hdr.encode(typeData, flagEXT|flagFIN, 0, uint32(len(msg)))
+		if err := s.waitForSend(hdr, strings.NewReader(msg)); err != nil {
+			return err
+		}
+	}
+	return s.GoAway()
+}
+
+// handleGoAwayMessage is invoked for the reason the peer sent before
+// its GoAway
+func (s *Session) handleGoAwayMessage(hdr header, body io.Reader) error {
+	if !s.hasExtension(extGoAwayMessage) || hdr.Length() > maxGoAwayMessageSize {
+		s.logger.Printf("[ERR] yamux: unexpected go away message (length: %d)", hdr.Length())
+		return ErrUnexpectedFlag
+	}
+	msg := make([]byte, hdr.Length())
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return err
+	}
+	s.remoteGoAwayMsg.Store(strings.ToValidUTF8(string(msg), "\uFFFD"))
+	return nil
+}
+
+// RemoteGoAwayMessage returns the reason the peer attached to its
+// GoAway, see GoAwayWithMessage. It is empty if none was received.
+func (s *Session) RemoteGoAwayMessage() string {
+	msg, _ := s.remoteGoAwayMsg.Load().(string)
+	return msg
+}
+
+// EffectiveConfig returns a copy of the session config with the
+// values actually in force. Protocol extensions the peer didn't agree
+// to are disabled, and defaulted limits are filled in. Extensions are
+// reported as disabled until the peer's advertisement arrives.
+//
+// Stream windows are not negotiated: each side grows the window it
+// grants up to its own MaxStreamWindowSize, see Stream.SendWindow for
+// what the peer currently allows.
+func (s *Session) EffectiveConfig() *Config {
+	config := s.config.Clone()
+	if !s.hasExtension(extReorder) {
+		config.ReorderWindow = 0
+	}
+	if !s.hasExtension(extChecksum) {
+		config.EnableChecksum = false
+	}
+	if !s.hasExtension(extCompression) {
+		config.FrameCodec = nil
+	}
+	if !s.hasExtension(extToken) {
+		config.ExchangeSessionToken = false
+	}
+	if !s.hasExtension(extGoAwayMessage) {
+		config.EnableGoAwayMessage = false
+	}
+	if !s.hasExtension(extPause) {
+		config.EnableStreamPause = false
+	}
+	config.MaxFrameSize = s.maxFrameSize()
+	return config
+}
@@ -0,0 +1,59 @@
+package yamux
+
+import (
+	"io"
+)
+
+// parseHeader validates the frame header at the start of b. It only
+// looks at b, so it is safe to call on arbitrary input. The returned
+// header aliases b.
+func parseHeader(b []byte) (header, error) {
+	if len(b) < headerSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	hdr := header(b[:headerSize])
+	if hdr.Version() != protoVersion {
+		return nil, ErrInvalidVersion
+	}
+	if mt := hdr.MsgType(); mt < typeData || mt > typeGoAway {
+		return nil, ErrInvalidMsgType
+	}
+	return hdr, nil
+}
+
+// frameBodySize returns the number of bytes that follow hdr on the
+// wire. Only data frames carry a payload, sequenced frames are also
+// prefixed with their sequence number. Data frames larger than
+// maxSize are rejected.
+func frameBodySize(hdr header, maxSize uint32) (int, error) {
+	size := 0
+	if hdr.Flags()&flagSEQ == flagSEQ {
+		size += sizeOfSeq
+	}
+	if hdr.MsgType() == typeData {
+		if hdr.Length() > maxSize {
+			return 0, ErrFrameTooLarge
+		}
+		size += int(hdr.Length())
+	}
+	return size, nil
+}
+
+// parseFrame validates the frame at the start of b, returning its
+// header and the body that follows it. Data frames larger than maxSize
+// are rejected before looking at the body. Like parseHeader it only
+// looks at b, and the results alias it.
+func parseFrame(b []byte, maxSize uint32) (header, []byte, error) {
+	hdr, err := parseHeader(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	size, err := frameBodySize(hdr, maxSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(b)-headerSize < size {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return hdr, b[headerSize : headerSize+size], nil
+}
@@ -0,0 +1,36 @@
+//go:build go1.18
+// +build go1.18
+
+package yamux
+
+import (
+	"testing"
+)
+
+func FuzzParseFrame(f *testing.F) {
+	f.Add(testFrame(typeData, flagSYN, 3, []byte("abc")))
+	f.Add(testFrame(typeData, flagSEQ|flagCHK, 8, make([]byte, 12)))
+	f.Add(testFrame(typeWindowUpdate, flagACK, 1<<20, nil))
+	f.Add(testFrame(typePing, 0, 7, nil))
+	f.Add(testFrame(typeGoAway, 0, goAwayProtoErr, nil))
+	f.Add([]byte{protoVersion})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		hdr, body, err := parseFrame(b, initialStreamWindow)
+		if err != nil {
+			if hdr != nil || body != nil {
+				t.Fatalf("results on error: %v", err)
+			}
+			return
+		}
+		if hdr.Version() != protoVersion || hdr.MsgType() > typeGoAway {
+			t.Fatalf("accepted bad header: %v", hdr)
+		}
+		if hdr.MsgType() == typeData && hdr.Length() > initialStreamWindow {
+			t.Fatalf("accepted large frame: %v", hdr)
+		}
+		if size, _ := frameBodySize(hdr, initialStreamWindow); len(body) != size {
+			t.Fatalf("bad body size: %d, expected %d", len(body), size)
+		}
+	})
+}
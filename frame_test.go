@@ -0,0 +1,53 @@
+package yamux
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func testFrame(msgType uint8, flags uint16, length uint32, body []byte) []byte {
+	hdr := header(make([]byte, headerSize))
+	hdr.encode(msgType, flags, 1, length)
+	return append([]byte(hdr), body...)
+}
+
+func TestParseFrame(t *testing.T) {
+	type tcase struct {
+		name string
+		in   []byte
+		body []byte
+		err  error
+	}
+	badVersion := testFrame(typeData, 0, 0, nil)
+	badVersion[0] = protoVersion + 1
+
+	cases := []tcase{
+		{"empty", nil, nil, io.ErrUnexpectedEOF},
+		{"short header", testFrame(typePing, 0, 0, nil)[:headerSize-1], nil, io.ErrUnexpectedEOF},
+		{"bad version", badVersion, nil, ErrInvalidVersion},
+		{"bad type", testFrame(typeGoAway+1, 0, 0, nil), nil, ErrInvalidMsgType},
+		{"ping", testFrame(typePing, flagSYN, 42, []byte("next")), []byte{}, nil},
+		{"window update", testFrame(typeWindowUpdate, 0, 1<<20, nil), []byte{}, nil},
+		{"data", testFrame(typeData, 0, 3, []byte("abcdef")), []byte("abc"), nil},
+		{"short data", testFrame(typeData, 0, 3, []byte("ab")), nil, io.ErrUnexpectedEOF},
+		{"large data", testFrame(typeData, 0, 17, make([]byte, 17)), nil, ErrFrameTooLarge},
+		{"sequenced data", testFrame(typeData, flagSEQ, 2, []byte("0123ab")), []byte("0123ab"), nil},
+		{"sequenced ping", testFrame(typePing, flagSEQ, 2, []byte("0123ab")), []byte("0123"), nil},
+	}
+	for _, tc := range cases {
+		hdr, body, err := parseFrame(tc.in, 16)
+		if err != tc.err {
+			t.Fatalf("%s: err: %v", tc.name, err)
+		}
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(hdr, tc.in[:headerSize]) {
+			t.Fatalf("%s: bad header: %v", tc.name, hdr)
+		}
+		if !bytes.Equal(body, tc.body) {
+			t.Fatalf("%s: bad body: %q", tc.name, body)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package yamux
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// SessionInterface is the method set of a Session that doesn't involve
+// the concrete *Stream, so code using a session can depend on it and be
+// tested against a mock instead. It embeds net.Listener, so a session
+// can be used to accept streams as connections.
+//
+// OpenStream, AcceptStream and their variants are left out because
+// they return a *Stream, which a mock can't provide. Code meant to be
+// mocked should use Open and Accept, which return the stream as a
+// net.Conn; a mock may return a StreamInterface there.
+type SessionInterface interface {
+	net.Listener
+
+	// Opening and accepting streams
+	Open() (net.Conn, error)
+	SetAcceptDeadline(t time.Time) error
+
+	// Liveness
+	Ping() (time.Duration, error)
+	SendKeepAlive() (time.Duration, error)
+	Heartbeat()
+
+	// Shutting down
+	GoAway() error
+	GoAwayWithMessage(msg string) error
+	RemoteGoAwayMessage() string
+	GoAwayReceived() bool
+	GoAwaySent() bool
+	SetGoAwayGrace(d time.Duration)
+	Drain(ctx context.Context) error
+	WaitGoAwayDrained(ctx context.Context) error
+	IsClosed() bool
+	CloseChan() <-chan struct{}
+	SendError() error
+	RecvError() error
+
+	// Introspection
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	NumStreams() int
+	Age() time.Duration
+	Token() []byte
+	EffectiveConfig() *Config
+	Stats() Stats
+	RecentlyClosed() []StreamSummary
+	FlowControlSnapshot() []StreamFlowState
+	SendBufferUsage() int64
+}
+
+// Session must implement SessionInterface
+var _ SessionInterface = (*Session)(nil)
+
+// StreamInterface covers the methods of a Stream used to read, write
+// and manage it, so code using streams can be tested against a mock
+// instead. It embeds net.Conn.
+type StreamInterface interface {
+	net.Conn
+
+	// Reading and writing
+	ReadAvailable(b []byte) (n int, more bool, err error)
+	ReadVectored(bufs [][]byte) (n int, err error)
+	SetMaxReadChunk(n int)
+	DrainInbound(limit int64) (int64, error)
+	ReadTimeout(b []byte, d time.Duration) (int, error)
+	WriteTimeout(b []byte, d time.Duration) (int, error)
+	WritableChan() <-chan struct{}
+	WriteWithAck(b []byte) (n int, acked <-chan error)
+	SetNoDelay(noDelay bool) error
+	Flush() error
+	LastReadFlags() uint16
+
+	// Closing
+	CloseRead() error
+	CloseWrite() error
+	Closed() (readClosed, writeClosed bool)
+	PeerClosedWrite() bool
+	SetContext(ctx context.Context)
+	SetIdleTimeout(d time.Duration)
+	WaitEstablished(ctx context.Context) error
+	Approve() error
+
+	// Flow control
+	SetWeight(w uint32)
+	Weight() uint32
+	SetRateLimit(bytesPerSec int64)
+	PauseReads()
+	ResumeReads() error
+	PeerPaused() bool
+	SetHighWaterCallback(fraction float64, cb func())
+	SendWindow() uint32
+	Shrink()
+
+	// Introspection
+	StreamID() uint32
+	Header() []byte
+	SetUserData(v interface{})
+	UserData() interface{}
+	State() StreamState
+	CreatedAt() time.Time
+	Age() time.Duration
+}
+
+// Stream must implement StreamInterface
+var _ StreamInterface = (*Stream)(nil)
@@ -0,0 +1,50 @@
+package yamux
+
+import (
+	"runtime"
+)
+
+// StreamHandle is the net.Conn returned by Session.Open and Accept if
+// ResetLeakedStreams is set. It forwards to the Stream, but unlike the
+// Stream it isn't referenced by the session, so it can be garbage
+// collected once the application drops it. A stream whose handle is
+// collected before it was closed is reset.
+type StreamHandle struct {
+	*Stream
+}
+
+// newStreamHandle returns a handle resetting stream when it's
+// collected, remembering where it was created if LeakedStreamStacks is
+// set
+func newStreamHandle(stream *Stream) *StreamHandle {
+	var site string
+	if stream.session.config.LeakedStreamStacks {
+		buf := make([]byte, 4096)
+		site = string(buf[:runtime.Stack(buf, false)])
+	}
+	h := &StreamHandle{Stream: stream}
+	runtime.SetFinalizer(h, func(h *StreamHandle) {
+		// Queueing the reset may block, and would hold up all
+		// finalizers of the process meanwhile
+		go h.Stream.resetLeaked(site)
+	})
+	return h
+}
+
+// resetLeaked resets a stream whose handle was collected, unless it
+// was closed already
+func (s *Stream) resetLeaked(site string) {
+	s.stateLock.Lock()
+	state := s.state
+	s.stateLock.Unlock()
+	switch state {
+	case StreamLocalClose, StreamClosed, StreamReset:
+		return
+	}
+	if site != "" {
+		s.session.logger.Printf("[WARN] yamux: resetting leaked stream %d, created at:\n%s", s.id, site)
+	} else {
+		s.session.logger.Printf("[WARN] yamux: resetting leaked stream %d", s.id)
+	}
+	s.session.resetStream(s.id)
+}
@@ -0,0 +1,76 @@
+package yamux
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// livenessHeader is the reserved stream header marking a stream
+// opened for an active liveness check.
+var livenessHeader = []byte("\x00yamux-liveness")
+
+const (
+	// livenessNonceSize is the size of the nonce echoed by the peer
+	livenessNonceSize = 8
+
+	// maxLivenessEchoes is how many liveness streams of the peer may
+	// be answered at a time. We only run one check at a time, so the
+	// limit just guards against peers flooding us with them.
+	maxLivenessEchoes = 4
+)
+
+// isLivenessHeader checks if a stream header marks a liveness stream
+func isLivenessHeader(meta []byte) bool {
+	return meta != nil && bytes.Equal(meta, livenessHeader)
+}
+
+// checkLiveness opens a liveness stream and waits for the peer to
+// echo a nonce, which requires its whole session to make progress.
+func (s *Session) checkLiveness() error {
+	stream, err := s.OpenStreamWithHeader(livenessHeader)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(s.config.ConnectionWriteTimeout))
+
+	nonce := make([]byte, livenessNonceSize)
+	if err := s.readRandom(nonce, rand.Read); err != nil {
+		return err
+	}
+	if _, err := stream.Write(nonce); err != nil {
+		return err
+	}
+
+	echo := make([]byte, livenessNonceSize)
+	if _, err := io.ReadFull(stream, echo); err != nil {
+		return err
+	}
+	if !bytes.Equal(nonce, echo) {
+		return ErrLivenessCheckFailed
+	}
+	return nil
+}
+
+// echoLiveness answers a liveness stream opened by the peer, counted
+// in livenessEchoes
+func (s *Session) echoLiveness(stream *Stream) {
+	defer atomic.AddInt32(&s.livenessEchoes, -1)
+	defer stream.Close()
+	if err := stream.sendWindowUpdate(); err != nil {
+		return
+	}
+	stream.SetDeadline(time.Now().Add(s.config.ConnectionWriteTimeout))
+
+	nonce := make([]byte, livenessNonceSize)
+	if _, err := io.ReadFull(stream, nonce); err != nil {
+		s.logger.Printf("[WARN] yamux: failed to read liveness nonce: %v", err)
+		return
+	}
+	if _, err := stream.Write(nonce); err != nil {
+		s.logger.Printf("[WARN] yamux: failed to echo liveness nonce: %v", err)
+	}
+}
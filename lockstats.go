@@ -0,0 +1,21 @@
+//go:build yamux_lockstats && go1.18
+// +build yamux_lockstats,go1.18
+
+package yamux
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// lockStats is set if lock contention is counted, see Stats. It is
+// enabled with the yamux_lockstats build tag.
+const lockStats = true
+
+// lockCounted locks mu, counting in contended if it was held
+func lockCounted(mu *sync.Mutex, contended *uint64) {
+	if !mu.TryLock() {
+		atomic.AddUint64(contended, 1)
+		mu.Lock()
+	}
+}
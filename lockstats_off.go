@@ -0,0 +1,17 @@
+//go:build !yamux_lockstats || !go1.18
+// +build !yamux_lockstats !go1.18
+
+package yamux
+
+import (
+	"sync"
+)
+
+// lockStats is set if lock contention is counted, see Stats. It is
+// enabled with the yamux_lockstats build tag.
+const lockStats = false
+
+// lockCounted locks mu. Contention is not counted in this build.
+func lockCounted(mu *sync.Mutex, contended *uint64) {
+	mu.Lock()
+}
@@ -8,12 +8,204 @@ import (
 	"time"
 )
 
+// AcceptOverflowPolicy controls what happens to an inbound stream
+// that arrives while the accept backlog is full.
+type AcceptOverflowPolicy int
+
+const (
+	// AcceptOverflowRST resets the new stream, leaving the peer free
+	// to retry the open.
+	AcceptOverflowRST AcceptOverflowPolicy = iota
+
+	// AcceptOverflowGoAway resets the new stream and sends a GoAway
+	// so the peer stops opening streams on this session. Streams that
+	// are already established are left alone.
+	AcceptOverflowGoAway
+)
+
+// AcceptOrder controls which of the streams waiting in the accept
+// backlog AcceptStream returns first.
+type AcceptOrder int
+
+const (
+	// AcceptFIFO accepts streams in the order they arrived. If the
+	// backlog is full, new streams are rejected.
+	AcceptFIFO AcceptOrder = iota
+
+	// AcceptLIFO accepts the most recently arrived stream first. If
+	// the backlog is full, the oldest waiting stream is reset to make
+	// room for the new one. This trades fairness for latency, as
+	// streams that waited longest are likely stale during a spike.
+	AcceptLIFO
+)
+
+// ChecksumMismatchPolicy controls what happens if the checksum of a
+// received data frame doesn't match.
+type ChecksumMismatchPolicy int
+
+const (
+	// ChecksumMismatchClose closes the session with a protocol error,
+	// and ErrChecksumMismatch is reported as the shutdown reason.
+	ChecksumMismatchClose ChecksumMismatchPolicy = iota
+
+	// ChecksumMismatchReset drops the frame and resets its stream,
+	// leaving the other streams alone.
+	ChecksumMismatchReset
+)
+
+// FlowControlViolationAction controls what happens if the peer sends
+// more data than the receive window it was granted.
+type FlowControlViolationAction int
+
+const (
+	// FlowControlViolationClose closes the session with a protocol
+	// error, and ErrRecvWindowExceeded is reported as the shutdown
+	// reason.
+	FlowControlViolationClose FlowControlViolationAction = iota
+
+	// FlowControlViolationReset drops the frame and resets its stream,
+	// leaving the other streams alone.
+	FlowControlViolationReset
+)
+
+// RecvBufferStrategy selects how streams buffer received data until it
+// is read.
+type RecvBufferStrategy int
+
+const (
+	// RecvBufferContiguous buffers data in one contiguous buffer. It
+	// is simple, but partial reads of a busy stream may move the rest
+	// of the buffered data.
+	RecvBufferContiguous RecvBufferStrategy = iota
+
+	// RecvBufferRing buffers data in a ring buffer, which never moves
+	// buffered data except to grow.
+	RecvBufferRing
+)
+
+// DuplicateSYNAction controls what happens if the peer opens a stream
+// with the ID of a stream that is still open.
+type DuplicateSYNAction int
+
+const (
+	// DuplicateSYNClose resets the stream and closes the session with
+	// a protocol error, reporting ErrDuplicateStream as the reason.
+	DuplicateSYNClose DuplicateSYNAction = iota
+
+	// DuplicateSYNReset resets the stream and ignores the SYN, leaving
+	// the other streams alone.
+	DuplicateSYNReset
+)
+
+// KeepAliveMode controls when the keep alive loop pings the peer.
+type KeepAliveMode int
+
+const (
+	// KeepAliveAlways pings every KeepAliveInterval, unless Heartbeat
+	// reported activity meanwhile.
+	KeepAliveAlways KeepAliveMode = iota
+
+	// KeepAliveOnIdleRecv only pings once nothing was received from
+	// the peer for KeepAliveInterval, as frames received prove that
+	// it is alive.
+	KeepAliveOnIdleRecv
+
+	// KeepAliveOnIdleBoth only pings once nothing was sent or
+	// received for KeepAliveInterval. A wedged peer is then detected
+	// once the streams stall on flow control.
+	KeepAliveOnIdleBoth
+)
+
 // Config is used to tune the Yamux session
 type Config struct {
 	// AcceptBacklog is used to limit how many streams may be
 	// waiting an accept.
 	AcceptBacklog int
 
+	// AcceptOverflowPolicy selects how a stream is rejected
+	// when the accept backlog is exceeded.
+	AcceptOverflowPolicy AcceptOverflowPolicy
+
+	// AcceptOrder selects which waiting stream is accepted first,
+	// and which one is reset when the backlog is exceeded.
+	AcceptOrder AcceptOrder
+
+	// MaxPendingOutboundSYNs bounds how many streams we opened may
+	// wait for the peer to accept them. Further opens block until one
+	// is accepted, pacing stream creation to what the peer absorbs.
+	// Zero uses the AcceptBacklog, assuming the peer uses the same.
+	MaxPendingOutboundSYNs int
+
+	// LoadMaxStreams and LoadMaxMemory are the high-water marks of
+	// the session load, the number of open streams and the bytes
+	// received but not read yet over all streams. While either is
+	// reached, streams opened by the peer are reset with a
+	// backpressure code, which the opener sees as ErrPeerOverloaded.
+	// Stats reports the load as a factor of the marks. Zero disables
+	// a mark. Evaluating LoadMaxMemory visits every stream, so it
+	// costs proportionally to the number of streams per SYN.
+	LoadMaxStreams int
+	LoadMaxMemory  int64
+
+	// RequireStreamApproval holds accepted streams until the
+	// application admits them with Stream.Approve, which acknowledges
+	// the stream to the peer. Until then the stream can't be read or
+	// written, and closing it rejects it. The peer may send up to
+	// MaxUnapprovedData bytes before approval; streams exceeding that
+	// or not approved within ApprovalTimeout of being accepted are
+	// reset.
+	RequireStreamApproval bool
+
+	// MaxUnapprovedData is how many bytes the peer may send on a
+	// stream awaiting approval. Zero uses a default of 16KB.
+	MaxUnapprovedData uint32
+
+	// ApprovalTimeout is how long an accepted stream may await
+	// approval. Zero uses a default of 10 seconds.
+	ApprovalTimeout time.Duration
+
+	// DefaultStreamIdleTimeout is the idle timeout of new streams, see
+	// Stream.SetIdleTimeout. Zero disables it.
+	DefaultStreamIdleTimeout time.Duration
+
+	// ResetLeakedStreams makes Session.Open and Accept return a
+	// StreamHandle, which resets its stream if it's garbage collected
+	// before the stream was closed. This is a safety net against
+	// streams the application forgets to close, which never return
+	// their window to the peer. The reset happens whenever the GC gets
+	// to it, possibly much later or never, so it is no substitute for
+	// closing streams. Streams returned by OpenStream and AcceptStream
+	// are referenced by the session and never collected, as is the
+	// Stream of a handle once it's kept outside of the handle.
+	ResetLeakedStreams bool
+
+	// LeakedStreamStacks records the stack that opened or accepted a
+	// stream with ResetLeakedStreams, to log it once the stream leaks.
+	// It's costly, so it's meant for debugging.
+	LeakedStreamStacks bool
+
+	// OpenRetries is how many times opening a stream is retried if
+	// the peer refuses it because its accept backlog is full or it is
+	// overloaded. Other resets are not retried. When set, OpenStream
+	// and OpenStreamWithHeader wait up to ConnectionWriteTimeout for
+	// the peer to accept the stream, returning ErrStreamRejected or
+	// ErrPeerOverloaded once the retries are used up. Streams are not
+	// retried after a GoAway.
+	OpenRetries int
+
+	// OpenRetryBackoff is the delay before the first retry of a
+	// rejected stream. It doubles with every further retry.
+	OpenRetryBackoff time.Duration
+
+	// DuplicateSYNAction selects how a SYN for a stream that is
+	// still open is handled.
+	DuplicateSYNAction DuplicateSYNAction
+
+	// GoAwayOnStreamIDExhaustion sends a GoAway once we run out of
+	// stream IDs, signalling the peer that the session should be
+	// replaced by a new one.
+	GoAwayOnStreamIDExhaustion bool
+
 	// EnableKeepalive is used to do a period keep alive
 	// messages using a ping.
 	EnableKeepAlive bool
@@ -21,16 +213,288 @@ type Config struct {
 	// KeepAliveInterval is how often to perform the keep alive
 	KeepAliveInterval time.Duration
 
+	// KeepAliveMode selects whether keep alive pings are skipped while
+	// there is traffic on the session
+	KeepAliveMode KeepAliveMode
+
+	// ActiveLivenessCheck makes every keep alive round also open a
+	// short lived stream and wait for the peer to echo a nonce on it.
+	// This detects peers whose session is wedged even though they
+	// still answer pings. The peer must support liveness streams.
+	ActiveLivenessCheck bool
+
+	// KeepAliveRetries is how many times a failed keep alive ping is
+	// retried before the session is closed with ErrKeepAliveTimeout,
+	// to ride out short network outages.
+	KeepAliveRetries int
+
+	// KeepAliveBackoff is the delay before the first retry of a failed
+	// keep alive ping. It doubles with every further retry. Zero uses
+	// a tenth of the KeepAliveInterval.
+	KeepAliveBackoff time.Duration
+
+	// MaxRTT is the keep alive round trip time above which a ping is
+	// counted as a violation. Zero disables the check.
+	MaxRTT time.Duration
+
+	// MaxRTTViolations is how many consecutive keep alive pings may
+	// exceed MaxRTT before the session is closed with ErrRTTExceeded.
+	MaxRTTViolations int
+
+	// MaxOutstandingPings is how many pings, sent by Ping or keep
+	// alive, may go unanswered before the session is closed with
+	// ErrPingsUnanswered. A ping counts as unanswered once it timed
+	// out, and any answer from the peer resets the count, so pings
+	// that are merely in flight concurrently never trip the limit.
+	// Zero disables the check.
+	MaxOutstandingPings int
+
+	// Rand is the source of randomness for ping IDs, liveness check
+	// nonces and the session token, for instance a seeded generator
+	// for reproducible tests or a specific CSPRNG. Reads are
+	// serialized across all sessions, so it may be shared by sessions
+	// using clones of a config. If nil, pings use sequential IDs,
+	// nonces come from math/rand and the token from crypto/rand.
+	Rand io.Reader
+
 	// ConnectionWriteTimeout is meant to be a "safety valve" timeout after
 	// we which will suspect a problem with the underlying connection and
 	// close it. This is only applied to writes, where's there's generally
 	// an expectation that things will move along quickly.
 	ConnectionWriteTimeout time.Duration
 
+	// WriteErrorClassifier decides which errors writing to the
+	// connection are transient. Writes failing with those are retried
+	// after a short backoff, for up to ConnectionWriteTimeout, rather
+	// than closing the session. It must only accept errors after
+	// which the connection is still usable and the failed write left
+	// nothing half written beyond what it reported. If nil, all
+	// write errors close the session.
+	WriteErrorClassifier func(err error) bool
+
+	// HeaderReadTimeout bounds how long reading a single frame may
+	// take once its first byte arrived. A peer stalling mid frame
+	// tears down the session with ErrFrameReadTimeout. Zero disables
+	// the limit; waiting for the next frame to start is never limited.
+	HeaderReadTimeout time.Duration
+
+	// Watchdog, if set, tears down the session with ErrSessionStalled
+	// when the send or recv loop has work but makes no progress for
+	// this long, logging a dump of all goroutines to help diagnose the
+	// hang. A slow connection also stalls the loops, so it should be
+	// well above the time writing or reading a frame may take.
+	Watchdog time.Duration
+
 	// MaxStreamWindowSize is used to control the maximum
-	// window size that we allow for a stream.
+	// window size that we allow for a stream. It only applies to the
+	// data we receive; the peer advertises its own window for the data
+	// we send, so both sides may use different sizes. Every stream
+	// starts out with the protocol's 256KB window in both directions.
 	MaxStreamWindowSize uint32
 
+	// MaxSendBuffer caps the number of bytes sent across all streams
+	// that the peer has not yet returned window credit for. Once it is
+	// reached, Write blocks regardless of the advertised windows, which
+	// protects us from peers advertising huge windows but stalling.
+	// It should be at least half of the peers window, since the peer
+	// only returns credit after that much was consumed. Zero disables
+	// the limit.
+	MaxSendBuffer int64
+
+	// FailFastOnSendBufferFull makes Write return ErrSendBufferFull
+	// instead of blocking when MaxSendBuffer is reached.
+	FailFastOnSendBufferFull bool
+
+	// ReadAheadFactor is the fraction of the stream window that has to
+	// be consumed by the reader before a window update is sent. Lower
+	// values return credit earlier, keeping the pipe full on high
+	// latency links at the cost of more window updates. Zero uses the
+	// default of one half.
+	ReadAheadFactor float64
+
+	// MinWindowUpdate is the smallest window update a stream sends,
+	// smaller credit is held back until it adds up. This avoids
+	// floods of tiny updates with a small ReadAheadFactor or
+	// WindowUpdateInterval. Credit is always returned once the peer
+	// used up its window, so it can't stall. Window updates carrying
+	// flags, such as the ACK, are sent regardless. Zero disables the
+	// minimum.
+	MinWindowUpdate uint32
+
+	// MaxQueuedFramesPerStream bounds the number of data frames a
+	// stream buffers before it holds back window updates, until its
+	// buffer was read empty. It protects against peers sending lots
+	// of tiny frames, which cost more to handle than their size
+	// suggests. The peer may still use up the window it was granted.
+	// Zero disables the limit.
+	MaxQueuedFramesPerStream int
+
+	// BatchWindowUpdates leaves returning window credit to the send
+	// loop, which merges the credit a stream returned since its last
+	// round into a single window update. This saves control frames
+	// with bursty readers while the connection is busy; an idle send
+	// loop sends the update right away.
+	BatchWindowUpdates bool
+
+	// WindowUpdateInterval is the longest credit below the threshold
+	// set by ReadAheadFactor is held back when BatchWindowUpdates is
+	// set. Credit is returned once the threshold is reached or the
+	// interval passed, whichever comes first. A small interval keeps
+	// latency low, a large one saves window updates. Zero only returns
+	// credit once the threshold is reached, flushing it right away.
+	WindowUpdateInterval time.Duration
+
+	// MaxCoalesceBytes enables write coalescing: the send loop
+	// collects the frames it sends in a buffer of this size, and
+	// writes them to the connection in one go once the buffer is full
+	// or there is nothing else to send, see CoalesceDelay. This saves
+	// writes to the connection with many small frames at the cost of
+	// latency. The cap counts bytes on the wire and frames are not
+	// split to fit it: a frame larger than the room left is written
+	// through after the buffered ones. It is unrelated to
+	// MaxFrameSize, which limits received frames; data frames are sent
+	// in parts of at most 64KB, so a cap above that collects several
+	// of them. A Write only returns once its frames left the buffer,
+	// which may take up to CoalesceDelay. Close writes the buffered
+	// frames, waiting up to ConnectionWriteTimeout, before closing the
+	// connection. Zero disables coalescing.
+	MaxCoalesceBytes int
+
+	// CoalesceDelay is how long coalesced frames may wait for more,
+	// counted from the first one, see MaxCoalesceBytes. Zero writes
+	// them as soon as the send queue runs empty.
+	CoalesceDelay time.Duration
+
+	// ExchangeSessionToken makes both sides exchange a random session
+	// token when the session is established, see Session.Token. It
+	// helps the application correlate a session with the one it
+	// replaces after a reconnect; yamux doesn't resume any state
+	// itself. The peer must support it, otherwise there is no token.
+	ExchangeSessionToken bool
+
+	// EnableGoAwayMessage allows attaching a short reason to a GoAway
+	// with Session.GoAwayWithMessage, which the peer reports with
+	// RemoteGoAwayMessage and in its logs. The peer must support it,
+	// otherwise only the GoAway is sent.
+	EnableGoAwayMessage bool
+
+	// EnableStreamPause makes Stream.PauseReads tell the peer to stop
+	// writing to the stream until ResumeReads, rather than only holding
+	// back credit. The peer then knows the pause is intended and blocks
+	// writes even with send window left, see Stream.PeerPaused. The
+	// peer must support it, otherwise pausing falls back to flow
+	// control.
+	EnableStreamPause bool
+
+	// ExposeSpareFlags reports the flag bits of received data frames
+	// that yamux doesn't use via Stream.LastReadFlags. It is meant for
+	// experimental protocols, future versions may assign meaning to
+	// these bits.
+	ExposeSpareFlags bool
+
+	// StrictProtocol treats frames that are unusual but harmless as
+	// protocol errors, closing the session: currently window updates
+	// for streams that were never opened. Window updates for closed
+	// streams are always discarded, as they race with closing.
+	StrictProtocol bool
+
+	// MaxFrameSize is the largest data frame payload accepted from
+	// the peer. Larger frames close the session with ErrFrameTooLarge
+	// before any of the payload is buffered. It must not be below the
+	// largest frame the peer sends; this implementation splits frames
+	// at 64KB, but other implementations may send up to the stream
+	// window at once. Zero accepts up to MaxStreamWindowSize.
+	MaxFrameSize uint32
+
+	// MaxStreamHeaderSize bounds the size of stream headers we send
+	// and accept. Streams opened with a larger header are reset
+	// before the header is buffered. Zero uses the default of 4KB.
+	MaxStreamHeaderSize uint32
+
+	// RecvBufferStrategy selects the receive buffer of streams.
+	RecvBufferStrategy RecvBufferStrategy
+
+	// BufferPool provides the memory of stream receive buffers, and
+	// may be shared by many sessions to reuse memory between bursts,
+	// see NewBufferPool. A stream hands its buffer back once reading
+	// returned io.EOF or a reset error, and on CloseRead or Shrink;
+	// other buffers are left to the garbage collector. If nil,
+	// buffers are allocated as needed.
+	BufferPool BufferPool
+
+	// ReorderWindow enables the frame reordering extension when
+	// positive. Frames are stamped with sequence numbers and up to
+	// ReorderWindow frames arriving ahead of their predecessor are
+	// held back until it arrives. Both peers must support and enable
+	// the extension; otherwise strict ordering is assumed.
+	ReorderWindow int
+
+	// FrameCodec, if set, is used to encode data frame payloads,
+	// e.g. to compress them with FlateCodec. It is only used if the
+	// peer is configured with a codec of the same ID, otherwise
+	// payloads are sent as is. Encoding costs CPU time on both sides
+	// and only pays off on bandwidth constrained links.
+	FrameCodec FrameCodec
+
+	// EnableChecksum adds a CRC32C checksum to data frame payloads
+	// and verifies it on receipt, to detect corruption the transport
+	// didn't catch. It is only used if the peer enables it as well.
+	EnableChecksum bool
+
+	// ChecksumMismatchPolicy selects how a data frame with a bad
+	// checksum is handled.
+	ChecksumMismatchPolicy ChecksumMismatchPolicy
+
+	// FlowControlViolationAction selects how a data frame exceeding
+	// the receive window of its stream is handled.
+	FlowControlViolationAction FlowControlViolationAction
+
+	// MaxSessionLifetime, if set, retires the session once it is that
+	// old, e.g. to force rotating the keys of the underlying conn. The
+	// session sends a GoAway and closes once all streams are closed,
+	// just like Session.Drain, which must not run at the same time.
+	// New streams should be opened on a new session once GoAwaySent
+	// reports true.
+	MaxSessionLifetime time.Duration
+
+	// MaxSessionLifetimeGrace, if set, limits how long a retiring
+	// session waits for its streams to close before closing them.
+	MaxSessionLifetimeGrace time.Duration
+
+	// PreserveDataOnClose keeps the data streams received but didn't
+	// read yet when the session is closed, so it can still be read
+	// before Read returns io.EOF. This includes streams that were
+	// closed for writing but not by the peer. Otherwise the data is
+	// discarded and Read returns io.EOF right away. DefaultConfig
+	// enables it.
+	PreserveDataOnClose bool
+
+	// ClosedStreamHistory is the number of closed streams whose
+	// summaries are kept for Session.RecentlyClosed. Zero disables it.
+	ClosedStreamHistory int
+
+	// SessionRateLimit, if positive, limits the rate data is sent at
+	// by all streams of the session combined, in bytes per second.
+	// Control frames such as keepalives are not limited. Bursts of up
+	// to one second worth of data are allowed after the session was
+	// idle. Stream.SetRateLimit can limit single streams further.
+	// Writes held back by the limit are not subject to
+	// ConnectionWriteTimeout; use write deadlines to bound them.
+	SessionRateLimit int64
+
+	// RecvWorkers is the number of goroutines delivering received
+	// stream frames. Headers are always parsed by a single goroutine;
+	// with more than one worker, payloads are handed to the worker of
+	// their stream, which may help sessions with many busy streams.
+	// Frames of a stream are delivered in order. Zero or one delivers
+	// frames on the recv goroutine.
+	RecvWorkers int
+
+	// TraceFunc, if set, is invoked synchronously for every significant
+	// state transition of the session and its streams. It must not
+	// block and must not call back into the session.
+	TraceFunc func(ev TraceEvent)
+
 	// LogOutput is used to control the log destination. Either Logger or
 	// LogOutput can be set, not both.
 	LogOutput io.Writer
@@ -46,23 +510,161 @@ func DefaultConfig() *Config {
 		AcceptBacklog:          256,
 		EnableKeepAlive:        true,
 		KeepAliveInterval:      30 * time.Second,
+		MaxRTTViolations:       3,
 		ConnectionWriteTimeout: 10 * time.Second,
 		MaxStreamWindowSize:    initialStreamWindow,
+		MaxStreamHeaderSize:    defaultStreamHeaderSize,
+		RecvWorkers:            1,
+		PreserveDataOnClose:    true,
 		LogOutput:              os.Stderr,
 	}
 }
 
+// maxPendingSYNs returns how many outbound SYNs may be pending
+func maxPendingSYNs(config *Config) int {
+	if config.MaxPendingOutboundSYNs > 0 {
+		return config.MaxPendingOutboundSYNs
+	}
+	return config.AcceptBacklog
+}
+
+// Clone returns a copy of the config that can be changed without
+// affecting the original, e.g. to set up a new session after the
+// previous one died. It is a shallow copy, so the fields holding
+// references, such as Logger, LogOutput, FrameCodec, TraceFunc, Rand,
+// BufferPool and WriteErrorClassifier, are shared with the original.
+func (c *Config) Clone() *Config {
+	clone := *c
+	return &clone
+}
+
 // VerifyConfig is used to verify the sanity of configuration
 func VerifyConfig(config *Config) error {
 	if config.AcceptBacklog <= 0 {
 		return fmt.Errorf("backlog must be positive")
 	}
+	switch config.AcceptOverflowPolicy {
+	case AcceptOverflowRST, AcceptOverflowGoAway:
+	default:
+		return fmt.Errorf("unknown accept overflow policy %d", config.AcceptOverflowPolicy)
+	}
+	switch config.AcceptOrder {
+	case AcceptFIFO, AcceptLIFO:
+	default:
+		return fmt.Errorf("unknown accept order %d", config.AcceptOrder)
+	}
+	switch config.RecvBufferStrategy {
+	case RecvBufferContiguous, RecvBufferRing:
+	default:
+		return fmt.Errorf("unknown recv buffer strategy %d", config.RecvBufferStrategy)
+	}
+	switch config.DuplicateSYNAction {
+	case DuplicateSYNClose, DuplicateSYNReset:
+	default:
+		return fmt.Errorf("unknown duplicate SYN action %d", config.DuplicateSYNAction)
+	}
+	switch config.KeepAliveMode {
+	case KeepAliveAlways, KeepAliveOnIdleRecv, KeepAliveOnIdleBoth:
+	default:
+		return fmt.Errorf("unknown keep alive mode %d", config.KeepAliveMode)
+	}
 	if config.KeepAliveInterval == 0 {
 		return fmt.Errorf("keep-alive interval must be positive")
 	}
+	if config.MaxPendingOutboundSYNs < 0 {
+		return fmt.Errorf("MaxPendingOutboundSYNs must not be negative")
+	}
+	if config.LoadMaxStreams < 0 {
+		return fmt.Errorf("LoadMaxStreams must not be negative")
+	}
+	if config.LoadMaxMemory < 0 {
+		return fmt.Errorf("LoadMaxMemory must not be negative")
+	}
+	if config.MaxUnapprovedData > config.MaxStreamWindowSize {
+		return fmt.Errorf("MaxUnapprovedData must not exceed MaxStreamWindowSize")
+	}
+	if config.ApprovalTimeout < 0 {
+		return fmt.Errorf("ApprovalTimeout must not be negative")
+	}
+	if config.DefaultStreamIdleTimeout < 0 {
+		return fmt.Errorf("DefaultStreamIdleTimeout must not be negative")
+	}
+	if config.OpenRetries < 0 || config.OpenRetryBackoff < 0 {
+		return fmt.Errorf("open retries and backoff must not be negative")
+	}
+	if config.KeepAliveRetries < 0 || config.KeepAliveBackoff < 0 {
+		return fmt.Errorf("keep-alive retries and backoff must not be negative")
+	}
+	if config.MaxRTT < 0 {
+		return fmt.Errorf("max RTT must not be negative")
+	}
+	if config.MaxOutstandingPings < 0 {
+		return fmt.Errorf("MaxOutstandingPings must not be negative")
+	}
+	if config.MaxRTT > 0 && config.MaxRTTViolations <= 0 {
+		return fmt.Errorf("MaxRTTViolations must be positive when MaxRTT is set")
+	}
+	if config.HeaderReadTimeout < 0 {
+		return fmt.Errorf("header read timeout must not be negative")
+	}
+	if config.Watchdog < 0 {
+		return fmt.Errorf("watchdog must not be negative")
+	}
 	if config.MaxStreamWindowSize < initialStreamWindow {
 		return fmt.Errorf("MaxStreamWindowSize must be larger than %d", initialStreamWindow)
 	}
+	if config.MaxSendBuffer != 0 && config.MaxSendBuffer < int64(initialStreamWindow) {
+		return fmt.Errorf("MaxSendBuffer must be zero or at least %d", initialStreamWindow)
+	}
+	if config.ReadAheadFactor < 0 || config.ReadAheadFactor > 1 {
+		return fmt.Errorf("ReadAheadFactor must be between 0 and 1")
+	}
+	if config.MinWindowUpdate > config.MaxStreamWindowSize {
+		return fmt.Errorf("MinWindowUpdate must not exceed MaxStreamWindowSize")
+	}
+	if config.MaxQueuedFramesPerStream < 0 {
+		return fmt.Errorf("MaxQueuedFramesPerStream must not be negative")
+	}
+	if config.WindowUpdateInterval < 0 {
+		return fmt.Errorf("WindowUpdateInterval must not be negative")
+	}
+	if config.MaxCoalesceBytes != 0 && config.MaxCoalesceBytes < headerSize {
+		return fmt.Errorf("MaxCoalesceBytes must be at least %d", headerSize)
+	}
+	if config.CoalesceDelay < 0 {
+		return fmt.Errorf("CoalesceDelay must not be negative")
+	}
+	if config.CoalesceDelay > 0 && config.MaxCoalesceBytes == 0 {
+		return fmt.Errorf("CoalesceDelay requires MaxCoalesceBytes")
+	}
+	if config.MaxStreamHeaderSize > initialStreamWindow {
+		return fmt.Errorf("MaxStreamHeaderSize must not exceed %d", initialStreamWindow)
+	}
+	if config.ReorderWindow < 0 {
+		return fmt.Errorf("reorder window must not be negative")
+	}
+	if config.MaxSessionLifetime < 0 || config.MaxSessionLifetimeGrace < 0 {
+		return fmt.Errorf("session lifetime must not be negative")
+	}
+	if config.ClosedStreamHistory < 0 {
+		return fmt.Errorf("closed stream history must not be negative")
+	}
+	if config.SessionRateLimit < 0 {
+		return fmt.Errorf("session rate limit must not be negative")
+	}
+	if config.RecvWorkers < 0 {
+		return fmt.Errorf("recv workers must not be negative")
+	}
+	switch config.ChecksumMismatchPolicy {
+	case ChecksumMismatchClose, ChecksumMismatchReset:
+	default:
+		return fmt.Errorf("unknown checksum mismatch policy %d", config.ChecksumMismatchPolicy)
+	}
+	switch config.FlowControlViolationAction {
+	case FlowControlViolationClose, FlowControlViolationReset:
+	default:
+		return fmt.Errorf("unknown flow control violation action %d", config.FlowControlViolationAction)
+	}
 	if config.LogOutput != nil && config.Logger != nil {
 		return fmt.Errorf("both Logger and LogOutput may not be set, select one")
 	} else if config.LogOutput == nil && config.Logger == nil {
@@ -73,7 +675,8 @@ func VerifyConfig(config *Config) error {
 
 // Server is used to initialize a new server-side connection.
 // There must be at most one server-side connection. If a nil config is
-// provided, the DefaultConfiguration will be used.
+// provided, the DefaultConfiguration will be used. The config is copied,
+// so changing it later does not affect the session.
 func Server(conn io.ReadWriteCloser, config *Config) (*Session, error) {
 	if config == nil {
 		config = DefaultConfig()
@@ -81,11 +684,12 @@ func Server(conn io.ReadWriteCloser, config *Config) (*Session, error) {
 	if err := VerifyConfig(config); err != nil {
 		return nil, err
 	}
-	return newSession(config, conn, false), nil
+	return newSession(config.Clone(), conn, false), nil
 }
 
 // Client is used to initialize a new client-side connection.
-// There must be at most one client-side connection.
+// There must be at most one client-side connection. The config is
+// copied, so changing it later does not affect the session.
 func Client(conn io.ReadWriteCloser, config *Config) (*Session, error) {
 	if config == nil {
 		config = DefaultConfig()
@@ -94,5 +698,5 @@ func Client(conn io.ReadWriteCloser, config *Config) (*Session, error) {
 	if err := VerifyConfig(config); err != nil {
 		return nil, err
 	}
-	return newSession(config, conn, true), nil
+	return newSession(config.Clone(), conn, true), nil
 }
@@ -1,7 +1,10 @@
 package yamux
 
 import (
+	"io"
 	"net"
+	"reflect"
+	"sync/atomic"
 	"testing"
 
 	"golang.org/x/net/nettest"
@@ -41,3 +44,49 @@ func TestConn(t *testing.T) {
 		return
 	})
 }
+
+func TestConfig_Clone(t *testing.T) {
+	conf := testConf()
+	clone := conf.Clone()
+	if !reflect.DeepEqual(clone, conf) {
+		t.Fatalf("bad: %#v", clone)
+	}
+	clone.AcceptBacklog = 1
+	if conf.AcceptBacklog == 1 {
+		t.Fatalf("original should not change")
+	}
+
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+	if client.config == conf || client.config == server.config {
+		t.Fatalf("config should be copied")
+	}
+
+	// Changing the config doesn't affect the live sessions
+	conf.AcceptBacklog = 1
+	conf.MaxStreamWindowSize = 2 * initialStreamWindow
+	if client.config.AcceptBacklog != 64 || server.config.MaxStreamWindowSize != initialStreamWindow {
+		t.Fatalf("bad: %#v", client.config)
+	}
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	if _, err := stream.Write(make([]byte, initialStreamWindow)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(stream2, make([]byte, initialStreamWindow)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if w := atomic.LoadUint32(&stream.sendWindow); w > initialStreamWindow {
+		t.Fatalf("bad: %d", w)
+	}
+}
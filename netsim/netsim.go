@@ -0,0 +1,200 @@
+// Package netsim simulates network links for testing, for instance to
+// test yamux sessions against a link with a high bandwidth-delay
+// product.
+package netsim
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// errDeadline is returned by Write once the write deadline passed
+type errDeadline struct{}
+
+func (errDeadline) Error() string   { return "i/o deadline reached" }
+func (errDeadline) Timeout() bool   { return true }
+func (errDeadline) Temporary() bool { return true }
+
+// ErrClosed is returned by Write once the conn is closed
+var ErrClosed = errors.New("netsim: use of closed conn")
+
+// closeGrace is how long Close waits for the data in flight to be
+// written after the last of it was due
+const closeGrace = time.Second
+
+// WrapConn returns a conn that delays the data written to conn as if it
+// was sent over a link with the given one way latency and bandwidth, in
+// bytes per second. Write blocks for as long as it takes to send the
+// data at the bandwidth, and the data arrives latency later. Zero
+// disables either limit. Reads are passed through, so both ends of a
+// connection need to be wrapped to simulate a round trip.
+func WrapConn(conn net.Conn, latency time.Duration, bandwidth int64) net.Conn {
+	c := &linkConn{
+		Conn:      conn,
+		latency:   latency,
+		bandwidth: bandwidth,
+		queueCh:   make(chan struct{}, 1),
+		doneCh:    make(chan struct{}),
+	}
+	go c.deliver()
+	return c
+}
+
+// packet is data in flight
+type packet struct {
+	data []byte
+	due  time.Time
+}
+
+// linkConn is a conn wrapped by WrapConn
+type linkConn struct {
+	net.Conn
+	latency   time.Duration
+	bandwidth int64
+
+	// writeLock serializes writes, sentAt is the time the link is
+	// done sending the data written so far
+	writeLock sync.Mutex
+	sentAt    time.Time
+
+	// lock protects the fields below
+	lock     sync.Mutex
+	queue    []packet
+	err      error
+	closed   bool
+	deadline time.Time
+
+	queueCh chan struct{}
+	doneCh  chan struct{}
+}
+
+// Write implements net.Conn
+func (c *linkConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.lock.Lock()
+	err, closed, deadline := c.err, c.closed, c.deadline
+	c.lock.Unlock()
+	switch {
+	case closed:
+		return 0, ErrClosed
+	case err != nil:
+		return 0, err
+	case !deadline.IsZero() && !time.Now().Before(deadline):
+		return 0, errDeadline{}
+	}
+
+	// Sending starts once the link is done with the previous data
+	sentAt := time.Now()
+	if c.sentAt.After(sentAt) {
+		sentAt = c.sentAt
+	}
+	if c.bandwidth > 0 {
+		sentAt = sentAt.Add(time.Duration(int64(len(b)) * int64(time.Second) / c.bandwidth))
+	}
+	if !deadline.IsZero() && deadline.Before(sentAt) {
+		time.Sleep(time.Until(deadline))
+		return 0, errDeadline{}
+	}
+	c.sentAt = sentAt
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	c.lock.Lock()
+	c.queue = append(c.queue, packet{data: data, due: sentAt.Add(c.latency)})
+	c.lock.Unlock()
+	select {
+	case c.queueCh <- struct{}{}:
+	default:
+	}
+
+	// Block while the data is being sent
+	time.Sleep(time.Until(sentAt))
+	return len(b), nil
+}
+
+// deliver is a long running goroutine writing the data in flight to
+// the wrapped conn once it is due
+func (c *linkConn) deliver() {
+	defer close(c.doneCh)
+	for {
+		c.lock.Lock()
+		if len(c.queue) == 0 {
+			closed := c.closed
+			c.lock.Unlock()
+			if closed {
+				return
+			}
+			<-c.queueCh
+			continue
+		}
+		p := c.queue[0]
+		c.queue[0] = packet{}
+		c.queue = c.queue[1:]
+		c.lock.Unlock()
+
+		if wait := time.Until(p.due); wait > 0 {
+			time.Sleep(wait)
+		}
+		if _, err := c.Conn.Write(p.data); err != nil {
+			c.lock.Lock()
+			c.err = err
+			c.queue = nil
+			c.lock.Unlock()
+		}
+	}
+}
+
+// Close delivers the data in flight and closes the wrapped conn. If
+// the far side doesn't read the data, it is dropped shortly after it
+// was due.
+func (c *linkConn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	wait := closeGrace
+	if n := len(c.queue); n > 0 {
+		wait += time.Until(c.queue[n-1].due)
+	}
+	c.lock.Unlock()
+	select {
+	case c.queueCh <- struct{}{}:
+	default:
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-c.doneCh:
+		return c.Conn.Close()
+	case <-timer.C:
+	}
+
+	// Unblock the pending write
+	err := c.Conn.Close()
+	<-c.doneCh
+	return err
+}
+
+// SetDeadline implements net.Conn
+func (c *linkConn) SetDeadline(t time.Time) error {
+	if err := c.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn. Data that was accepted before
+// the deadline is still delivered.
+func (c *linkConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = t
+	return nil
+}
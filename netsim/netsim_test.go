@@ -0,0 +1,125 @@
+package netsim
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/yamux"
+)
+
+func testPipe(latency time.Duration, bandwidth int64) (*linkConn, *linkConn) {
+	a, b := yamux.NewMemoryPipeConfig(yamux.MemoryPipeConfig{BufferSize: 1024 * 1024})
+	return WrapConn(a, latency, bandwidth).(*linkConn), WrapConn(b, latency, bandwidth).(*linkConn)
+}
+
+func TestWrapConn_Latency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	a, b := testPipe(latency, 0)
+	defer a.Close()
+	defer b.Close()
+
+	start := time.Now()
+	if _, err := a.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := b.Write(buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(a, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rtt := time.Since(start); rtt < 2*latency || rtt > 4*latency {
+		t.Fatalf("bad: %v", rtt)
+	}
+}
+
+func TestWrapConn_Bandwidth(t *testing.T) {
+	const bandwidth = 1024 * 1024
+	a, b := testPipe(0, bandwidth)
+	defer b.Close()
+
+	go func() {
+		for i := 0; i < 16; i++ {
+			a.Write(make([]byte, bandwidth/32))
+		}
+		a.Close()
+	}()
+
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, b)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != bandwidth/2 {
+		t.Fatalf("bad: %d", n)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+}
+
+func TestWrapConn_WriteDeadline(t *testing.T) {
+	a, b := testPipe(0, 1024)
+	defer a.Close()
+	defer b.Close()
+
+	a.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := a.Write(make([]byte, 1024)); err == nil {
+		t.Fatalf("should time out")
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.queue) != 0 {
+		t.Fatalf("should not be sent")
+	}
+}
+
+func TestWrapConn_Close_Unread(t *testing.T) {
+	a, b := net.Pipe()
+	c := WrapConn(a, 10*time.Millisecond, 0)
+	defer b.Close()
+
+	// The far side never reads, so delivering blocks
+	if _, err := c.Write([]byte("data")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Close()
+	}()
+	select {
+	case <-errCh:
+	case <-time.After(closeGrace + time.Second):
+		t.Fatalf("close should not hang")
+	}
+}
+
+func TestWrapConn_Session(t *testing.T) {
+	const latency = 20 * time.Millisecond
+	a, b := testPipe(latency, 0)
+	client, err := yamux.Client(a, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	server, err := yamux.Server(b, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer server.Close()
+
+	rtt, err := client.Ping()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rtt < 2*latency {
+		t.Fatalf("bad: %v", rtt)
+	}
+}
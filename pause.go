@@ -0,0 +1,64 @@
+package yamux
+
+import (
+	"sync"
+)
+
+// pendingPauses holds the pause frames that didn't fit the send queue,
+// so PauseReads and ResumeReads never block. The send loop writes them
+// before anything else, see EnableStreamPause.
+type pendingPauses struct {
+	lock   sync.Mutex
+	frames map[uint32]pendingPause
+
+	// readyCh is notified when a frame is added
+	readyCh chan struct{}
+}
+
+// pendingPause is a pause frame waiting to be queued
+type pendingPause struct {
+	flags uint16
+	code  uint32
+}
+
+func newPendingPauses() *pendingPauses {
+	return &pendingPauses{
+		frames:  make(map[uint32]pendingPause),
+		readyCh: make(chan struct{}, 1),
+	}
+}
+
+// update replaces the pending pause frame of stream id with code,
+// reporting whether there was one
+func (p *pendingPauses) update(id, code uint32) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	frame, ok := p.frames[id]
+	if !ok {
+		return false
+	}
+	frame.code = code
+	p.frames[id] = frame
+	return true
+}
+
+// add makes code the pending pause frame of stream id, sent with flags
+func (p *pendingPauses) add(id uint32, flags uint16, code uint32) {
+	p.lock.Lock()
+	p.frames[id] = pendingPause{flags: flags, code: code}
+	p.lock.Unlock()
+	asyncNotify(p.readyCh)
+}
+
+// flushPauses queues the pending pause frames on sched. It is called by
+// the send loop, which writes them before anything else.
+func (s *Session) flushPauses(sched *sendScheduler) {
+	s.pauses.lock.Lock()
+	defer s.pauses.lock.Unlock()
+	for id, frame := range s.pauses.frames {
+		hdr := header(make([]byte, headerSize))
+		hdr.encode(typeWindowUpdate, frame.flags|flagEXT, id, frame.code)
+		sched.push(sendReady{Hdr: hdr})
+		delete(s.pauses.frames, id)
+	}
+}
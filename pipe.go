@@ -0,0 +1,274 @@
+package yamux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPipeBufferSize is the default number of bytes buffered in
+	// each direction of a memory pipe
+	defaultPipeBufferSize = 64 * 1024
+)
+
+// MemoryPipeConfig is used to tune a memory pipe
+type MemoryPipeConfig struct {
+	// BufferSize is the number of bytes that can be written in each
+	// direction before writes block waiting for the peer to read. Bytes
+	// delayed by Latency count towards it. Zero selects a default of
+	// 64KB.
+	BufferSize int
+
+	// Latency, if set, delays the delivery of written data to
+	// simulate a network link. The round trip time is twice the
+	// latency.
+	Latency time.Duration
+}
+
+// NewMemoryPipe returns the two ends of a buffered in-memory
+// connection, e.g. to run a client and server session in the same
+// process or in tests. Unlike net.Pipe, writes return once the data is
+// buffered rather than once it is read.
+func NewMemoryPipe() (net.Conn, net.Conn) {
+	return NewMemoryPipeConfig(MemoryPipeConfig{})
+}
+
+// NewMemoryPipeConfig is like NewMemoryPipe, using the given config
+func NewMemoryPipeConfig(config MemoryPipeConfig) (net.Conn, net.Conn) {
+	size := config.BufferSize
+	if size <= 0 {
+		size = defaultPipeBufferSize
+	}
+	ab := newPipeBuffer(size, config.Latency)
+	ba := newPipeBuffer(size, config.Latency)
+	a := newMemoryConn(ba, ab, "a")
+	b := newMemoryConn(ab, ba, "b")
+	return a, b
+}
+
+// pipeChunk is data written to a pipe buffer at once
+type pipeChunk struct {
+	data []byte
+	due  time.Time // when the data may be read
+}
+
+// pipeBuffer holds the data in flight in one direction of a memory pipe
+type pipeBuffer struct {
+	mu      sync.Mutex
+	chunks  []pipeChunk
+	size    int
+	limit   int
+	latency time.Duration
+
+	// writerClosed is set once no more data will be written, and
+	// readerClosed once no more data will be read
+	writerClosed bool
+	readerClosed bool
+
+	// readableCh and writableCh are notified whenever data is written
+	// or read, respectively, or the buffer is closed
+	readableCh chan struct{}
+	writableCh chan struct{}
+}
+
+func newPipeBuffer(limit int, latency time.Duration) *pipeBuffer {
+	return &pipeBuffer{
+		limit:      limit,
+		latency:    latency,
+		readableCh: make(chan struct{}, 1),
+		writableCh: make(chan struct{}, 1),
+	}
+}
+
+// read copies due data into b. If there is none, it returns how long
+// until the next chunk is due, or zero if there is no data yet.
+func (p *pipeBuffer) read(b []byte) (int, time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.readerClosed {
+		return 0, 0, io.ErrClosedPipe
+	}
+	if len(p.chunks) == 0 {
+		if p.writerClosed {
+			return 0, 0, io.EOF
+		}
+		return 0, 0, nil
+	}
+	if wait := time.Until(p.chunks[0].due); wait > 0 {
+		return 0, wait, nil
+	}
+
+	n := 0
+	now := time.Now()
+	for n < len(b) && len(p.chunks) > 0 && !p.chunks[0].due.After(now) {
+		chunk := &p.chunks[0]
+		c := copy(b[n:], chunk.data)
+		n += c
+		if chunk.data = chunk.data[c:]; len(chunk.data) == 0 {
+			p.chunks[0] = pipeChunk{}
+			p.chunks = p.chunks[1:]
+		}
+	}
+	p.size -= n
+	asyncNotify(p.writableCh)
+	return n, 0, nil
+}
+
+// write buffers as much of b as fits
+func (p *pipeBuffer) write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.writerClosed || p.readerClosed {
+		return 0, io.ErrClosedPipe
+	}
+	n := p.limit - p.size
+	if n <= 0 {
+		return 0, nil
+	}
+	if n > len(b) {
+		n = len(b)
+	}
+	data := make([]byte, n)
+	copy(data, b)
+	p.chunks = append(p.chunks, pipeChunk{data: data, due: time.Now().Add(p.latency)})
+	p.size += n
+	asyncNotify(p.readableCh)
+	return n, nil
+}
+
+// closeWriter stops writes, reads return io.EOF once the buffer is empty
+func (p *pipeBuffer) closeWriter() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writerClosed = true
+	asyncNotify(p.readableCh)
+	asyncNotify(p.writableCh)
+}
+
+// closeReader stops reads and writes, dropping the buffered data
+func (p *pipeBuffer) closeReader() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readerClosed = true
+	p.chunks = nil
+	p.size = 0
+	asyncNotify(p.readableCh)
+	asyncNotify(p.writableCh)
+}
+
+// memoryConn is one end of a memory pipe
+type memoryConn struct {
+	r *pipeBuffer
+	w *pipeBuffer
+
+	readDeadline  pipeDeadline
+	writeDeadline pipeDeadline
+
+	local  net.Addr
+	remote net.Addr
+
+	closeOnce sync.Once
+}
+
+func newMemoryConn(r, w *pipeBuffer, name string) *memoryConn {
+	remote := "b"
+	if name == "b" {
+		remote = "a"
+	}
+	return &memoryConn{
+		r:             r,
+		w:             w,
+		readDeadline:  makePipeDeadline(),
+		writeDeadline: makePipeDeadline(),
+		local:         &yamuxAddr{"pipe-" + name},
+		remote:        &yamuxAddr{"pipe-" + remote},
+	}
+}
+
+// Read implements net.Conn
+func (c *memoryConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		if isClosedChan(c.readDeadline.wait()) {
+			return 0, ErrTimeout
+		}
+		n, wait, err := c.r.read(b)
+		if n != 0 || err != nil {
+			return n, err
+		}
+
+		var dueCh <-chan time.Time
+		if wait > 0 {
+			dueCh = time.After(wait)
+		}
+		select {
+		case <-c.r.readableCh:
+		case <-dueCh:
+		case <-c.readDeadline.wait():
+			return 0, ErrTimeout
+		}
+	}
+}
+
+// Write implements net.Conn
+func (c *memoryConn) Write(b []byte) (int, error) {
+	total := 0
+	for {
+		if isClosedChan(c.writeDeadline.wait()) {
+			return total, ErrTimeout
+		}
+		n, err := c.w.write(b[total:])
+		total += n
+		if err != nil || total == len(b) {
+			return total, err
+		}
+
+		select {
+		case <-c.w.writableCh:
+		case <-c.writeDeadline.wait():
+			return total, ErrTimeout
+		}
+	}
+}
+
+// Close implements net.Conn
+func (c *memoryConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.w.closeWriter()
+		c.r.closeReader()
+	})
+	return nil
+}
+
+// LocalAddr implements net.Conn
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr implements net.Conn
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline implements net.Conn
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
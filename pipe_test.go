@@ -0,0 +1,140 @@
+package yamux
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestMemoryPipe(t *testing.T) {
+	a, b := NewMemoryPipeConfig(MemoryPipeConfig{BufferSize: 1024})
+
+	// Writes larger than the buffer complete as the peer reads
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := a.Write(data)
+		if err == nil {
+			err = a.Close()
+		}
+		errCh <- err
+	}()
+
+	got, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("bad: %d", len(got))
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := a.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := b.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := a.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestMemoryPipe_Buffered(t *testing.T) {
+	a, b := NewMemoryPipeConfig(MemoryPipeConfig{BufferSize: 4})
+	defer a.Close()
+	defer b.Close()
+
+	// Writes return once buffered
+	if n, err := a.Write([]byte("abcd")); err != nil || n != 4 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+
+	// The buffer is full
+	a.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if n, err := a.Write([]byte("ef")); err != ErrTimeout || n != 0 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+
+	buf := make([]byte, 8)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "abcd" {
+		t.Fatalf("bad: %q %v", buf[:n], err)
+	}
+	b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := b.Read(buf); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestMemoryPipe_Latency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	a, b := NewMemoryPipeConfig(MemoryPipeConfig{Latency: latency})
+	defer a.Close()
+	defer b.Close()
+
+	start := time.Now()
+	if _, err := a.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > latency/2 {
+		t.Fatalf("write should not wait: %v", elapsed)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Fatalf("read too early: %v", elapsed)
+	}
+}
+
+func TestMemoryPipe_Session(t *testing.T) {
+	a, b := NewMemoryPipeConfig(MemoryPipeConfig{Latency: 5 * time.Millisecond})
+	client, _ := Client(a, testConf())
+	server, _ := Server(b, testConf())
+	defer client.Close()
+	defer server.Close()
+
+	rtt, err := client.Ping()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rtt < 10*time.Millisecond {
+		t.Fatalf("bad: %v", rtt)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		_, err = io.Copy(stream, stream)
+		stream.Close()
+		errCh <- err
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data := make([]byte, 512*1024)
+	go stream.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream.Close()
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
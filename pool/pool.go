@@ -0,0 +1,229 @@
+// Package pool spreads streams over a set of yamux sessions, for
+// instance to use more than one connection to a busy peer.
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/SkycoinProject/yamux"
+)
+
+// ErrClosed is returned by Open once the pool is closed
+var ErrClosed = errors.New("pool: closed")
+
+// DialFunc establishes a new session, usually by dialing a connection
+// and running yamux.Client on it
+type DialFunc func(ctx context.Context) (*yamux.Session, error)
+
+// Strategy selects the session a stream is opened on
+type Strategy int
+
+const (
+	// RoundRobin opens streams on the sessions in turn
+	RoundRobin Strategy = iota
+
+	// LeastLoaded opens streams on the session with the fewest
+	// streams
+	LeastLoaded
+)
+
+// Config is used to tune a pool
+type Config struct {
+	// Size is the number of sessions the pool grows to as streams
+	// are opened. Zero uses a single session.
+	Size int
+
+	// Strategy selects the session each stream is opened on
+	Strategy Strategy
+}
+
+// Pool manages a set of sessions created on demand by a DialFunc.
+// Sessions that are closed or received a GoAway are dropped and later
+// replaced; a dropped session that is still open is closed once its
+// streams are done. It is safe for concurrent use.
+type Pool struct {
+	dial     DialFunc
+	size     int
+	strategy Strategy
+
+	lock     sync.Mutex
+	sessions []*yamux.Session
+	next     int
+	closed   bool
+
+	// dialing is the number of dials in progress, and dialCh is
+	// closed and replaced whenever one completes
+	dialing int
+	dialCh  chan struct{}
+}
+
+// New returns a pool that creates sessions with dial. A nil config
+// uses a single session.
+func New(dial DialFunc, config *Config) (*Pool, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	if dial == nil {
+		return nil, fmt.Errorf("dial func must be set")
+	}
+	if config.Size < 0 {
+		return nil, fmt.Errorf("size must not be negative")
+	}
+	switch config.Strategy {
+	case RoundRobin, LeastLoaded:
+	default:
+		return nil, fmt.Errorf("unknown strategy %d", config.Strategy)
+	}
+	size := config.Size
+	if size == 0 {
+		size = 1
+	}
+	return &Pool{
+		dial:     dial,
+		size:     size,
+		strategy: config.Strategy,
+		dialCh:   make(chan struct{}),
+	}, nil
+}
+
+// Open opens a stream on the best session according to the strategy,
+// dialing a new session while the pool is below its size. If the
+// session turns out to be unusable, it is dropped and the stream is
+// opened on another one.
+func (p *Pool) Open(ctx context.Context) (*yamux.Stream, error) {
+	for attempt := 0; ; attempt++ {
+		session, err := p.session(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := session.OpenStreamContext(ctx)
+		if err == nil {
+			return stream, nil
+		}
+		if ctx.Err() != nil || healthy(session) || attempt >= p.size {
+			return nil, err
+		}
+	}
+}
+
+// Len returns the number of sessions in the pool
+func (p *Pool) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.prune()
+	return len(p.sessions)
+}
+
+// Close closes the pool and all of its sessions
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	sessions := p.sessions
+	p.sessions = nil
+	p.closed = true
+	p.lock.Unlock()
+	for _, session := range sessions {
+		session.Close()
+	}
+	return nil
+}
+
+// session returns the session to open the next stream on
+func (p *Pool) session(ctx context.Context) (*yamux.Session, error) {
+	p.lock.Lock()
+	for {
+		if p.closed {
+			p.lock.Unlock()
+			return nil, ErrClosed
+		}
+		p.prune()
+
+		// Grow the pool, without holding the lock while dialing
+		if len(p.sessions)+p.dialing < p.size {
+			p.dialing++
+			p.lock.Unlock()
+			session, err := p.dial(ctx)
+			p.lock.Lock()
+			p.dialing--
+			close(p.dialCh)
+			p.dialCh = make(chan struct{})
+			if err != nil {
+				p.lock.Unlock()
+				return nil, err
+			}
+			if p.closed {
+				p.lock.Unlock()
+				session.Close()
+				return nil, ErrClosed
+			}
+			p.sessions = append(p.sessions, session)
+			p.lock.Unlock()
+			return session, nil
+		}
+		if len(p.sessions) > 0 {
+			session := p.choose()
+			p.lock.Unlock()
+			return session, nil
+		}
+
+		// Wait for the sessions being dialed
+		dialCh := p.dialCh
+		p.lock.Unlock()
+		select {
+		case <-dialCh:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.lock.Lock()
+	}
+}
+
+// choose picks a session according to the strategy. The lock must be
+// held, and there must be a session.
+func (p *Pool) choose() *yamux.Session {
+	if p.strategy == LeastLoaded {
+		best := p.sessions[0]
+		for _, session := range p.sessions[1:] {
+			if session.NumStreams() < best.NumStreams() {
+				best = session
+			}
+		}
+		return best
+	}
+	session := p.sessions[p.next%len(p.sessions)]
+	p.next++
+	return session
+}
+
+// prune drops the sessions that can't open streams anymore. The lock
+// must be held.
+func (p *Pool) prune() {
+	n := 0
+	for _, session := range p.sessions {
+		if healthy(session) {
+			p.sessions[n] = session
+			n++
+			continue
+		}
+		if !session.IsClosed() {
+			go retire(session)
+		}
+	}
+	for i := n; i < len(p.sessions); i++ {
+		p.sessions[i] = nil
+	}
+	p.sessions = p.sessions[:n]
+}
+
+// healthy checks if streams can be opened on a session
+func healthy(session *yamux.Session) bool {
+	return !session.IsClosed() && !session.GoAwayReceived()
+}
+
+// retire closes a dropped session once its streams are done
+func retire(session *yamux.Session) {
+	session.Drain(context.Background())
+	session.Close()
+}
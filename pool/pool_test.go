@@ -0,0 +1,209 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/yamux"
+)
+
+// testDialer dials sessions to servers that accept streams and close
+// them once the client did
+type testDialer struct {
+	lock    sync.Mutex
+	servers []*yamux.Session
+	err     error
+}
+
+func (d *testDialer) dial(ctx context.Context) (*yamux.Session, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	a, b := yamux.NewMemoryPipe()
+	server, _ := yamux.Server(b, nil)
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, stream)
+				stream.Close()
+			}()
+		}
+	}()
+	d.servers = append(d.servers, server)
+	return yamux.Client(a, nil)
+}
+
+func (d *testDialer) dialed() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.servers)
+}
+
+func (d *testDialer) Close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, server := range d.servers {
+		server.Close()
+	}
+}
+
+func TestPool_RoundRobin(t *testing.T) {
+	d := &testDialer{}
+	defer d.Close()
+	p, err := New(d.dial, &Config{Size: 3})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer p.Close()
+
+	// The pool grows to its size, then reuses the sessions in turn
+	streams := make(map[*yamux.Session]int)
+	for i := 0; i < 6; i++ {
+		stream, err := p.Open(context.Background())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		streams[stream.Session()]++
+	}
+	if d.dialed() != 3 || p.Len() != 3 {
+		t.Fatalf("bad: %d %d", d.dialed(), p.Len())
+	}
+	for session, n := range streams {
+		if n != 2 {
+			t.Fatalf("bad: %p %d", session, n)
+		}
+	}
+}
+
+func TestPool_LeastLoaded(t *testing.T) {
+	d := &testDialer{}
+	defer d.Close()
+	p, err := New(d.dial, &Config{Size: 2, Strategy: LeastLoaded})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer p.Close()
+
+	first, err := p.Open(context.Background())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	second, err := p.Open(context.Background())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if first.Session() == second.Session() {
+		t.Fatalf("should use both sessions")
+	}
+
+	// Streams go to the other session while the first is busier
+	if _, err := p.Open(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		stream, err := p.Open(context.Background())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if first.Session().NumStreams() < second.Session().NumStreams() && stream.Session() != first.Session() {
+			t.Fatalf("should use the least loaded session")
+		}
+		if diff := first.Session().NumStreams() - second.Session().NumStreams(); diff > 1 || diff < -1 {
+			t.Fatalf("unbalanced: %d", diff)
+		}
+	}
+}
+
+func TestPool_Unhealthy(t *testing.T) {
+	d := &testDialer{}
+	defer d.Close()
+	p, err := New(d.dial, &Config{Size: 2})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer p.Close()
+
+	first, err := p.Open(context.Background())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	second, err := p.Open(context.Background())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := second.WaitEstablished(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A closed session and one that got a GoAway are replaced
+	first.Session().Close()
+	d.lock.Lock()
+	if err := d.servers[1].GoAway(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d.lock.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for !second.Session().GoAwayReceived() {
+		if time.Now().After(deadline) {
+			t.Fatalf("go away not received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		stream, err := p.Open(context.Background())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if s := stream.Session(); s == first.Session() || s == second.Session() {
+			t.Fatalf("should not use unhealthy sessions")
+		}
+	}
+	if d.dialed() != 4 || p.Len() != 2 {
+		t.Fatalf("bad: %d %d", d.dialed(), p.Len())
+	}
+
+	// The dropped session is closed once its stream is done
+	time.Sleep(10 * time.Millisecond)
+	if second.Session().IsClosed() {
+		t.Fatalf("closed early")
+	}
+	second.Close()
+	select {
+	case <-second.Session().CloseChan():
+	case <-time.After(time.Second):
+		t.Fatalf("should be closed")
+	}
+}
+
+func TestPool_DialError(t *testing.T) {
+	d := &testDialer{err: fmt.Errorf("refused")}
+	p, err := New(d.dial, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := p.Open(context.Background()); err != d.err {
+		t.Fatalf("err: %v", err)
+	}
+	p.Close()
+	if _, err := p.Open(context.Background()); err != ErrClosed {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := New(nil, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := New(d.dial, &Config{Strategy: 2}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,71 @@
+package yamux
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the bytes sent per second.
+// It holds up to one second worth of tokens, so a stream that was idle
+// may send a burst of up to its rate at once.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, zero if unlimited
+	tokens float64
+	last   time.Time
+}
+
+// set changes the rate, disabling the limit if it is not positive
+func (r *rateLimiter) set(bytesPerSec int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if bytesPerSec <= 0 {
+		r.rate = 0
+		return
+	}
+	if r.rate == 0 {
+		r.tokens = float64(bytesPerSec)
+		r.last = time.Now()
+	}
+	r.rate = float64(bytesPerSec)
+	r.refill(time.Now())
+}
+
+// refill adds the tokens accumulated since the last refill. The lock
+// must be held.
+func (r *rateLimiter) refill(now time.Time) {
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+}
+
+// allow returns how many of n bytes may be sent now. If none may, it
+// returns how long to wait for the next byte.
+func (r *rateLimiter) allow(n uint32) (uint32, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rate == 0 {
+		return n, 0
+	}
+	r.refill(time.Now())
+	if r.tokens < 1 {
+		// Round up, the wait must not be zero
+		return 0, time.Duration(math.Ceil((1 - r.tokens) / r.rate * float64(time.Second)))
+	}
+	if float64(n) > r.tokens {
+		n = uint32(r.tokens)
+	}
+	return n, 0
+}
+
+// consume takes the tokens for n sent bytes
+func (r *rateLimiter) consume(n uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rate != 0 {
+		r.tokens -= float64(n)
+	}
+}
@@ -0,0 +1,84 @@
+package yamux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// heldFrame is a sequenced frame waiting for its predecessors
+type heldFrame struct {
+	hdr  header
+	body []byte
+}
+
+// reorderBuffer restores the order of sequenced frames. Frames are
+// held until every frame with a lower sequence number was handled.
+type reorderBuffer struct {
+	window int
+	next   uint32
+	held   map[uint32]heldFrame
+	seqBuf []byte
+}
+
+// newReorderBuffer is used to construct a reorder buffer
+// holding at most window frames
+func newReorderBuffer(window int) *reorderBuffer {
+	return &reorderBuffer{
+		window: window,
+		held:   make(map[uint32]heldFrame),
+		seqBuf: make([]byte, sizeOfSeq),
+	}
+}
+
+// handleSequenced is used to handle a frame carrying a sequence
+// number. In order frames are handled right away, early frames are
+// read in full and held until their predecessors arrive.
+func (s *Session) handleSequenced(hdr header) error {
+	r := s.reorder
+	if _, err := io.ReadFull(s.bufRead, r.seqBuf); err != nil {
+		return err
+	}
+	seq := binary.BigEndian.Uint32(r.seqBuf)
+
+	if seq != r.next {
+		ahead := seq - r.next
+		if r.window == 0 || ahead > uint32(r.window) || len(r.held) >= r.window {
+			s.logger.Printf("[ERR] yamux: sequenced frame %d outside of reorder window (expected %d)", seq, r.next)
+			return ErrReorderWindowExceeded
+		}
+		if _, ok := r.held[seq]; ok {
+			s.logger.Printf("[ERR] yamux: duplicate sequenced frame %d", seq)
+			return ErrReorderWindowExceeded
+		}
+
+		frame := heldFrame{hdr: header(make([]byte, headerSize))}
+		copy(frame.hdr, hdr)
+		if hdr.MsgType() == typeData && hdr.Length() > 0 {
+			frame.body = make([]byte, hdr.Length())
+			if _, err := io.ReadFull(s.bufRead, frame.body); err != nil {
+				return err
+			}
+		}
+		r.held[seq] = frame
+		return nil
+	}
+
+	if err := handlers[hdr.MsgType()](s, hdr, s.bufRead); err != nil {
+		return err
+	}
+	r.next++
+
+	// Release any frames that are now in order
+	for {
+		frame, ok := r.held[r.next]
+		if !ok {
+			return nil
+		}
+		delete(r.held, r.next)
+		r.next++
+		if err := handlers[frame.hdr.MsgType()](s, frame.hdr, bytes.NewReader(frame.body)); err != nil {
+			return err
+		}
+	}
+}
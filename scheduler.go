@@ -0,0 +1,263 @@
+package yamux
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+const (
+	// drrQuantum is the number of payload bytes a stream of weight 1
+	// may send per scheduling round.
+	drrQuantum = 64 * 1024
+)
+
+const (
+	// ticketQueued is the state of a frame waiting to be sent, or to
+	// send its next part
+	ticketQueued int32 = iota
+
+	// ticketSending is the state of a frame, or part of it, being
+	// written to the connection
+	ticketSending
+
+	// ticketDone is the state of a frame that was sent completely
+	ticketDone
+
+	// ticketCanceled is the state of a frame whose remaining parts
+	// are dropped
+	ticketCanceled
+)
+
+// sendTicket allows the writer of a data frame to cancel it while
+// it is still queued, e.g. once the write deadline passed.
+type sendTicket struct {
+	state int32
+
+	// sent is the number of payload bytes sent so far
+	sent uint32
+}
+
+// cancel drops the frame if no part of it is being sent right now.
+// It returns false if the frame is being sent or already done.
+func (t *sendTicket) cancel() bool {
+	return atomic.CompareAndSwapInt32(&t.state, ticketQueued, ticketCanceled)
+}
+
+// sendScheduler orders the frames queued for sending. Control frames,
+// i.e. frames without a body, are sent first and in order. Data frames
+// are queued per stream and sent using deficit round robin, so that the
+// bandwidth is shared between the streams in proportion to their
+// weights, regardless of how much data each of them offers.
+//
+// Data frames are split into smaller frames to not exceed the deficit
+// of their stream, so a large write can't hold off the other streams.
+// Frames whose payload must stay in one piece, such as encoded payloads
+// or stream headers, are sent whole once enough deficit built up.
+type sendScheduler struct {
+	control []sendReady
+
+	// active holds the streams with queued data frames in the order
+	// they are visited. The stream at the front was already credited
+	// its quantum for the current visit if credited is set.
+	//
+	// A stream that ran out of frames keeps its place until it is
+	// visited again. Writers only queue their next frame once the
+	// previous one is sent, which would otherwise cost them a turn.
+	active   []uint32
+	credited bool
+	queues   map[uint32][]*queuedFrame
+	deficit  map[uint32]int64
+
+	// frames is the number of queued data frames
+	frames int
+
+	// chunkHdr and chunkBody are reused for parts of split frames
+	chunkHdr  header
+	chunkBody io.LimitedReader
+}
+
+// queuedFrame is a data frame in the queue of a stream
+type queuedFrame struct {
+	ready sendReady
+
+	// remain is the number of payload bytes not yet sent, and flags
+	// the flags to set on the next part of the frame
+	remain uint32
+	flags  uint16
+}
+
+// newSendScheduler is used to construct an empty scheduler
+func newSendScheduler() *sendScheduler {
+	return &sendScheduler{
+		queues:   make(map[uint32][]*queuedFrame),
+		deficit:  make(map[uint32]int64),
+		chunkHdr: header(make([]byte, headerSize)),
+	}
+}
+
+// empty checks if there is nothing to send
+func (q *sendScheduler) empty() bool {
+	return len(q.control) == 0 && q.frames == 0
+}
+
+// push queues a frame to be sent
+func (q *sendScheduler) push(ready sendReady) {
+	if ready.Body == nil {
+		q.control = append(q.control, ready)
+		return
+	}
+
+	hdr := header(ready.Hdr)
+	id := hdr.StreamID()
+	if _, ok := q.queues[id]; !ok {
+		q.active = append(q.active, id)
+	}
+	q.frames++
+	q.queues[id] = append(q.queues[id], &queuedFrame{
+		ready:  ready,
+		remain: hdr.Length(),
+		flags:  hdr.Flags(),
+	})
+}
+
+// popControl is like pop, but only returns control frames
+func (q *sendScheduler) popControl() (sendReady, bool) {
+	if len(q.control) == 0 {
+		return sendReady{}, false
+	}
+	ready := q.control[0]
+	q.control[0] = sendReady{}
+	q.control = q.control[1:]
+	return ready, true
+}
+
+// pop returns the next frame to send. Partial is set on the returned
+// frame if it is not the last part of a split frame. It returns false
+// if there is nothing to send, because the queued frames were canceled.
+func (q *sendScheduler) pop() (sendReady, bool) {
+	if ready, ok := q.popControl(); ok {
+		return ready, true
+	}
+
+	for len(q.active) > 0 {
+		id := q.active[0]
+		queue := q.queues[id]
+		if len(queue) == 0 {
+			// The stream stayed idle for a round
+			delete(q.queues, id)
+			delete(q.deficit, id)
+			q.active = q.active[1:]
+			q.credited = false
+			continue
+		}
+		head := queue[0]
+		if t := head.ready.Ticket; t != nil && atomic.LoadInt32(&t.state) == ticketCanceled {
+			q.done(id)
+			continue
+		}
+
+		if !q.credited {
+			weight := int64(head.ready.Weight)
+			if weight == 0 {
+				weight = 1
+			}
+			q.deficit[id] += drrQuantum * weight
+			q.credited = true
+		}
+
+		split := splittable(head.flags)
+		if int64(head.remain) > q.deficit[id] && (!split || q.deficit[id] == 0) {
+			// Not enough credit left, move on to the next stream
+			q.active = append(q.active[1:], id)
+			q.credited = false
+			continue
+		}
+
+		if !split {
+			if !claim(head.ready) {
+				q.done(id)
+				continue
+			}
+			q.deficit[id] -= int64(head.remain)
+			q.done(id)
+			return head.ready, true
+		}
+
+		n := head.remain
+		if int64(n) > q.deficit[id] {
+			n = uint32(q.deficit[id])
+		}
+		if !claim(head.ready) {
+			q.done(id)
+			continue
+		}
+		q.deficit[id] -= int64(n)
+
+		hdr := header(head.ready.Hdr)
+		if n == hdr.Length() {
+			// The frame is sent as is
+			q.done(id)
+			return head.ready, true
+		}
+
+		q.chunkHdr.encode(hdr.MsgType(), head.flags, id, n)
+		q.chunkBody = io.LimitedReader{R: head.ready.Body, N: int64(n)}
+		head.remain -= n
+		head.flags = 0
+
+		chunk := sendReady{Hdr: q.chunkHdr, Body: &q.chunkBody, Err: head.ready.Err, Ticket: head.ready.Ticket}
+		if head.remain == 0 {
+			q.done(id)
+		} else {
+			// The rest of the frame waits for the next round
+			chunk.Partial = true
+			q.active = append(q.active[1:], id)
+			q.credited = false
+		}
+		return chunk, true
+	}
+	return sendReady{}, false
+}
+
+// done removes the head of the queue of the stream at the front
+func (q *sendScheduler) done(id uint32) {
+	q.frames--
+	queue := q.queues[id]
+	queue[0] = nil
+	q.queues[id] = queue[1:]
+	if len(queue) == 1 {
+		// Let the other streams have their turn
+		q.active = append(q.active[1:], id)
+		q.credited = false
+	}
+}
+
+// claim marks a frame that is about to be sent as being sent. It
+// returns false if the frame was canceled, cancelling it first if its
+// deadline passed.
+func claim(ready sendReady) bool {
+	t := ready.Ticket
+	if t == nil {
+		return true
+	}
+	if isClosedChan(ready.Deadline) && t.cancel() {
+		asyncSendErr(ready.Err, ErrTimeout)
+	}
+	return atomic.CompareAndSwapInt32(&t.state, ticketQueued, ticketSending)
+}
+
+// sentPart is used to account for a sent frame, or part of it
+func (t *sendTicket) sentPart(n uint32, partial bool) {
+	atomic.AddUint32(&t.sent, n)
+	if partial {
+		atomic.StoreInt32(&t.state, ticketQueued)
+	} else {
+		atomic.StoreInt32(&t.state, ticketDone)
+	}
+}
+
+// splittable checks if a data frame with the given flags may be sent
+// as several smaller frames
+func splittable(flags uint16) bool {
+	return flags&(flagCMP|flagHDR) == 0
+}
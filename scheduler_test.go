@@ -0,0 +1,139 @@
+package yamux
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// testSchedule runs the scheduler with one writer per weight, each of
+// which queues its next frame of the given size once the previous one
+// was sent, and returns the payload bytes sent per writer.
+func testSchedule(t *testing.T, weights []uint32, sizes []int, rounds int) []int64 {
+	q := newSendScheduler()
+	payload := make([]byte, 1024*1024)
+	queue := func(i int) {
+		hdr := header(make([]byte, headerSize))
+		hdr.encode(typeData, 0, uint32(2*i+1), uint32(sizes[i]))
+		q.push(sendReady{
+			Hdr:    hdr,
+			Body:   bytes.NewReader(payload[:sizes[i]]),
+			Weight: weights[i],
+		})
+	}
+	for i := range weights {
+		queue(i)
+	}
+
+	sent := make([]int64, len(weights))
+	for r := 0; r < rounds; r++ {
+		if q.empty() {
+			t.Fatalf("should not be empty")
+		}
+		ready, ok := q.pop()
+		if !ok {
+			t.Fatalf("should not be empty")
+		}
+		hdr := header(ready.Hdr)
+		n, err := io.Copy(ioutil.Discard, ready.Body)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if n != int64(hdr.Length()) {
+			t.Fatalf("bad: %d %d", n, hdr.Length())
+		}
+
+		i := int(hdr.StreamID() / 2)
+		sent[i] += n
+		if !ready.Partial {
+			queue(i)
+		}
+	}
+	return sent
+}
+
+func TestSendScheduler_Fairness(t *testing.T) {
+	type testCase struct {
+		weights []uint32
+		sizes   []int
+	}
+	cases := []testCase{
+		{[]uint32{1, 1}, []int{1024 * 1024, 64 * 1024}},
+		{[]uint32{1, 1, 1}, []int{256 * 1024, 100, 2 * drrQuantum}},
+		{[]uint32{1, 2}, []int{1024 * 1024, 1024 * 1024}},
+		{[]uint32{0, 3}, []int{512 * 1024, 1024 * 1024}},
+	}
+	for _, tc := range cases {
+		sent := testSchedule(t, tc.weights, tc.sizes, 10000)
+
+		// Writers of frames below the quantum are never backlogged,
+		// but must not wait longer than a round
+		share := func(i int) float64 {
+			w := tc.weights[i]
+			if w == 0 {
+				w = 1
+			}
+			return float64(sent[i]) / float64(w)
+		}
+		for i := range sent {
+			if tc.sizes[i] < drrQuantum {
+				if sent[i] == 0 {
+					t.Fatalf("%v: starved: %v", tc.weights, sent)
+				}
+				continue
+			}
+			if ratio := share(i) / share(0); ratio < 0.95 || ratio > 1.05 {
+				t.Fatalf("%v: unfair share: %v", tc.weights, sent)
+			}
+		}
+	}
+}
+
+func TestSendScheduler_Control(t *testing.T) {
+	q := newSendScheduler()
+	if !q.empty() {
+		t.Fatalf("should be empty")
+	}
+
+	hdr := header(make([]byte, headerSize))
+	hdr.encode(typeData, flagSYN, 1, 3*drrQuantum)
+	q.push(sendReady{Hdr: hdr, Body: bytes.NewReader(make([]byte, 3*drrQuantum))})
+	hdr2 := header(make([]byte, headerSize))
+	hdr2.encode(typeData, flagSYN, 3, 10)
+	q.push(sendReady{Hdr: hdr2, Body: bytes.NewReader(make([]byte, 10))})
+	ping := header(make([]byte, headerSize))
+	ping.encode(typePing, flagSYN, 0, 1)
+	q.push(sendReady{Hdr: ping})
+
+	// Control frames go first
+	if ready, _ := q.pop(); header(ready.Hdr).MsgType() != typePing {
+		t.Fatalf("bad: %v", header(ready.Hdr))
+	}
+
+	// The large frame is split, with the flags on the first part only
+	expect := []struct {
+		id      uint32
+		flags   uint16
+		length  uint32
+		partial bool
+	}{
+		{1, flagSYN, drrQuantum, true},
+		{3, flagSYN, 10, false},
+		{1, 0, drrQuantum, true},
+		{1, 0, drrQuantum, false},
+	}
+	for _, e := range expect {
+		ready, _ := q.pop()
+		hdr := header(ready.Hdr)
+		if hdr.StreamID() != e.id || hdr.Flags() != e.flags || hdr.Length() != e.length || ready.Partial != e.partial {
+			t.Fatalf("bad: %v %v", hdr, ready.Partial)
+		}
+		if n, _ := io.Copy(ioutil.Discard, ready.Body); n != int64(e.length) {
+			t.Fatalf("bad: %d", n)
+		}
+	}
+	if !q.empty() {
+		t.Fatalf("should be empty")
+	}
+}
@@ -2,6 +2,8 @@ package yamux
 
 import (
 	"bufio"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -29,22 +31,116 @@ type Session struct {
 	// send. This depends if we are a client/server.
 	nextStreamID uint32
 
+	// extensions is the set of protocol extensions negotiated
+	// with the remote side.
+	extensions uint32
+
+	// lastHeartbeat is the UnixNano time of the last application
+	// reported activity, see Heartbeat.
+	lastHeartbeat int64
+
+	// lastRecv and lastSend are the UnixNano times the last frame was
+	// received and sent, only tracked as needed by KeepAliveMode
+	lastRecv int64
+	lastSend int64
+
+	// frameStart is the UnixNano time the frame being read started
+	// to arrive, or zero between frames.
+	frameStart int64
+
+	// bytesSent is the number of payload bytes sent, see Stats
+	bytesSent uint64
+
+	// staleWindowUpdates is the number of window updates received
+	// for streams we don't know, see Stats
+	staleWindowUpdates uint64
+
+	// streamLockContended, writeLockContended and readLockContended
+	// count how often the stream map lock and the stream write and
+	// read locks were found held, if built with lockStats
+	streamLockContended uint64
+	writeLockContended  uint64
+	readLockContended   uint64
+
+	// keepAlivesSent and keepAlivesFailed count the rounds of the keep
+	// alive loop, and lastKeepAliveRTT and lastKeepAliveTime are the
+	// RTT and UnixNano time of its last successful ping, see Stats
+	keepAlivesSent    uint64
+	keepAlivesFailed  uint64
+	lastKeepAliveRTT  int64
+	lastKeepAliveTime int64
+
+	// framesCoalesced and coalesceFlushes count the frames the send
+	// loop buffered and the writes of the buffer, see MaxCoalesceBytes
+	framesCoalesced uint64
+	coalesceFlushes uint64
+
+	// sendBeats and recvBeats count the iterations of the send and
+	// recv loops, and sendBusy and recvBusy are set while they are
+	// writing or handling a frame, see watchdog
+	sendBeats uint64
+	recvBeats uint64
+	sendBusy  int32
+	recvBusy  int32
+
+	// remoteGoAwayAt is the UnixNano time the first GoAway was
+	// received, and goAwayGrace the duration streams may still be
+	// opened after it, see SetGoAwayGrace.
+	remoteGoAwayAt int64
+	goAwayGrace    int64
+
+	// lastInboundSYN is the UnixNano time the peer last opened a
+	// stream, see WaitGoAwayDrained
+	lastInboundSYN int64
+
+	// livenessEchoes is the number of liveness streams of the peer
+	// being answered, see maxLivenessEchoes
+	livenessEchoes int32
+
+	// remoteStreamID is the highest stream ID the remote side opened
+	remoteStreamID uint32
+
+	// created is the time the session was established
+	created time.Time
+
+	// client is set on the client side of the session
+	client bool
+
+	// token holds the session token once exchanged, see Token
+	token atomic.Value
+
+	// remoteGoAwayMsg holds the reason the peer sent for its GoAway,
+	// see RemoteGoAwayMessage
+	remoteGoAwayMsg atomic.Value
+
 	// config holds our configuration
 	config *Config
 
 	// logger is used for our logs
 	logger *log.Logger
 
-	// conn is the underlying connection
-	conn io.ReadWriteCloser
+	// conn is the underlying connection, and connWriter writes to it
+	// without short writes
+	conn       io.ReadWriteCloser
+	connWriter io.Writer
+
+	// coalesce buffers the frames written by the send loop if
+	// MaxCoalesceBytes is set, connWriter then writes to it.
+	// coalescedErrs holds the result channels of the buffered frames,
+	// which are signaled once the buffer is written. Both are only
+	// used by the send loop.
+	coalesce      *bufio.Writer
+	coalescedErrs []chan error
 
 	// bufRead is a buffered reader
 	bufRead *bufio.Reader
 
-	// pings is used to track inflight pings
-	pings    map[uint32]chan struct{}
-	pingID   uint32
-	pingLock sync.Mutex
+	// pings is used to track inflight pings, and missedPings counts
+	// the pings that timed out since the peer last answered one
+	pings       map[uint32]chan struct{}
+	pingID      uint32
+	missedPings int
+	pingLock    sync.Mutex
 
 	// streams maps a stream id to a stream, and inflight has an entry
 	// for any outgoing stream that has not yet been established. Both are
@@ -53,13 +149,21 @@ type Session struct {
 	inflight   map[uint32]struct{}
 	streamLock sync.Mutex
 
-	// synCh acts like a semaphore. It is sized to the AcceptBacklog which
-	// is assumed to be symmetric between the client and server. This allows
-	// the client to avoid exceeding the backlog and instead blocks the open.
+	// streamCloseCh is closed and replaced whenever a stream is
+	// removed, protected by streamLock
+	streamCloseCh chan struct{}
+
+	// synCh acts like a semaphore. It is sized to MaxPendingOutboundSYNs,
+	// or the AcceptBacklog which is assumed to be symmetric between the
+	// client and server. This allows the client to avoid exceeding the
+	// backlog and instead blocks the open.
 	synCh chan struct{}
 
-	// acceptCh is used to pass ready streams to the client
-	acceptCh chan *Stream
+	// accept holds the ready streams until the client accepts them
+	accept *acceptQueue
+
+	// acceptDeadline is used to time out AcceptStream
+	acceptDeadline pipeDeadline
 
 	// sendCh is used to mark a stream as ready to send,
 	// or to send a header out directly.
@@ -69,9 +173,51 @@ type Session struct {
 	// between stream registration and stream shutdown
 	recvDoneCh chan struct{}
 
-	// shutdown is used to safely close a session
+	// sendDoneCh is closed when send() exits, so Close can wait for
+	// the coalesced frames to be written
+	sendDoneCh chan struct{}
+
+	// sendBuffered is the number of sent bytes not yet credited back
+	// by the peer, bounded by MaxSendBuffer. sendBufferCh is closed
+	// and replaced whenever credit is returned to wake up writers.
+	sendBuffered   int64
+	sendBufferCh   chan struct{}
+	sendBufferLock sync.Mutex
+
+	// sendSeq is the sequence number of the next sequenced frame.
+	// It is only used by the send goroutine.
+	sendSeq uint32
+
+	// reorder holds sequenced frames that arrived early. It is
+	// only used by the recv goroutine.
+	reorder *reorderBuffer
+
+	// closed holds the summaries of recently closed streams if
+	// ClosedStreamHistory is set
+	closed *streamHistory
+
+	// sendLimiter enforces SessionRateLimit on data frames and
+	// sendMeter measures the rate payloads are sent at
+	sendLimiter rateLimiter
+	sendMeter   rateMeter
+
+	// workers delivers stream frames if RecvWorkers is above one
+	workers *recvWorkers
+
+	// batch collects window updates if BatchWindowUpdates is set
+	batch *windowBatch
+
+	// pauses holds the pause frames the send queue had no room for if
+	// EnableStreamPause is set
+	pauses *pendingPauses
+
+	// shutdown is used to safely close a session. sendLoopErr and
+	// recvLoopErr are the errors that terminated the send and recv
+	// loops, if any.
 	shutdown     bool
 	shutdownErr  error
+	sendLoopErr  error
+	recvLoopErr  error
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
 }
@@ -79,9 +225,19 @@ type Session struct {
 // sendReady is used to either mark a stream as ready
 // or to directly send a header
 type sendReady struct {
-	Hdr  []byte
-	Body io.Reader
-	Err  chan error
+	Hdr    []byte
+	Body   io.Reader
+	Err    chan error
+	Weight uint32
+
+	// Partial is set by the sendScheduler if more parts of the
+	// frame follow, so Err is not signaled yet.
+	Partial bool
+
+	// Ticket, if set, allows the frame to be canceled while queued.
+	// It is canceled once Deadline is closed.
+	Ticket   *sendTicket
+	Deadline <-chan struct{}
 }
 
 // newSession is used to construct a new session
@@ -92,29 +248,74 @@ func newSession(config *Config, conn io.ReadWriteCloser, client bool) *Session {
 	}
 
 	s := &Session{
-		config:     config,
-		logger:     logger,
-		conn:       conn,
-		bufRead:    bufio.NewReader(conn),
-		pings:      make(map[uint32]chan struct{}),
-		streams:    make(map[uint32]*Stream),
-		inflight:   make(map[uint32]struct{}),
-		synCh:      make(chan struct{}, config.AcceptBacklog),
-		acceptCh:   make(chan *Stream, config.AcceptBacklog),
-		sendCh:     make(chan sendReady, 64),
-		recvDoneCh: make(chan struct{}),
-		shutdownCh: make(chan struct{}),
+		created:        time.Now(),
+		client:         client,
+		config:         config,
+		logger:         logger,
+		conn:           conn,
+		bufRead:        bufio.NewReader(conn),
+		pings:          make(map[uint32]chan struct{}),
+		streams:        make(map[uint32]*Stream),
+		inflight:       make(map[uint32]struct{}),
+		streamCloseCh:  make(chan struct{}),
+		synCh:          make(chan struct{}, maxPendingSYNs(config)),
+		accept:         newAcceptQueue(config.AcceptBacklog, config.AcceptOrder),
+		acceptDeadline: makePipeDeadline(),
+		sendCh:         make(chan sendReady, 64),
+		recvDoneCh:     make(chan struct{}),
+		sendDoneCh:     make(chan struct{}),
+		shutdownCh:     make(chan struct{}),
+		sendBufferCh:   make(chan struct{}),
+		reorder:        newReorderBuffer(config.ReorderWindow),
 	}
 	if client {
 		s.nextStreamID = 1
 	} else {
 		s.nextStreamID = 2
 	}
+	if ext := localExtensions(config); ext != 0 {
+		// The advertisement must be the first frame on the wire
+		s.sendCh <- sendReady{Hdr: extensionsHeader(ext)}
+	}
+	s.connWriter = fullWriter{
+		w:         conn,
+		retryable: config.WriteErrorClassifier,
+		timeout:   config.ConnectionWriteTimeout,
+		done:      s.shutdownCh,
+		logf: func(format string, v ...interface{}) {
+			s.logger.Printf(format, v...)
+		},
+	}
+	if config.MaxCoalesceBytes > 0 {
+		w := countingWriter{w: s.connWriter, n: &s.coalesceFlushes}
+		s.coalesce = bufio.NewWriterSize(w, config.MaxCoalesceBytes)
+		s.connWriter = s.coalesce
+	}
+	if config.BatchWindowUpdates {
+		s.batch = newWindowBatch(config.WindowUpdateInterval)
+	}
+	if config.EnableStreamPause {
+		s.pauses = newPendingPauses()
+	}
+	if config.ClosedStreamHistory > 0 {
+		s.closed = newStreamHistory(config.ClosedStreamHistory)
+	}
+	s.sendLimiter.set(config.SessionRateLimit)
+	s.startRecvWorkers()
 	go s.recv()
 	go s.send()
 	if config.EnableKeepAlive {
 		go s.keepalive()
 	}
+	if config.Watchdog > 0 {
+		go s.watchdog()
+	}
+	if config.HeaderReadTimeout > 0 {
+		go s.frameWatchdog()
+	}
+	if config.MaxSessionLifetime > 0 {
+		go s.retire()
+	}
 	return s
 }
 
@@ -136,7 +337,7 @@ func (s *Session) CloseChan() <-chan struct{} {
 
 // NumStreams returns the number of currently open streams
 func (s *Session) NumStreams() int {
-	s.streamLock.Lock()
+	lockCounted(&s.streamLock, &s.streamLockContended)
 	num := len(s.streams)
 	s.streamLock.Unlock()
 	return num
@@ -148,21 +349,188 @@ func (s *Session) Open() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	if s.config.ResetLeakedStreams {
+		return newStreamHandle(conn), nil
+	}
 	return conn, nil
 }
 
 // OpenStream is used to create a new stream
 func (s *Session) OpenStream() (*Stream, error) {
+	return s.openStream(nil)
+}
+
+// OpenStreamContext is like OpenStream, but gives up once ctx is done
+// while waiting for the number of pending SYNs to drop, or for the peer
+// to accept the stream if OpenRetries is set.
+func (s *Session) OpenStreamContext(ctx context.Context) (*Stream, error) {
+	return s.openStreamContext(ctx, nil)
+}
+
+// OpenEstablished opens a stream and waits for the peer to acknowledge
+// it, see Stream.WaitEstablished, so the stream is ready to use once
+// it's returned. If ctx is done or the peer rejects the stream
+// meanwhile, the stream is reset and the error returned.
+func (s *Session) OpenEstablished(ctx context.Context) (*Stream, error) {
+	stream, err := s.openStreamContext(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.WaitEstablished(ctx); err != nil {
+		stream.cancel(err)
+		if err == ErrStreamClosed && s.IsClosed() {
+			err = ErrSessionShutdown
+		}
+		return nil, err
+	}
+	return stream, nil
+}
+
+// OpenStreamWithHeader is used to create a new stream carrying open
+// time metadata, such as a routing key. The metadata is sent along
+// with the SYN and is available to the peer via Stream.Header before
+// the stream is accepted. The peer must support stream headers.
+func (s *Session) OpenStreamWithHeader(meta []byte) (*Stream, error) {
+	if uint32(len(meta)) > s.maxStreamHeaderSize() {
+		return nil, ErrStreamHeaderTooLarge
+	}
+	if meta == nil {
+		meta = []byte{}
+	}
+	return s.openStream(meta)
+}
+
+// OpenStreamWithData is used to create a new stream, sending data
+// along with the SYN. This saves a round trip for protocols where the
+// peer acts on the first request right away. Data that doesn't fit
+// the initial window is written once the peer grants more, like with
+// Write. If ctx is done before all of data was sent, the stream is
+// reset and ctx.Err() is returned.
+func (s *Session) OpenStreamWithData(ctx context.Context, data []byte) (*Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return s.OpenStreamContext(ctx)
+	}
+
+	var sent int
+	stream, err := s.openStreamFunc(ctx, func(stream *Stream) error {
+		lockCounted(&stream.sendLock, &s.writeLockContended)
+		defer stream.sendLock.Unlock()
+		var err error
+		sent, err = stream.write(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Advertise a larger window if we have one
+	if err := stream.sendWindowUpdate(); err != nil {
+		return nil, err
+	}
+	if sent == len(data) {
+		return stream, nil
+	}
+
+	// Write the rest, resetting the stream if ctx is done meanwhile
+	writtenCh := make(chan struct{})
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				stream.cancel(ctx.Err())
+			case <-writtenCh:
+			}
+		}()
+	}
+	_, err = stream.Write(data[sent:])
+	close(writtenCh)
+	if err != nil {
+		stream.cancel(err)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// openStream is used to create a new stream, sending meta
+// as the stream header if it is not nil. Rejected streams are
+// retried according to OpenRetries.
+func (s *Session) openStream(meta []byte) (*Stream, error) {
+	return s.openStreamContext(context.Background(), meta)
+}
+
+// openStreamContext is like openStream, giving up once ctx is done
+func (s *Session) openStreamContext(ctx context.Context, meta []byte) (*Stream, error) {
+	send := (*Stream).sendWindowUpdate
+	if meta != nil {
+		send = func(stream *Stream) error { return stream.sendHeader(meta) }
+	}
+	if s.config.OpenRetries == 0 {
+		return s.openStreamFunc(ctx, send)
+	}
+
+	delay := s.config.OpenRetryBackoff
+	for retry := 0; ; retry++ {
+		stream, err := s.openStreamFunc(ctx, send)
+		if err != nil {
+			return nil, err
+		}
+		err = s.waitEstablished(ctx, stream)
+		if err == nil {
+			return stream, nil
+		}
+		if !stream.refused() || retry == s.config.OpenRetries {
+			stream.cancel(err)
+			return nil, err
+		}
+
+		s.logger.Printf("[WARN] yamux: stream rejected, retry %d of %d in %v", retry+1, s.config.OpenRetries, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.shutdownCh:
+			return nil, ErrSessionShutdown
+		}
+		delay *= 2
+	}
+}
+
+// waitEstablished waits for the peer to accept or refuse stream, for
+// at most ConnectionWriteTimeout so a silent peer can't hold up the
+// open forever
+func (s *Session) waitEstablished(ctx context.Context, stream *Stream) error {
+	timeout := s.config.ConnectionWriteTimeout
+	if timeout <= 0 {
+		return stream.WaitEstablished(ctx)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := stream.WaitEstablished(waitCtx)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return ErrTimeout
+	}
+	return err
+}
+
+// openStreamFunc is used to create a new stream, using send to send
+// its first frame. It gives up once ctx is done while waiting for the
+// number of pending SYNs to drop.
+func (s *Session) openStreamFunc(ctx context.Context, send func(*Stream) error) (*Stream, error) {
 	if s.IsClosed() {
 		return nil, ErrSessionShutdown
 	}
-	if atomic.LoadInt32(&s.remoteGoAway) == 1 {
+	if atomic.LoadInt32(&s.remoteGoAway) == 1 && !s.inGoAwayGrace() {
 		return nil, ErrRemoteGoAway
 	}
 
 	// Block if we have too many inflight SYNs
 	select {
 	case s.synCh <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case <-s.shutdownCh:
 		return nil, ErrSessionShutdown
 	}
@@ -171,21 +539,24 @@ GET_ID:
 	// Get an ID, and check for stream exhaustion
 	id := atomic.LoadUint32(&s.nextStreamID)
 	if id >= math.MaxUint32-1 {
-		return nil, ErrStreamsExhausted
+		<-s.synCh
+		s.streamIDExhausted()
+		return nil, s.streamsExhaustedError(id)
 	}
 	if !atomic.CompareAndSwapUint32(&s.nextStreamID, id, id+2) {
 		goto GET_ID
 	}
 
 	// Register the stream
-	stream := newStream(s, id, streamInit)
-	s.streamLock.Lock()
+	stream := newStream(s, id, StreamInit)
+	lockCounted(&s.streamLock, &s.streamLockContended)
 	s.streams[id] = stream
 	s.inflight[id] = struct{}{}
 	s.streamLock.Unlock()
+	s.trace(TraceStreamOpen, id, 0)
 
-	// Send the window update to create
-	if err := stream.sendWindowUpdate(); err != nil {
+	// Send the first frame to create
+	if err := send(stream); err != nil {
 		select {
 		case <-s.synCh:
 		default:
@@ -196,6 +567,29 @@ GET_ID:
 	return stream, nil
 }
 
+// streamsExhaustedError returns the error describing the stream usage
+// once we ran out of stream IDs, the next of which is id
+func (s *Session) streamsExhaustedError(id uint32) error {
+	// Clients use odd IDs starting from 1, servers even ones from 2
+	first := 2 - id%2
+	return &StreamsExhaustedError{
+		Streams: s.NumStreams(),
+		Max:     (math.MaxUint32 - first) / 2,
+	}
+}
+
+// streamIDExhausted is used to signal the peer that we are out of
+// stream IDs, if configured. The GoAway is only sent once.
+func (s *Session) streamIDExhausted() {
+	if !s.config.GoAwayOnStreamIDExhaustion || atomic.LoadInt32(&s.localGoAway) == 1 {
+		return
+	}
+	s.logger.Printf("[WARN] yamux: stream ids exhausted, sending go away")
+	if err := s.sendNoWait(s.goAway(goAwayNormal)); err != nil {
+		s.logger.Printf("[WARN] yamux: failed to send go away: %v", err)
+	}
+}
+
 // Accept is used to block until the next available stream
 // is ready to be accepted.
 func (s *Session) Accept() (net.Conn, error) {
@@ -203,33 +597,84 @@ func (s *Session) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	if s.config.ResetLeakedStreams {
+		return newStreamHandle(conn), nil
+	}
 	return conn, err
 }
 
+// AcceptStreamWithHeader is like AcceptStream, and also returns the
+// metadata the peer attached when opening the stream, as Header does.
+// It is nil if the peer sent none.
+func (s *Session) AcceptStreamWithHeader() (*Stream, []byte, error) {
+	stream, err := s.AcceptStream()
+	if err != nil {
+		return nil, nil, err
+	}
+	return stream, stream.header, nil
+}
+
 // AcceptStream is used to block until the next available stream
 // is ready to be accepted.
 func (s *Session) AcceptStream() (*Stream, error) {
+	return s.acceptStream(func() (*Stream, <-chan struct{}) {
+		return s.accept.pop(), s.accept.readyCh
+	})
+}
+
+// AcceptStreamMatching is like AcceptStream, but only accepts streams
+// whose ID matches pred. Other streams stay queued for other accept
+// calls, so several accept loops can serve the streams of a session
+// by ID, e.g. with pred selecting a range of IDs. Streams no accept
+// call matches count against AcceptBacklog until they are accepted.
+func (s *Session) AcceptStreamMatching(pred func(id uint32) bool) (*Stream, error) {
+	return s.acceptStream(func() (*Stream, <-chan struct{}) {
+		return s.accept.popMatching(pred)
+	})
+}
+
+// acceptStream accepts the stream returned by pop, waiting on the
+// channel it returns while there is none
+func (s *Session) acceptStream(pop func() (*Stream, <-chan struct{})) (*Stream, error) {
 	if isClosedChan(s.shutdownCh) {
 		return nil, s.shutdownErr
 	}
-	select {
-	case stream := <-s.acceptCh:
-		if err := stream.sendWindowUpdate(); err != nil {
-			return nil, err
+	for {
+		stream, waitCh := pop()
+		if stream != nil {
+			if s.config.RequireStreamApproval {
+				stream.awaitApproval()
+				return stream, nil
+			}
+			if err := stream.sendWindowUpdate(); err != nil {
+				return nil, err
+			}
+			return stream, nil
+		}
+		select {
+		case <-waitCh:
+		case <-s.acceptDeadline.wait():
+			return nil, ErrTimeout
+		case <-s.shutdownCh:
+			return nil, s.shutdownErr
 		}
-		return stream, nil
-	case <-s.shutdownCh:
-		return nil, s.shutdownErr
 	}
 }
 
+// SetAcceptDeadline sets the deadline for Accept and AcceptStream,
+// which return ErrTimeout once it passed. A zero value for t disables
+// the deadline.
+func (s *Session) SetAcceptDeadline(t time.Time) error {
+	s.acceptDeadline.set(t)
+	return nil
+}
+
 // Close is used to close the session and all streams.
 // Attempts to send a GoAway before closing the connection.
 func (s *Session) Close() error {
 	s.shutdownLock.Lock()
-	defer s.shutdownLock.Unlock()
-
 	if s.shutdown {
+		s.shutdownLock.Unlock()
 		return nil
 	}
 	s.shutdown = true
@@ -237,10 +682,24 @@ func (s *Session) Close() error {
 		s.shutdownErr = ErrSessionShutdown
 	}
 	close(s.shutdownCh)
+	sendFailed := s.sendLoopErr != nil
+	s.shutdownLock.Unlock()
+
+	// The send loop may fail while writing the coalesced frames, and
+	// needs the shutdownLock to record the error
+	if s.coalesce != nil && !sendFailed {
+		// Let the send loop write the coalesced frames first
+		timer := time.NewTimer(s.config.ConnectionWriteTimeout)
+		select {
+		case <-s.sendDoneCh:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
 	s.conn.Close()
 	<-s.recvDoneCh
 
-	s.streamLock.Lock()
+	lockCounted(&s.streamLock, &s.streamLockContended)
 	defer s.streamLock.Unlock()
 	for _, stream := range s.streams {
 		stream.forceClose()
@@ -259,12 +718,181 @@ func (s *Session) exitErr(err error) {
 	s.Close()
 }
 
+// exitSendErr is used when the send loop dies because of an
+// error writing to the underlying connection.
+func (s *Session) exitSendErr(err error) {
+	s.shutdownLock.Lock()
+	s.sendLoopErr = err
+	s.shutdownLock.Unlock()
+	s.exitErr(err)
+}
+
+// SendError returns the error that terminated the send loop, such as
+// a write error of the underlying connection. It is nil as long as the
+// send loop is running or if the session was closed normally.
+func (s *Session) SendError() error {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	return s.sendLoopErr
+}
+
+// RecvError returns the error that terminated the recv loop, such as
+// io.EOF if the peer closed the connection, a read error of the
+// underlying connection or a protocol error. It is nil as long as the
+// recv loop is running or if the session was closed locally.
+func (s *Session) RecvError() error {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	return s.recvLoopErr
+}
+
 // GoAway can be used to prevent accepting further
 // connections. It does not close the underlying conn.
 func (s *Session) GoAway() error {
 	return s.waitForSend(s.goAway(goAwayNormal), nil)
 }
 
+// Drain gracefully winds down the session. It sends a GoAway, so new
+// inbound streams are rejected, and waits until all streams are closed
+// or ctx is done. Existing streams are not closed, and the session is
+// left open.
+func (s *Session) Drain(ctx context.Context) error {
+	if err := s.GoAway(); err != nil {
+		return err
+	}
+	for {
+		num, closeCh := s.streamsOpen(false)
+		if num == 0 {
+			return nil
+		}
+		select {
+		case <-closeCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.shutdownCh:
+			return s.shutdownErr
+		}
+	}
+}
+
+// WaitGoAwayDrained blocks until the peer stopped opening streams and
+// the streams it opened are all closed, or ctx is done. The peer is
+// considered to have stopped once no stream was opened for
+// goAwayQuietPeriod since the call, leaving time for streams it opened
+// before seeing our GoAway. It is meant to be called after GoAway, to
+// learn when the session can be closed; unlike Drain it doesn't wait
+// for the streams we opened.
+func (s *Session) WaitGoAwayDrained(ctx context.Context) error {
+	start := time.Now().UnixNano()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		last := atomic.LoadInt64(&s.lastInboundSYN)
+		if last < start {
+			last = start
+		}
+		quiet := goAwayQuietPeriod - time.Since(time.Unix(0, last))
+		num, closeCh := s.streamsOpen(true)
+		var quietCh <-chan time.Time
+		if quiet > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(quiet)
+			quietCh = timer.C
+		} else if num == 0 {
+			return nil
+		}
+		select {
+		case <-quietCh:
+		case <-closeCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.shutdownCh:
+			return s.shutdownErr
+		}
+	}
+}
+
+// streamsOpen returns the number of open streams, only counting those
+// the peer opened if inbound is set, along with a channel closed once
+// one of the streams is removed
+func (s *Session) streamsOpen(inbound bool) (int, <-chan struct{}) {
+	lockCounted(&s.streamLock, &s.streamLockContended)
+	defer s.streamLock.Unlock()
+	if !inbound {
+		return len(s.streams), s.streamCloseCh
+	}
+	num := 0
+	for id := range s.streams {
+		if id%2 == 1 != s.client {
+			num++
+		}
+	}
+	return num, s.streamCloseCh
+}
+
+// Age returns how long ago the session was established
+func (s *Session) Age() time.Duration {
+	return time.Since(s.created)
+}
+
+// retire is a long running goroutine that drains and closes the
+// session once it reached MaxSessionLifetime
+func (s *Session) retire() {
+	timer := time.NewTimer(s.config.MaxSessionLifetime)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.shutdownCh:
+		return
+	}
+
+	ctx := context.Background()
+	if grace := s.config.MaxSessionLifetimeGrace; grace > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, grace)
+		defer cancel()
+	}
+	if err := s.Drain(ctx); err == context.DeadlineExceeded {
+		s.logger.Printf("[WARN] yamux: closing session with %d streams left", s.NumStreams())
+	}
+	s.Close()
+}
+
+// GoAwayReceived checks if the remote side sent a GoAway. New streams
+// can't be opened once it did, but existing streams keep working.
+func (s *Session) GoAwayReceived() bool {
+	return atomic.LoadInt32(&s.remoteGoAway) == 1
+}
+
+// SetGoAwayGrace allows opening streams for d after receiving a GoAway,
+// e.g. to finish a critical exchange during a coordinated shutdown.
+// This only helps if the peer cooperates and keeps accepting streams
+// for that long after sending the GoAway, which a yamux peer that
+// called GoAway does not; it resets them. Zero, the default, fails
+// opens with ErrRemoteGoAway right away.
+func (s *Session) SetGoAwayGrace(d time.Duration) {
+	atomic.StoreInt64(&s.goAwayGrace, int64(d))
+}
+
+// inGoAwayGrace returns whether streams may still be opened after a
+// GoAway was received
+func (s *Session) inGoAwayGrace() bool {
+	grace := atomic.LoadInt64(&s.goAwayGrace)
+	at := atomic.LoadInt64(&s.remoteGoAwayAt)
+	return grace > 0 && at != 0 && time.Since(time.Unix(0, at)) < time.Duration(grace)
+}
+
+// GoAwaySent checks if we sent a GoAway, or queued one to be sent, so
+// the remote side can no longer open new streams.
+func (s *Session) GoAwaySent() bool {
+	return atomic.LoadInt32(&s.localGoAway) == 1
+}
+
 // goAway is used to send a goAway message
 func (s *Session) goAway(reason uint32) header {
 	atomic.SwapInt32(&s.localGoAway, 1)
@@ -280,8 +908,11 @@ func (s *Session) Ping() (time.Duration, error) {
 
 	// Get a new ping id, mark as pending
 	s.pingLock.Lock()
-	id := s.pingID
-	s.pingID++
+	id, err := s.nextPingID()
+	if err != nil {
+		s.pingLock.Unlock()
+		return 0, err
+	}
 	s.pings[id] = ch
 	s.pingLock.Unlock()
 
@@ -299,7 +930,13 @@ func (s *Session) Ping() (time.Duration, error) {
 	case <-time.After(s.config.ConnectionWriteTimeout):
 		s.pingLock.Lock()
 		delete(s.pings, id) // Ignore it if a response comes later.
+		s.missedPings++
+		missed := s.missedPings
 		s.pingLock.Unlock()
+		if max := s.config.MaxOutstandingPings; max > 0 && missed > max {
+			s.logger.Printf("[ERR] yamux: %d pings unanswered", missed)
+			s.exitErr(ErrPingsUnanswered)
+		}
 		return 0, ErrTimeout
 	case <-s.shutdownCh:
 		return 0, ErrSessionShutdown
@@ -309,18 +946,122 @@ func (s *Session) Ping() (time.Duration, error) {
 	return time.Now().Sub(start), nil
 }
 
+// nextPingID returns an ID for a new ping, random if Config.Rand is
+// set. The pingLock must be held.
+func (s *Session) nextPingID() (uint32, error) {
+	if s.config.Rand == nil {
+		id := s.pingID
+		s.pingID++
+		return id, nil
+	}
+	b := make([]byte, 4)
+	for {
+		if err := s.readRandom(b, nil); err != nil {
+			return 0, err
+		}
+		if id := binary.BigEndian.Uint32(b); s.pings[id] == nil {
+			return id, nil
+		}
+	}
+}
+
+// randLock serializes reads from Config.Rand. It is shared by all
+// sessions, as sessions set up with clones of a config share its Rand.
+var randLock sync.Mutex
+
+// readRandom fills b from Config.Rand, or with def if it is unset
+func (s *Session) readRandom(b []byte, def func([]byte) (int, error)) error {
+	if s.config.Rand == nil {
+		_, err := def(b)
+		return err
+	}
+	randLock.Lock()
+	defer randLock.Unlock()
+	_, err := io.ReadFull(s.config.Rand, b)
+	return err
+}
+
+// SendKeepAlive performs a single keep alive round on demand, i.e. a
+// ping followed by the liveness check if ActiveLivenessCheck is set,
+// and returns the RTT of the ping. It works regardless of
+// EnableKeepAlive. Unlike the keep alive loop, a failed round is not
+// retried or counted, and doesn't close the session.
+func (s *Session) SendKeepAlive() (time.Duration, error) {
+	rtt, err := s.Ping()
+	if err != nil {
+		return 0, err
+	}
+	if s.config.ActiveLivenessCheck {
+		if err := s.checkLiveness(); err != nil {
+			return rtt, err
+		}
+	}
+	return rtt, nil
+}
+
 // keepalive is a long running goroutine that periodically does
 // a ping to keep the connection alive.
 func (s *Session) keepalive() {
+	violations := 0
+	failures := 0
+	delay := s.config.KeepAliveInterval
 	for {
 		select {
-		case <-time.After(s.config.KeepAliveInterval):
-			_, err := s.Ping()
+		case <-time.After(delay):
+			// Skip the ping if there was recent activity
+			delay = s.config.KeepAliveInterval
+			if last := s.lastActivity(); last != 0 {
+				if idle := time.Since(time.Unix(0, last)); idle < delay {
+					delay -= idle
+					continue
+				}
+			}
+
+			rtt, err := s.Ping()
+			if err == ErrSessionShutdown {
+				return
+			}
+			atomic.AddUint64(&s.keepAlivesSent, 1)
 			if err != nil {
-				if err != ErrSessionShutdown {
-					s.logger.Printf("[ERR] yamux: keepalive failed: %v", err)
-					s.exitErr(ErrKeepAliveTimeout)
+				atomic.AddUint64(&s.keepAlivesFailed, 1)
+			} else {
+				atomic.StoreInt64(&s.lastKeepAliveRTT, int64(rtt))
+				atomic.StoreInt64(&s.lastKeepAliveTime, time.Now().UnixNano())
+			}
+			if err != nil && failures < s.config.KeepAliveRetries {
+				// Retry sooner, backing off exponentially
+				delay = s.keepAliveBackoff() << uint(failures)
+				failures++
+				s.logger.Printf("[WARN] yamux: keepalive failed, retry %d of %d in %v: %v", failures, s.config.KeepAliveRetries, delay, err)
+				continue
+			}
+			if err != nil {
+				s.logger.Printf("[ERR] yamux: keepalive failed: %v", err)
+				s.exitErr(ErrKeepAliveTimeout)
+				return
+			}
+			failures = 0
+
+			if s.config.ActiveLivenessCheck {
+				if err := s.checkLiveness(); err != nil {
+					if !s.IsClosed() {
+						atomic.AddUint64(&s.keepAlivesFailed, 1)
+						s.logger.Printf("[ERR] yamux: liveness check failed: %v", err)
+						s.exitErr(ErrLivenessCheckFailed)
+					}
+					return
 				}
+			}
+
+			// Enforce the RTT limit, if any
+			if s.config.MaxRTT == 0 || rtt <= s.config.MaxRTT {
+				violations = 0
+				continue
+			}
+			violations++
+			if violations >= s.config.MaxRTTViolations {
+				s.logger.Printf("[ERR] yamux: keepalive rtt %v exceeded %v", rtt, s.config.MaxRTT)
+				s.exitErr(ErrRTTExceeded)
 				return
 			}
 		case <-s.shutdownCh:
@@ -329,6 +1070,83 @@ func (s *Session) keepalive() {
 	}
 }
 
+// lastActivity returns the UnixNano time of the latest activity that
+// makes a keep alive ping unnecessary, or zero if there was none
+func (s *Session) lastActivity() int64 {
+	last := atomic.LoadInt64(&s.lastHeartbeat)
+	switch s.config.KeepAliveMode {
+	case KeepAliveOnIdleRecv:
+		if recv := atomic.LoadInt64(&s.lastRecv); recv > last {
+			last = recv
+		}
+	case KeepAliveOnIdleBoth:
+		if recv := atomic.LoadInt64(&s.lastRecv); recv > last {
+			last = recv
+		}
+		if send := atomic.LoadInt64(&s.lastSend); send > last {
+			last = send
+		}
+	}
+	return last
+}
+
+// keepAliveBackoff returns the delay before the first retry of a
+// failed keep alive ping, see KeepAliveBackoff
+func (s *Session) keepAliveBackoff() time.Duration {
+	if s.config.KeepAliveBackoff > 0 {
+		return s.config.KeepAliveBackoff
+	}
+	return s.config.KeepAliveInterval / 10
+}
+
+// Heartbeat tells the session that the application observed
+// activity on the connection. The keepalive timer is reset as if a
+// ping round just succeeded, so busy sessions are not pinged.
+func (s *Session) Heartbeat() {
+	atomic.StoreInt64(&s.lastHeartbeat, time.Now().UnixNano())
+}
+
+// SendBufferUsage returns the number of sent bytes the peer has not
+// yet returned window credit for, as limited by MaxSendBuffer. It is
+// only tracked if MaxSendBuffer is set.
+func (s *Session) SendBufferUsage() int64 {
+	s.sendBufferLock.Lock()
+	defer s.sendBufferLock.Unlock()
+	return s.sendBuffered
+}
+
+// reserveSendBuffer is used to reserve up to n bytes of the send
+// buffer. If nothing could be reserved, the returned channel is
+// closed once buffer space is released.
+func (s *Session) reserveSendBuffer(n uint32) (uint32, <-chan struct{}) {
+	if s.config.MaxSendBuffer == 0 {
+		return n, nil
+	}
+	s.sendBufferLock.Lock()
+	defer s.sendBufferLock.Unlock()
+	avail := s.config.MaxSendBuffer - s.sendBuffered
+	if avail <= 0 {
+		return 0, s.sendBufferCh
+	}
+	if int64(n) > avail {
+		n = uint32(avail)
+	}
+	s.sendBuffered += int64(n)
+	return n, nil
+}
+
+// releaseSendBuffer is used to return n bytes to the send buffer
+func (s *Session) releaseSendBuffer(n uint32) {
+	if s.config.MaxSendBuffer == 0 || n == 0 {
+		return
+	}
+	s.sendBufferLock.Lock()
+	s.sendBuffered -= int64(n)
+	close(s.sendBufferCh)
+	s.sendBufferCh = make(chan struct{})
+	s.sendBufferLock.Unlock()
+}
+
 // waitForSendErr waits to send a header, checking for a potential shutdown
 func (s *Session) waitForSend(hdr header, body io.Reader) error {
 	errCh := make(chan error, 1)
@@ -339,6 +1157,12 @@ func (s *Session) waitForSend(hdr header, body io.Reader) error {
 // potential shutdown. Since there's the expectation that sends can happen
 // in a timely manner, we enforce the connection write timeout here.
 func (s *Session) waitForSendErr(hdr header, body io.Reader, errCh chan error) error {
+	return s.waitForSendReady(sendReady{Hdr: hdr, Body: body, Err: errCh})
+}
+
+// waitForSendReady is like waitForSendErr, but queues a prepared
+// sendReady, e.g. to carry the weight of a stream.
+func (s *Session) waitForSendReady(ready sendReady) error {
 	t := timerPool.Get()
 	timer := t.(*time.Timer)
 	timer.Reset(s.config.ConnectionWriteTimeout)
@@ -351,22 +1175,42 @@ func (s *Session) waitForSendErr(hdr header, body io.Reader, errCh chan error) e
 		timerPool.Put(t)
 	}()
 
-	ready := sendReady{Hdr: hdr, Body: body, Err: errCh}
 	select {
 	case s.sendCh <- ready:
+	case <-ready.Deadline:
+		return ErrTimeout
 	case <-s.shutdownCh:
 		return ErrSessionShutdown
 	case <-timer.C:
 		return ErrConnectionWriteTimeout
 	}
 
-	select {
-	case err := <-errCh:
-		return err
-	case <-s.shutdownCh:
-		return ErrSessionShutdown
-	case <-timer.C:
-		return ErrConnectionWriteTimeout
+	// Data frames held back by the session rate limit are not stuck
+	timeout := timer.C
+	if ready.Body != nil && s.config.SessionRateLimit > 0 {
+		timeout = nil
+	}
+
+	deadline := ready.Deadline
+	for {
+		select {
+		case err := <-ready.Err:
+			return err
+		case <-deadline:
+			if ready.Ticket.cancel() {
+				return ErrTimeout
+			}
+			// A part is being sent, the send loop cancels the
+			// rest once it is done
+			deadline = nil
+		case <-s.shutdownCh:
+			return ErrSessionShutdown
+		case <-timeout:
+			if ready.Ticket != nil {
+				ready.Ticket.cancel()
+			}
+			return ErrConnectionWriteTimeout
+		}
 	}
 }
 
@@ -396,57 +1240,271 @@ func (s *Session) sendNoWait(hdr header) error {
 	}
 }
 
-// send is a long running goroutine that sends data
+// send is a long running goroutine that sends data. Queued frames
+// are ordered by a sendScheduler, so that streams share the connection
+// fairly.
 func (s *Session) send() {
+	defer close(s.sendDoneCh)
+	if s.coalesce != nil {
+		defer s.flushCoalescedOnExit()
+	}
+	sched := newSendScheduler()
+	buf := make([]byte, drrQuantum)
+	csum := newChecksumWriter(s.connWriter)
+	var batchCh, pauseCh chan struct{}
+	if s.batch != nil {
+		batchCh = s.batch.readyCh
+	}
+	if s.pauses != nil {
+		pauseCh = s.pauses.readyCh
+	}
+
+	// flushAt is when the coalesced frames are due to be written
+	var flushAt time.Time
 	for {
-		select {
-		case ready := <-s.sendCh:
-			// Send a header if ready
-			if ready.Hdr != nil {
-				sent := 0
-				for sent < len(ready.Hdr) {
-					n, err := s.conn.Write(ready.Hdr[sent:])
-					if err != nil {
-						s.logger.Printf("[ERR] yamux: Failed to write header: %v", err)
-						asyncSendErr(ready.Err, err)
-						s.exitErr(err)
+		atomic.AddUint64(&s.sendBeats, 1)
+
+		// Merge the window updates that piled up meanwhile
+		if s.batch != nil {
+			s.flushWindowUpdates(sched)
+		}
+		if s.pauses != nil {
+			s.flushPauses(sched)
+		}
+
+		// Write the coalesced frames once due
+		if !flushAt.IsZero() && s.flushDue(flushAt, sched.empty()) {
+			if err := s.flushCoalesced(); err != nil {
+				return
+			}
+			flushAt = time.Time{}
+		}
+
+		// Wait for something to send
+		if sched.empty() {
+			var timer *time.Timer
+			var flushCh <-chan time.Time
+			if !flushAt.IsZero() {
+				timer = time.NewTimer(time.Until(flushAt))
+				flushCh = timer.C
+			}
+			woken := false
+			select {
+			case ready := <-s.sendCh:
+				sched.push(ready)
+			case <-batchCh:
+				woken = true
+			case <-pauseCh:
+				woken = true
+			case <-flushCh:
+				woken = true
+			case <-s.shutdownCh:
+				return
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			if woken {
+				continue
+			}
+		}
+
+		// Pick up whatever else is queued, bounded so a busy sendCh
+		// can't hold off the writes
+	DRAIN:
+		for i := 0; i < cap(s.sendCh); i++ {
+			select {
+			case ready := <-s.sendCh:
+				sched.push(ready)
+			default:
+				break DRAIN
+			}
+		}
+
+		// Hold back data frames while over the session rate limit
+		var ready sendReady
+		var ok bool
+		if _, wait := s.sendLimiter.allow(1); wait > 0 {
+			if ready, ok = sched.popControl(); !ok {
+				// Don't hold back coalesced frames meanwhile
+				if !flushAt.IsZero() {
+					if err := s.flushCoalesced(); err != nil {
 						return
 					}
-					sent += n
+					flushAt = time.Time{}
 				}
-			}
-
-			// Send data from a body if given
-			if ready.Body != nil {
-				_, err := io.Copy(s.conn, ready.Body)
-				if err != nil {
-					s.logger.Printf("[ERR] yamux: Failed to write body: %v", err)
-					asyncSendErr(ready.Err, err)
-					s.exitErr(err)
+				select {
+				case ready := <-s.sendCh:
+					sched.push(ready)
+				case <-time.After(wait):
+				case <-s.shutdownCh:
 					return
 				}
+				continue
 			}
-
-			// No error, successful send
-			asyncSendErr(ready.Err, nil)
-		case <-s.shutdownCh:
+		} else if ready, ok = sched.pop(); !ok {
+			continue
+		}
+		atomic.StoreInt32(&s.sendBusy, 1)
+		err := s.sendFrame(ready, buf, csum)
+		atomic.StoreInt32(&s.sendBusy, 0)
+		if err != nil {
 			return
 		}
+		if s.config.KeepAliveMode == KeepAliveOnIdleBoth {
+			atomic.StoreInt64(&s.lastSend, time.Now().UnixNano())
+		}
+		if s.coalesce != nil {
+			atomic.AddUint64(&s.framesCoalesced, 1)
+			if s.coalesce.Buffered() == 0 {
+				flushAt = time.Time{}
+			} else if flushAt.IsZero() {
+				flushAt = time.Now().Add(s.config.CoalesceDelay)
+			}
+		}
+	}
+}
+
+// flushDue checks if the frames coalesced since flushAt are to be
+// written, which happens once CoalesceDelay passed, or without a delay
+// once the send queue ran empty
+func (s *Session) flushDue(flushAt time.Time, idle bool) bool {
+	if s.config.CoalesceDelay == 0 {
+		return idle && len(s.sendCh) == 0
 	}
+	return !time.Now().Before(flushAt)
+}
+
+// flushCoalesced writes the frames collected by the send loop, see
+// MaxCoalesceBytes
+func (s *Session) flushCoalesced() error {
+	atomic.StoreInt32(&s.sendBusy, 1)
+	err := s.coalesce.Flush()
+	atomic.StoreInt32(&s.sendBusy, 0)
+	s.coalescedSent(err)
+	if err != nil {
+		s.logger.Printf("[ERR] yamux: Failed to write coalesced frames: %v", err)
+		s.exitSendErr(err)
+	}
+	return err
+}
+
+// flushCoalescedOnExit writes the frames still coalesced when the send
+// loop exits, so closing the session doesn't drop them
+func (s *Session) flushCoalescedOnExit() {
+	s.coalescedSent(s.coalesce.Flush())
+}
+
+// coalescedSent reports the result of writing the coalesced frames to
+// their senders
+func (s *Session) coalescedSent(err error) {
+	for _, ch := range s.coalescedErrs {
+		asyncSendErr(ch, err)
+	}
+	s.coalescedErrs = s.coalescedErrs[:0]
+}
+
+// sendFrame writes a single queued frame to the connection, using buf
+// to copy the body if needed and csum to add a checksum to data frames
+// if that extension is in use
+func (s *Session) sendFrame(ready sendReady, buf []byte, csum *checksumWriter) error {
+	hdr := header(ready.Hdr)
+	checksum := ready.Body != nil && hdr.MsgType() == typeData && s.hasExtension(extChecksum)
+	if checksum {
+		hdr = csum.header(hdr)
+	}
+
+	// Send a header if ready
+	if hdr != nil {
+		if err := s.writeHeader(hdr); err != nil {
+			s.logger.Printf("[ERR] yamux: Failed to write header: %v", err)
+			asyncSendErr(ready.Err, err)
+			s.coalescedSent(err)
+			s.exitSendErr(err)
+			return err
+		}
+	}
+
+	// Send data from a body if given
+	if ready.Body != nil {
+		var w io.Writer = s.connWriter
+		if checksum {
+			w = csum
+		}
+		_, err := io.CopyBuffer(w, ready.Body, buf)
+		if err == nil && checksum {
+			err = csum.writeSum()
+		}
+		if err != nil {
+			s.logger.Printf("[ERR] yamux: Failed to write body: %v", err)
+			asyncSendErr(ready.Err, err)
+			s.coalescedSent(err)
+			s.exitSendErr(err)
+			return err
+		}
+	}
+
+	// No error, successful send
+	if ready.Body != nil {
+		n := header(ready.Hdr).Length()
+		s.sendLimiter.consume(n)
+		s.sendMeter.add(int64(n))
+		atomic.AddUint64(&s.bytesSent, uint64(n))
+	}
+	if ready.Ticket != nil {
+		ready.Ticket.sentPart(header(ready.Hdr).Length(), ready.Partial)
+	}
+	if ready.Partial {
+		return nil
+	}
+
+	// Coalesced frames are only sent once the buffer is written
+	if s.coalesce == nil {
+		asyncSendErr(ready.Err, nil)
+	} else if s.coalesce.Buffered() == 0 {
+		asyncSendErr(ready.Err, nil)
+		s.coalescedSent(nil)
+	} else if ready.Err != nil {
+		s.coalescedErrs = append(s.coalescedErrs, ready.Err)
+	}
+	return nil
+}
+
+// writeHeader writes a frame header to the connection, stamping
+// it with a sequence number if that extension is in use.
+func (s *Session) writeHeader(hdr header) error {
+	s.traceFrame(hdr, true)
+	if s.hasExtension(extReorder) {
+		buf := make([]byte, headerSize+sizeOfSeq)
+		copy(buf, hdr)
+		header(buf).setFlags(hdr.Flags() | flagSEQ)
+		binary.BigEndian.PutUint32(buf[headerSize:], s.sendSeq)
+		s.sendSeq++
+		hdr = buf
+	}
+
+	_, err := s.connWriter.Write(hdr)
+	return err
 }
 
 // recv is a long running goroutine that accepts new data
 func (s *Session) recv() {
 	if err := s.recvLoop(); err != nil {
+		// Read errors caused by closing the session are expected
+		if !isClosedChan(s.shutdownCh) {
+			s.shutdownLock.Lock()
+			s.recvLoopErr = err
+			s.shutdownLock.Unlock()
+		}
 		s.exitErr(err)
 	}
 }
 
 // Ensure that the index of the handler (typeData/typeWindowUpdate/etc) matches the message type
 var (
-	handlers = []func(*Session, header) error{
-		typeData:         (*Session).handleStreamMessage,
-		typeWindowUpdate: (*Session).handleStreamMessage,
+	handlers = []func(*Session, header, io.Reader) error{
+		typeData:         (*Session).dispatchStreamMessage,
+		typeWindowUpdate: (*Session).dispatchStreamMessage,
 		typePing:         (*Session).handlePing,
 		typeGoAway:       (*Session).handleGoAway,
 	}
@@ -455,46 +1513,142 @@ var (
 // recvLoop continues to receive data until a fatal error is encountered
 func (s *Session) recvLoop() error {
 	defer close(s.recvDoneCh)
+	defer s.stopRecvWorkers()
 	hdr := header(make([]byte, headerSize))
 	for {
-		// Read the header
-		if _, err := io.ReadFull(s.bufRead, hdr); err != nil {
-			if err != io.EOF && !strings.Contains(err.Error(), "closed") && !strings.Contains(err.Error(), "reset by peer") {
-				s.logger.Printf("[ERR] yamux: Failed to read header: %v", err)
+		if s.config.HeaderReadTimeout > 0 {
+			// Waiting for the next frame to start is not limited
+			if _, err := s.bufRead.Peek(1); err == nil {
+				atomic.StoreInt64(&s.frameStart, time.Now().UnixNano())
 			}
+		}
+		if err := s.recvFrame(hdr); err != nil {
 			return err
 		}
+		if s.config.KeepAliveMode != KeepAliveAlways {
+			atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+		}
+		atomic.StoreInt64(&s.frameStart, 0)
+		atomic.StoreInt32(&s.recvBusy, 0)
+		atomic.AddUint64(&s.recvBeats, 1)
+	}
+}
+
+// recvFrame reads and handles a single frame
+func (s *Session) recvFrame(hdr header) error {
+	// Read the header
+	if _, err := io.ReadFull(s.bufRead, hdr); err != nil {
+		if err != io.EOF && !strings.Contains(err.Error(), "closed") && !strings.Contains(err.Error(), "reset by peer") {
+			s.logger.Printf("[ERR] yamux: Failed to read header: %v", err)
+		}
+		return err
+	}
 
-		// Verify the version
-		if hdr.Version() != protoVersion {
+	atomic.StoreInt32(&s.recvBusy, 1)
+
+	// Verify the version and type
+	if _, err := parseHeader(hdr); err != nil {
+		if err == ErrInvalidVersion {
 			s.logger.Printf("[ERR] yamux: Invalid protocol version: %d", hdr.Version())
-			return ErrInvalidVersion
 		}
+		return err
+	}
 
-		mt := hdr.MsgType()
-		if mt < typeData || mt > typeGoAway {
-			return ErrInvalidMsgType
+	// Reject oversized frames before buffering any of them
+	if _, err := frameBodySize(hdr, s.maxFrameSize()); err != nil {
+		s.logger.Printf("[ERR] yamux: frame too large (stream: %d, length: %d)", hdr.StreamID(), hdr.Length())
+		if err := s.sendNoWait(s.goAway(goAwayProtoErr)); err != nil {
+			s.logger.Printf("[WARN] yamux: failed to send go away: %v", err)
 		}
+		return err
+	}
 
-		if err := handlers[mt](s, hdr); err != nil {
-			return err
+	s.traceFrame(hdr, false)
+
+	if hdr.Flags()&flagSEQ == flagSEQ {
+		return s.handleSequenced(hdr)
+	}
+	return handlers[hdr.MsgType()](s, hdr, s.bufRead)
+}
+
+// maxFrameSize returns the largest data frame payload we accept. No
+// valid frame exceeds the largest window we grant plus a checksum.
+func (s *Session) maxFrameSize() uint32 {
+	if s.config.MaxFrameSize != 0 {
+		return s.config.MaxFrameSize
+	}
+	return s.config.MaxStreamWindowSize + sizeOfChecksum
+}
+
+// maxStreamHeaderSize returns the largest stream header we send and
+// accept, see MaxStreamHeaderSize
+func (s *Session) maxStreamHeaderSize() uint32 {
+	if s.config.MaxStreamHeaderSize != 0 {
+		return s.config.MaxStreamHeaderSize
+	}
+	return defaultStreamHeaderSize
+}
+
+// frameWatchdog is a long running goroutine that tears down the
+// session if reading a started frame takes longer than
+// HeaderReadTimeout, e.g. because the peer stalled mid header.
+func (s *Session) frameWatchdog() {
+	timeout := s.config.HeaderReadTimeout
+	interval := timeout / 4
+	if interval == 0 {
+		interval = timeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			start := atomic.LoadInt64(&s.frameStart)
+			if start != 0 && time.Since(time.Unix(0, start)) > timeout {
+				s.logger.Printf("[ERR] yamux: frame read stalled for more than %v", timeout)
+				s.exitErr(ErrFrameReadTimeout)
+				return
+			}
+		case <-s.shutdownCh:
+			return
 		}
 	}
 }
 
 // handleStreamMessage handles either a data or window update frame
-func (s *Session) handleStreamMessage(hdr header) error {
+func (s *Session) handleStreamMessage(hdr header, body io.Reader) error {
 	// Check for a new stream creation
 	id := hdr.StreamID()
 	flags := hdr.Flags()
+	if id == 0 && flags&flagEXT == flagEXT && hdr.MsgType() == typeWindowUpdate {
+		return s.handleExtensions(hdr, body)
+	}
+	if flags&flagCHK == flagCHK && hdr.MsgType() == typeData {
+		var err error
+		if hdr, body, err = s.verifyChecksum(hdr, body); err == ErrChecksumMismatch {
+			return s.checksumMismatch(hdr)
+		} else if err != nil {
+			return err
+		}
+		flags = hdr.Flags()
+	}
+	if id == 0 && flags&flagEXT == flagEXT && hdr.MsgType() == typeData {
+		if flags&flagFIN == flagFIN {
+			return s.handleGoAwayMessage(hdr, body)
+		}
+		return s.handleToken(hdr, body)
+	}
+	if flags&flagHDR == flagHDR {
+		return s.handleStreamHeader(hdr, body)
+	}
 	if flags&flagSYN == flagSYN {
-		if err := s.incomingStream(id); err != nil {
+		if err := s.incomingStream(id, nil); err != nil {
 			return err
 		}
 	}
 
 	// Get the stream
-	s.streamLock.Lock()
+	lockCounted(&s.streamLock, &s.streamLockContended)
 	stream := s.streams[id]
 	s.streamLock.Unlock()
 
@@ -503,10 +1657,12 @@ func (s *Session) handleStreamMessage(hdr header) error {
 		// Drain any data on the wire
 		if hdr.MsgType() == typeData && hdr.Length() > 0 {
 			s.logger.Printf("[WARN] yamux: Discarding data for stream: %d", id)
-			if _, err := io.CopyN(ioutil.Discard, s.bufRead, int64(hdr.Length())); err != nil {
+			if _, err := io.CopyN(ioutil.Discard, body, int64(hdr.Length())); err != nil {
 				s.logger.Printf("[ERR] yamux: Failed to discard data: %v", err)
 				return nil
 			}
+		} else if hdr.MsgType() == typeWindowUpdate {
+			return s.staleWindowUpdate(hdr)
 		} else {
 			s.logger.Printf("[WARN] yamux: frame for missing stream: %v", hdr)
 		}
@@ -524,8 +1680,17 @@ func (s *Session) handleStreamMessage(hdr header) error {
 		return nil
 	}
 
+	// Decode the payload if needed
+	length := hdr.Length()
+	if flags&flagCMP == flagCMP {
+		var err error
+		if body, length, err = s.decodePayload(body, length); err != nil {
+			return err
+		}
+	}
+
 	// Read the new data
-	if err := stream.readData(hdr, flags, s.bufRead); err != nil {
+	if err := stream.readData(length, flags, body); err != nil {
 		if sendErr := s.sendNoWait(s.goAway(goAwayProtoErr)); sendErr != nil {
 			s.logger.Printf("[WARN] yamux: failed to send go away: %v", sendErr)
 		}
@@ -534,8 +1699,49 @@ func (s *Session) handleStreamMessage(hdr header) error {
 	return nil
 }
 
+// handleStreamHeader handles a data frame carrying the header of
+// a new stream. The header is read before the stream is registered,
+// so it is in place by the time the stream can be accepted.
+func (s *Session) handleStreamHeader(hdr header, body io.Reader) error {
+	id := hdr.StreamID()
+	flags := hdr.Flags()
+	length := hdr.Length()
+	if hdr.MsgType() != typeData || flags&flagSYN != flagSYN {
+		s.logger.Printf("[ERR] yamux: stream header without SYN (stream: %d)", id)
+		return ErrUnexpectedFlag
+	}
+
+	// Reject oversized headers without buffering them
+	if length > s.maxStreamHeaderSize() {
+		s.logger.Printf("[WARN] yamux: stream header too large (stream: %d, size: %d)", id, length)
+		if _, err := io.CopyN(ioutil.Discard, body, int64(length)); err != nil {
+			return err
+		}
+		rst := header(make([]byte, headerSize))
+		rst.encode(typeWindowUpdate, flagRST, id, 0)
+		return s.sendNoWait(rst)
+	}
+
+	meta := make([]byte, length)
+	if _, err := io.ReadFull(body, meta); err != nil {
+		return err
+	}
+	if err := s.incomingStream(id, meta); err != nil {
+		return err
+	}
+
+	// Process any remaining flags, e.g. an immediate FIN
+	lockCounted(&s.streamLock, &s.streamLockContended)
+	stream := s.streams[id]
+	s.streamLock.Unlock()
+	if stream == nil {
+		return nil
+	}
+	return stream.processFlags(flags &^ flagSYN)
+}
+
 // handlePing is invokde for a typePing frame
-func (s *Session) handlePing(hdr header) error {
+func (s *Session) handlePing(hdr header, body io.Reader) error {
 	flags := hdr.Flags()
 	pingID := hdr.Length()
 
@@ -552,8 +1758,9 @@ func (s *Session) handlePing(hdr header) error {
 		return nil
 	}
 
-	// Handle a response
+	// Handle a response, late ones still show the peer is alive
 	s.pingLock.Lock()
+	s.missedPings = 0
 	ch := s.pings[pingID]
 	if ch != nil {
 		delete(s.pings, pingID)
@@ -564,26 +1771,40 @@ func (s *Session) handlePing(hdr header) error {
 }
 
 // handleGoAway is invokde for a typeGoAway frame
-func (s *Session) handleGoAway(hdr header) error {
+func (s *Session) handleGoAway(hdr header, body io.Reader) error {
+	atomic.CompareAndSwapInt64(&s.remoteGoAwayAt, 0, time.Now().UnixNano())
+	atomic.SwapInt32(&s.remoteGoAway, 1)
 	code := hdr.Length()
+	var reason string
+	if msg := s.RemoteGoAwayMessage(); msg != "" {
+		reason = ": " + msg
+	}
 	switch code {
 	case goAwayNormal:
-		atomic.SwapInt32(&s.remoteGoAway, 1)
+		if reason != "" {
+			s.logger.Printf("[WARN] yamux: received go away%s", reason)
+		}
 	case goAwayProtoErr:
-		s.logger.Printf("[ERR] yamux: received protocol error go away")
+		s.logger.Printf("[ERR] yamux: received protocol error go away%s", reason)
 		return fmt.Errorf("yamux protocol error")
 	case goAwayInternalErr:
-		s.logger.Printf("[ERR] yamux: received internal error go away")
+		s.logger.Printf("[ERR] yamux: received internal error go away%s", reason)
 		return fmt.Errorf("remote yamux internal error")
 	default:
-		s.logger.Printf("[ERR] yamux: received unexpected go away")
+		s.logger.Printf("[ERR] yamux: received unexpected go away%s", reason)
 		return fmt.Errorf("unexpected go away received")
 	}
 	return nil
 }
 
 // incomingStream is used to create a new incoming stream
-func (s *Session) incomingStream(id uint32) error {
+func (s *Session) incomingStream(id uint32, meta []byte) error {
+	// Only the recv loop opens incoming streams
+	if id > atomic.LoadUint32(&s.remoteStreamID) {
+		atomic.StoreUint32(&s.remoteStreamID, id)
+	}
+	atomic.StoreInt64(&s.lastInboundSYN, time.Now().UnixNano())
+
 	// Reject immediately if we are doing a go away
 	if atomic.LoadInt32(&s.localGoAway) == 1 {
 		hdr := header(make([]byte, headerSize))
@@ -591,42 +1812,125 @@ func (s *Session) incomingStream(id uint32) error {
 		return s.sendNoWait(hdr)
 	}
 
+	// Shed the stream if the session is overloaded
+	if s.loadFactor() >= 1 {
+		s.logger.Printf("[WARN] yamux: session overloaded, refusing stream %d", id)
+		hdr := header(make([]byte, headerSize))
+		hdr.encode(typeWindowUpdate, flagRST, id, rstOverloaded)
+		return s.sendNoWait(hdr)
+	}
+
 	// Allocate a new stream
-	stream := newStream(s, id, streamSYNReceived)
+	stream := newStream(s, id, StreamSYNReceived)
+	stream.header = meta
 
-	s.streamLock.Lock()
-	defer s.streamLock.Unlock()
+	lockCounted(&s.streamLock, &s.streamLockContended)
 
 	// Check if stream already exists
 	if _, ok := s.streams[id]; ok {
-		s.logger.Printf("[ERR] yamux: duplicate stream declared")
-		if sendErr := s.sendNoWait(s.goAway(goAwayProtoErr)); sendErr != nil {
-			s.logger.Printf("[WARN] yamux: failed to send go away: %v", sendErr)
-		}
-		return ErrDuplicateStream
+		s.streamLock.Unlock()
+		return s.duplicateStream(id)
+	}
+	defer s.streamLock.Unlock()
+
+	// Liveness streams are answered internally, bypassing the backlog
+	liveness := isLivenessHeader(meta)
+	if liveness && atomic.AddInt32(&s.livenessEchoes, 1) > maxLivenessEchoes {
+		atomic.AddInt32(&s.livenessEchoes, -1)
+		s.logger.Printf("[WARN] yamux: too many liveness checks, resetting stream %d", id)
+		hdr := header(make([]byte, headerSize))
+		hdr.encode(typeWindowUpdate, flagRST, id, 0)
+		return s.sendNoWait(hdr)
 	}
 
 	// Register the stream
 	s.streams[id] = stream
+	s.trace(TraceStreamOpen, id, 0)
+	if liveness {
+		go s.echoLiveness(stream)
+		return nil
+	}
+
+	// Hold the stream until approved
+	stream.approvalPending = s.config.RequireStreamApproval
 
 	// Check if we've exceeded the backlog
-	select {
-	case s.acceptCh <- stream:
+	queued, dropped := s.accept.push(stream)
+	if queued && dropped == nil {
 		return nil
-	default:
-		// Backlog exceeded! RST the stream
-		s.logger.Printf("[WARN] yamux: backlog exceeded, forcing connection reset")
-		delete(s.streams, id)
-		stream.sendHdr.encode(typeWindowUpdate, flagRST, id, 0)
-		return s.sendNoWait(stream.sendHdr)
 	}
+
+	// Backlog exceeded! RST the new stream, or the oldest waiting
+	// one when accepting LIFO
+	s.logger.Printf("[WARN] yamux: backlog exceeded, forcing connection reset")
+	if dropped != nil {
+		stream = dropped
+		stream.forceClose()
+	}
+	delete(s.streams, stream.id)
+	stream.sendHdr.encode(typeWindowUpdate, flagRST, stream.id, rstBacklog)
+	if err := s.sendNoWait(stream.sendHdr); err != nil {
+		return err
+	}
+	if s.config.AcceptOverflowPolicy == AcceptOverflowGoAway {
+		return s.sendNoWait(s.goAway(goAwayNormal))
+	}
+	return nil
+}
+
+// staleWindowUpdate handles a window update for a stream we don't
+// know. Usually the stream was just closed and the update crossed our
+// FIN or RST on the wire, so it is discarded. With StrictProtocol, an
+// update for a stream that was never opened is a protocol error.
+func (s *Session) staleWindowUpdate(hdr header) error {
+	id := hdr.StreamID()
+	if s.config.StrictProtocol && !s.streamOpened(id) {
+		s.logger.Printf("[ERR] yamux: window update for unknown stream: %d", id)
+		if err := s.sendNoWait(s.goAway(goAwayProtoErr)); err != nil {
+			s.logger.Printf("[WARN] yamux: failed to send go away: %v", err)
+		}
+		return ErrUnknownStream
+	}
+	atomic.AddUint64(&s.staleWindowUpdates, 1)
+	return nil
+}
+
+// streamOpened checks if a stream with the given ID was opened by
+// either side at some point
+func (s *Session) streamOpened(id uint32) bool {
+	next := atomic.LoadUint32(&s.nextStreamID)
+	if id%2 == next%2 {
+		return id < next
+	}
+	return id <= atomic.LoadUint32(&s.remoteStreamID)
+}
+
+// duplicateStream handles a SYN for a stream ID that is in use
+// according to the DuplicateSYNAction. The stream is reset, as both
+// sides can't agree on its state anymore. It returns an error if the
+// session should be closed.
+func (s *Session) duplicateStream(id uint32) error {
+	s.logger.Printf("[ERR] yamux: duplicate stream declared (stream: %d)", id)
+	s.resetStream(id)
+	if s.config.DuplicateSYNAction == DuplicateSYNReset {
+		return nil
+	}
+	if err := s.sendNoWait(s.goAway(goAwayProtoErr)); err != nil {
+		s.logger.Printf("[WARN] yamux: failed to send go away: %v", err)
+	}
+	return ErrDuplicateStream
 }
 
 // closeStream is used to close a stream once both sides have
 // issued a close. If there was an in-flight SYN and the stream
 // was not yet established, then this will give the credit back.
 func (s *Session) closeStream(id uint32) {
-	s.streamLock.Lock()
+	lockCounted(&s.streamLock, &s.streamLockContended)
+	stream, ok := s.streams[id]
+	if ok {
+		// The peer won't return credit for a closed stream
+		s.releaseSendBuffer(stream.releaseUnacked(math.MaxUint32))
+	}
 	if _, ok := s.inflight[id]; ok {
 		select {
 		case <-s.synCh:
@@ -635,13 +1939,22 @@ func (s *Session) closeStream(id uint32) {
 		}
 	}
 	delete(s.streams, id)
+	close(s.streamCloseCh)
+	s.streamCloseCh = make(chan struct{})
 	s.streamLock.Unlock()
+	if ok {
+		stream.done()
+		if s.closed != nil {
+			s.closed.add(stream.summary())
+		}
+	}
+	s.trace(TraceStreamClose, id, 0)
 }
 
 // establishStream is used to mark a stream that was in the
 // SYN Sent state as established.
 func (s *Session) establishStream(id uint32) {
-	s.streamLock.Lock()
+	lockCounted(&s.streamLock, &s.streamLockContended)
 	if _, ok := s.inflight[id]; ok {
 		delete(s.inflight, id)
 	} else {
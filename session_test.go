@@ -2,14 +2,21 @@ package yamux
 
 import (
 	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"reflect"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -372,7 +379,200 @@ func TestSendData_Small(t *testing.T) {
 }
 
 func TestSendData_Large(t *testing.T) {
-	client, server := testClientServer()
+	testSendDataLarge(t, testConf())
+}
+
+func TestSendData_LargeRingBuffer(t *testing.T) {
+	conf := testConf()
+	conf.RecvBufferStrategy = RecvBufferRing
+	testSendDataLarge(t, conf)
+}
+
+func TestSendData_LargeBatchWindowUpdates(t *testing.T) {
+	conf := testConf()
+	conf.BatchWindowUpdates = true
+	conf.ReadAheadFactor = 0.01
+	testSendDataLarge(t, conf)
+}
+
+func TestWindowUpdateInterval(t *testing.T) {
+	// waitWindow reads n bytes on the server and reports whether the
+	// client got the credit back within d
+	waitWindow := func(stream, stream2 *Stream, n int, d time.Duration) bool {
+		if _, err := stream.Write(make([]byte, n)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := io.ReadFull(stream2, make([]byte, n)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		deadline := time.Now().Add(d)
+		for stream.SendWindow() != initialStreamWindow {
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return true
+	}
+
+	for _, interval := range []time.Duration{0, time.Millisecond, time.Hour} {
+		conf := testConf()
+		conf.BatchWindowUpdates = true
+		conf.WindowUpdateInterval = interval
+		client, server := testClientServerConfig(conf)
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := stream.WaitEstablished(context.Background()); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Credit below the threshold comes back after a small interval
+		returned := waitWindow(stream, stream2, 1000, 100*time.Millisecond)
+		if want := interval == time.Millisecond; returned != want {
+			t.Fatalf("%v: bad: %v", interval, returned)
+		}
+
+		// Reaching the threshold returns it right away regardless
+		if !waitWindow(stream, stream2, int(initialStreamWindow/2), time.Second) {
+			t.Fatalf("%v: window not returned", interval)
+		}
+
+		client.Close()
+		server.Close()
+	}
+
+	conf := testConf()
+	conf.WindowUpdateInterval = -time.Second
+	if err := VerifyConfig(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestWindowUpdateBatch_RecvBusy(t *testing.T) {
+	conf := testConf()
+	conf.BatchWindowUpdates = true
+	conf.WindowUpdateInterval = time.Hour
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream.WaitEstablished(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(stream2, make([]byte, 1000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A busy receive buffer doesn't hold up the send loop
+	stream2.recvLock.Lock()
+	server.batch.add(stream2)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := server.Ping()
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("send loop blocked")
+	}
+	if stream.SendWindow() == initialStreamWindow {
+		t.Fatalf("window returned")
+	}
+	stream2.recvLock.Unlock()
+
+	// The update goes out once the buffer is free
+	deadline := time.Now().Add(time.Second)
+	for stream.SendWindow() != initialStreamWindow {
+		if time.Now().After(deadline) {
+			t.Fatalf("window not returned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSendData_AsymmetricWindows(t *testing.T) {
+	serverConf := testConf()
+	serverConf.MaxStreamWindowSize = 4 * initialStreamWindow
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, testConf())
+	server, _ := Server(conn2, serverConf)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	if err := stream.WaitEstablished(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Each side may send what the other side grants
+	if w := stream.SendWindow(); w != serverConf.MaxStreamWindowSize {
+		t.Fatalf("bad: %d", w)
+	}
+	if w := stream2.SendWindow(); w != initialStreamWindow {
+		t.Fatalf("bad: %d", w)
+	}
+
+	// Data flows both ways beyond either window
+	data := make([]byte, 2*serverConf.MaxStreamWindowSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	errCh := make(chan error, 2)
+	for _, s := range []*Stream{stream, stream2} {
+		go func(s *Stream) {
+			_, err := s.Write(data)
+			errCh <- err
+		}(s)
+	}
+	for _, s := range []*Stream{stream, stream2} {
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(s, got); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("bad data")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func testSendDataLarge(t *testing.T, conf *Config) {
+	client, server := testClientServerConfig(conf)
 	defer client.Close()
 	defer server.Close()
 
@@ -467,6 +667,87 @@ func TestGoAway(t *testing.T) {
 	}
 }
 
+func TestGoAway_State(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	if client.GoAwayReceived() || client.GoAwaySent() || server.GoAwayReceived() || server.GoAwaySent() {
+		t.Fatalf("no go away yet")
+	}
+	if err := server.GoAway(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !server.GoAwaySent() || server.GoAwayReceived() {
+		t.Fatalf("bad server state")
+	}
+
+	// Wait for the client to process the GoAway
+	if _, err := server.Ping(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !client.GoAwayReceived() || client.GoAwaySent() {
+		t.Fatalf("bad client state")
+	}
+
+	// The existing stream keeps working
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(stream2, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestGoAway_Grace(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	// The server sends a GoAway but keeps accepting streams
+	const grace = 100 * time.Millisecond
+	client.SetGoAwayGrace(grace)
+	hdr := header(make([]byte, headerSize))
+	hdr.encode(typeGoAway, 0, 0, goAwayNormal)
+	if err := server.sendNoWait(hdr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := server.Ping(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !client.GoAwayReceived() {
+		t.Fatalf("should receive go away")
+	}
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	time.Sleep(grace)
+	if _, err := client.OpenStream(); err != ErrRemoteGoAway {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestManyStreams(t *testing.T) {
 	client, server := testClientServer()
 	defer client.Close()
@@ -671,7 +952,56 @@ func TestHalfClose(t *testing.T) {
 	}
 }
 
-func TestReadDeadline(t *testing.T) {
+func TestSession_PreserveDataOnClose(t *testing.T) {
+	for _, preserve := range []bool{true, false} {
+		conf := testConfNoKeepAlive()
+		conf.PreserveDataOnClose = preserve
+		client, server := testClientServerConfig(conf)
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := stream.Write([]byte("a")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := stream2.Write([]byte("hello")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Half close the stream, the session closes before the peer
+		// closes its side
+		if err := stream.Close(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if state := stream.State(); state != StreamLocalClose {
+			t.Fatalf("bad: %v", state)
+		}
+		deadline := time.Now().Add(time.Second)
+		for stream.flowState().Buffered != 5 {
+			if time.Now().After(deadline) {
+				t.Fatalf("data not received")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		client.Close()
+		server.Close()
+
+		buf, err := ioutil.ReadAll(stream)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if want := map[bool]string{true: "hello"}[preserve]; string(buf) != want {
+			t.Fatalf("bad: %v %q", preserve, buf)
+		}
+	}
+}
+
+func TestReadVectored(t *testing.T) {
 	client, server := testClientServer()
 	defer client.Close()
 	defer server.Close()
@@ -680,25 +1010,40 @@ func TestReadDeadline(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	defer stream.Close()
+	for _, msg := range []string{"abc", "defg", "hi"} {
+		if _, err := stream.Write([]byte(msg)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	stream.Close()
 
-	stream2, err := server.Accept()
+	stream2, err := server.AcceptStream()
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	defer stream2.Close()
 
-	if err := stream.SetReadDeadline(time.Now().Add(5 * time.Millisecond)); err != nil {
+	// Wait for all the frames to arrive so they are read in one go
+	time.Sleep(20 * time.Millisecond)
+
+	bufs := [][]byte{make([]byte, 2), make([]byte, 4), make([]byte, 8)}
+	n, err := stream2.ReadVectored(bufs)
+	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	if n != 9 {
+		t.Fatalf("bad: %v", n)
+	}
+	if got := string(bufs[0]) + string(bufs[1]) + string(bufs[2][:3]); got != "abcdefghi" {
+		t.Fatalf("bad: %s", got)
+	}
 
-	buf := make([]byte, 4)
-	if _, err := stream.Read(buf); err != ErrTimeout {
+	if _, err := stream2.ReadVectored(bufs); err != io.EOF {
 		t.Fatalf("err: %v", err)
 	}
 }
 
-func TestWriteDeadline(t *testing.T) {
+func TestReadAvailable(t *testing.T) {
 	client, server := testClientServer()
 	defer client.Close()
 	defer server.Close()
@@ -707,141 +1052,161 @@ func TestWriteDeadline(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	defer stream.Close()
+	if _, err := stream.Write([]byte("abcdefg")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
 
-	stream2, err := server.Accept()
+	stream2, err := server.AcceptStream()
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	defer stream2.Close()
 
-	if err := stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
-		t.Fatalf("err: %v", err)
-	}
+	// Wait for the frame to arrive
+	time.Sleep(20 * time.Millisecond)
 
-	buf := make([]byte, 512)
-	for i := 0; i < int(initialStreamWindow); i++ {
-		_, err := stream.Write(buf)
-		if err != nil && err == ErrTimeout {
-			return
-		} else if err != nil {
+	buf := make([]byte, 4)
+	expect := []struct {
+		data string
+		more bool
+	}{
+		{"abcd", true},
+		{"efg", false},
+	}
+	for _, e := range expect {
+		n, more, err := stream2.ReadAvailable(buf)
+		if err != nil {
 			t.Fatalf("err: %v", err)
 		}
+		if string(buf[:n]) != e.data || more != e.more {
+			t.Fatalf("bad: %q %v", buf[:n], more)
+		}
+	}
+
+	stream.Close()
+	if _, more, err := stream2.ReadAvailable(buf); err != io.EOF || more {
+		t.Fatalf("bad: %v %v", more, err)
 	}
-	t.Fatalf("Expected timeout")
 }
 
-func TestBacklogExceeded(t *testing.T) {
+func TestStreamState(t *testing.T) {
 	client, server := testClientServer()
 	defer client.Close()
 	defer server.Close()
 
-	// Fill the backlog
-	max := client.config.AcceptBacklog
-	for i := 0; i < max; i++ {
-		stream, err := client.Open()
-		if err != nil {
-			t.Fatalf("err: %v", err)
-		}
-		defer stream.Close()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if state := stream.State(); state != StreamSYNSent {
+		t.Fatalf("bad: %v", state)
+	}
 
-		if _, err := stream.Write([]byte("foo")); err != nil {
-			t.Fatalf("err: %v", err)
-		}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if state := stream2.State(); state != StreamEstablished {
+		t.Fatalf("bad: %v", state)
 	}
 
-	// Attempt to open a new stream
-	errCh := make(chan error, 1)
-	go func() {
-		_, err := client.Open()
-		errCh <- err
-	}()
+	stream2.Close()
+	if state := stream2.State(); state != StreamLocalClose {
+		t.Fatalf("bad: %v", state)
+	}
 
-	// Shutdown the server
-	go func() {
-		time.Sleep(10 * time.Millisecond)
-		server.Close()
-	}()
-
-	select {
-	case err := <-errCh:
-		if err == nil {
-			t.Fatalf("open should fail")
+	// FIN from the server puts the client in remote close
+	deadline := time.Now().Add(time.Second)
+	for stream.State() != StreamRemoteClose {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %v", stream.State())
 		}
-	case <-time.After(time.Second):
-		t.Fatalf("timeout")
+		time.Sleep(time.Millisecond)
 	}
-}
-
-func TestKeepAlive(t *testing.T) {
-	client, server := testClientServer()
-	defer client.Close()
-	defer server.Close()
-
-	time.Sleep(200 * time.Millisecond)
 
-	// Ping value should increase
-	client.pingLock.Lock()
-	defer client.pingLock.Unlock()
-	if client.pingID == 0 {
-		t.Fatalf("should ping")
+	stream.Close()
+	if state := stream.State(); state != StreamClosed {
+		t.Fatalf("bad: %v", state)
 	}
-
-	server.pingLock.Lock()
-	defer server.pingLock.Unlock()
-	if server.pingID == 0 {
-		t.Fatalf("should ping")
+	if s := StreamReset.String(); s != "Reset" {
+		t.Fatalf("bad: %v", s)
 	}
 }
 
-func TestKeepAlive_Timeout(t *testing.T) {
-	conn1, conn2 := testConn()
-
-	clientConf := testConf()
-	clientConf.ConnectionWriteTimeout = time.Hour // We're testing keep alives, not connection writes
-	clientConf.EnableKeepAlive = false            // Just test one direction, so it's deterministic who hangs up on whom
-	client, _ := Client(conn1, clientConf)
+func TestStream_WriteAfterClose(t *testing.T) {
+	client, server := testClientServer()
 	defer client.Close()
-
-	server, _ := Server(conn2, testConf())
 	defer server.Close()
 
-	_ = captureLogs(client) // Client logs aren't part of the test
-	serverLogs := captureLogs(server)
-
-	errCh := make(chan error, 1)
-	go func() {
-		_, err := server.Accept() // Wait until server closes
-		errCh <- err
-	}()
+	open := func() (*Stream, *Stream) {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return stream, stream2
+	}
+	waitState := func(stream *Stream, state StreamState) {
+		deadline := time.Now().Add(time.Second)
+		for stream.State() != state {
+			if time.Now().After(deadline) {
+				t.Fatalf("bad: %v", stream.State())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	data := []byte("hello")
 
-	// Prevent the client from responding
-	clientConn := client.conn.(*pipeConn)
-	clientConn.writeBlocker.Lock()
+	// Half-closing only prevents our side from writing
+	stream, stream2 := open()
+	if err := stream2.CloseWrite(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream2.Write(data); err != ErrStreamClosedForWriting {
+		t.Fatalf("err: %v", err)
+	}
+	waitState(stream, StreamRemoteClose)
+	if _, err := stream.Write(data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(stream2, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
 
-	select {
-	case err := <-errCh:
-		if err != ErrKeepAliveTimeout {
-			t.Fatalf("unexpected error: %v", err)
+	// Both sides closed
+	stream.Close()
+	waitState(stream2, StreamClosed)
+	for _, s := range []*Stream{stream, stream2} {
+		if _, err := s.Write(data); err != ErrStreamClosedForWriting {
+			t.Fatalf("err: %v", err)
 		}
-	case <-time.After(1 * time.Second):
-		t.Fatalf("timeout waiting for timeout")
 	}
 
-	if !server.IsClosed() {
-		t.Fatalf("server should have closed")
+	// Reset, also after half-closing
+	stream, stream2 = open()
+	stream.Close()
+	server.resetStream(stream2.id)
+	waitState(stream, StreamReset)
+	for _, s := range []*Stream{stream, stream2} {
+		if _, err := s.Write(data); err != ErrConnectionReset {
+			t.Fatalf("err: %v", err)
+		}
 	}
 
-	if !serverLogs.match([]string{"[ERR] yamux: keepalive failed: i/o deadline reached"}) {
-		t.Fatalf("server log incorect: %v", serverLogs.logs())
+	// Closed by the session
+	stream, _ = open()
+	client.Close()
+	if _, err := stream.Write(data); err != ErrStreamClosed {
+		t.Fatalf("err: %v", err)
 	}
 }
 
-func TestLargeWindow(t *testing.T) {
-	conf := DefaultConfig()
-	conf.MaxStreamWindowSize *= 2
-
-	client, server := testClientServerConfig(conf)
+func TestReadDeadline(t *testing.T) {
+	client, server := testClientServer()
 	defer client.Close()
 	defer server.Close()
 
@@ -857,400 +1222,6085 @@ func TestLargeWindow(t *testing.T) {
 	}
 	defer stream2.Close()
 
-	stream.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
-	buf := make([]byte, conf.MaxStreamWindowSize)
-	n, err := stream.Write(buf)
-	if err != nil {
+	if err := stream.SetReadDeadline(time.Now().Add(5 * time.Millisecond)); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if n != len(buf) {
-		t.Fatalf("short write: %d", n)
-	}
-}
-
-type UnlimitedReader struct{}
 
-func (u *UnlimitedReader) Read(p []byte) (int, error) {
-	runtime.Gosched()
-	return len(p), nil
+	buf := make([]byte, 4)
+	if _, err := stream.Read(buf); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
 }
 
-func TestSendData_VeryLarge(t *testing.T) {
+func TestWriteDeadline(t *testing.T) {
 	client, server := testClientServer()
 	defer client.Close()
 	defer server.Close()
 
-	var n int64 = 1 * 1024 * 1024 * 1024
-	var workers int = 16
-
-	wg := &sync.WaitGroup{}
-	wg.Add(workers * 2)
-
-	for i := 0; i < workers; i++ {
-		go func() {
-			defer wg.Done()
-			stream, err := server.AcceptStream()
-			if err != nil {
-				t.Fatalf("err: %v", err)
-			}
-			defer stream.Close()
-
-			buf := make([]byte, 4)
-			_, err = stream.Read(buf)
-			if err != nil {
-				t.Fatalf("err: %v", err)
-			}
-			if !bytes.Equal(buf, []byte{0, 1, 2, 3}) {
-				t.Fatalf("bad header")
-			}
-
-			recv, err := io.Copy(ioutil.Discard, stream)
-			if err != nil {
-				t.Fatalf("err: %v", err)
-			}
-			if recv != n {
-				t.Fatalf("bad: %v", recv)
-			}
-		}()
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatalf("err: %v", err)
 	}
-	for i := 0; i < workers; i++ {
-		go func() {
-			defer wg.Done()
-			stream, err := client.Open()
-			if err != nil {
-				t.Fatalf("err: %v", err)
-			}
-			defer stream.Close()
+	defer stream.Close()
 
-			_, err = stream.Write([]byte{0, 1, 2, 3})
-			if err != nil {
-				t.Fatalf("err: %v", err)
-			}
+	stream2, err := server.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
 
-			unlimited := &UnlimitedReader{}
-			sent, err := io.Copy(stream, io.LimitReader(unlimited, n))
-			if err != nil {
-				t.Fatalf("err: %v", err)
-			}
-			if sent != n {
-				t.Fatalf("bad: %v", sent)
-			}
-		}()
+	if err := stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatalf("err: %v", err)
 	}
 
-	doneCh := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(doneCh)
-	}()
-	select {
-	case <-doneCh:
-	case <-time.After(20 * time.Second):
-		panic("timeout")
+	buf := make([]byte, 512)
+	for i := 0; i < int(initialStreamWindow); i++ {
+		_, err := stream.Write(buf)
+		if err != nil && err == ErrTimeout {
+			return
+		} else if err != nil {
+			t.Fatalf("err: %v", err)
+		}
 	}
+	t.Fatalf("Expected timeout")
 }
 
-func TestBacklogExceeded_Accept(t *testing.T) {
+func TestReadDeadline_Past(t *testing.T) {
 	client, server := testClientServer()
 	defer client.Close()
 	defer server.Close()
 
-	max := 5 * client.config.AcceptBacklog
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	// A deadline in the past unblocks a pending read
+	errCh := make(chan error, 1)
 	go func() {
-		for i := 0; i < max; i++ {
-			stream, err := server.Accept()
-			if err != nil {
-				t.Fatalf("err: %v", err)
-			}
-			defer stream.Close()
-		}
+		_, err := stream.Read(make([]byte, 4))
+		errCh <- err
 	}()
-
-	// Fill the backlog
-	for i := 0; i < max; i++ {
-		stream, err := client.Open()
-		if err != nil {
+	time.Sleep(10 * time.Millisecond)
+	if err := stream.SetReadDeadline(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if err != ErrTimeout {
 			t.Fatalf("err: %v", err)
 		}
-		defer stream.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("read not unblocked")
+	}
 
-		if _, err := stream.Write([]byte("foo")); err != nil {
-			t.Fatalf("err: %v", err)
+	// Later reads fail right away, even with data buffered
+	if _, err := stream2.Write([]byte("test")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint64(&stream.bytesRecv) != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("data not received")
 		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := stream.Read(make([]byte, 4)); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Until the deadline is cleared
+	if err := stream.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 4)
+	if n, err := stream.Read(buf); err != nil || string(buf[:n]) != "test" {
+		t.Fatalf("bad: %q %v", buf[:n], err)
+	}
+
+	// Or moved to the future
+	if err := stream.SetReadDeadline(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream2.Write([]byte("more")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream.SetReadDeadline(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "more" {
+		t.Fatalf("bad: %q %v", buf, err)
 	}
 }
 
-func TestSession_WindowUpdateWriteDuringRead(t *testing.T) {
-	client, server := testClientServerConfig(testConfNoKeepAlive())
+func TestWriteDeadline_Past(t *testing.T) {
+	client, server := testClientServer()
 	defer client.Close()
 	defer server.Close()
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
 
-	// Choose a huge flood size that we know will result in a window update.
-	flood := int64(client.config.MaxStreamWindowSize) - 1
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
 
-	// The server will accept a new stream and then flood data to it.
+	// Use up the send window, so the next write blocks
+	if _, err := stream.Write(make([]byte, initialStreamWindow)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	errCh := make(chan error, 1)
 	go func() {
-		defer wg.Done()
-
-		stream, err := server.AcceptStream()
-		if err != nil {
+		_, err := stream.Write([]byte("test"))
+		errCh <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := stream.SetWriteDeadline(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if err != ErrTimeout {
 			t.Fatalf("err: %v", err)
 		}
-		defer stream.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("write not unblocked")
+	}
 
-		n, err := stream.Write(make([]byte, flood))
-		if err != nil {
-			t.Fatalf("err: %v", err)
-		}
-		if int64(n) != flood {
-			t.Fatalf("short write: %d", n)
+	// Later writes fail right away, even with window available
+	if _, err := io.ReadFull(stream2, make([]byte, initialStreamWindow)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for stream.SendWindow() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("window not returned")
 		}
-	}()
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := stream.Write([]byte("test")); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
 
-	// The client will open a stream, block outbound writes, and then
-	// listen to the flood from the server, which should time out since
-	// it won't be able to send the window update.
-	go func() {
-		defer wg.Done()
+	// Until the deadline is cleared
+	if err := stream.SetWriteDeadline(time.Time{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("test")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(stream2, buf); err != nil || string(buf) != "test" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
+}
 
-		stream, err := client.OpenStream()
-		if err != nil {
-			t.Fatalf("err: %v", err)
-		}
-		defer stream.Close()
+func TestWrite_LargerThanWindow(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
 
-		conn := client.conn.(*pipeConn)
-		conn.writeBlocker.Lock()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
 
-		_, err = stream.Read(make([]byte, flood))
-		if err != ErrConnectionWriteTimeout {
-			t.Fatalf("err: %v", err)
+	// A single write twice the window needs successive window updates
+	data := make([]byte, 2*initialStreamWindow)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		n, err := stream.Write(data)
+		if err == nil && n != len(data) {
+			err = fmt.Errorf("short write: %d", n)
 		}
+		errCh <- err
 	}()
 
-	wg.Wait()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(stream2, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("bad data")
+	}
 }
 
-func TestSession_PartialReadWindowUpdate(t *testing.T) {
-	client, server := testClientServerConfig(testConfNoKeepAlive())
+func TestWrite_LargerThanWindow_Partial(t *testing.T) {
+	client, server := testClientServer()
 	defer client.Close()
 	defer server.Close()
 
-	var wg sync.WaitGroup
-	wg.Add(1)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
 
-	// Choose a huge flood size that we know will result in a window update.
-	flood := int64(client.config.MaxStreamWindowSize)
-	var wr *Stream
+	// Without a reader, only the window is written before the deadline
+	if err := stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	n, err := stream.Write(make([]byte, 2*initialStreamWindow))
+	if err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+	if n != int(initialStreamWindow) {
+		t.Fatalf("bad: %d", n)
+	}
 
-	// The server will accept a new stream and then flood data to it.
+	// A reset while blocked also returns what was written
+	stream, err = client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	resultCh := make(chan result, 1)
 	go func() {
-		defer wg.Done()
-
-		var err error
-		wr, err = server.AcceptStream()
+		n, err := stream.Write(make([]byte, 2*initialStreamWindow))
+		resultCh <- result{n, err}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for stream.SendWindow() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("window not used")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for {
+		stream2, err := server.AcceptStream()
 		if err != nil {
 			t.Fatalf("err: %v", err)
 		}
-		defer wr.Close()
-
-		if wr.sendWindow != client.config.MaxStreamWindowSize {
-			t.Fatalf("sendWindow: exp=%d, got=%d", client.config.MaxStreamWindowSize, wr.sendWindow)
+		if stream2.StreamID() == stream.StreamID() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			stream2.SetContext(ctx)
+			break
+		}
+	}
+	select {
+	case r := <-resultCh:
+		if r.err != ErrConnectionReset {
+			t.Fatalf("err: %v", r.err)
 		}
+		if r.n != int(initialStreamWindow) {
+			t.Fatalf("bad: %d", r.n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("write not unblocked")
+	}
+}
 
-		n, err := wr.Write(make([]byte, flood))
+func TestBacklogExceeded(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	// Fill the backlog
+	max := client.config.AcceptBacklog
+	for i := 0; i < max; i++ {
+		stream, err := client.Open()
 		if err != nil {
 			t.Fatalf("err: %v", err)
 		}
-		if int64(n) != flood {
-			t.Fatalf("short write: %d", n)
-		}
-		if wr.sendWindow != 0 {
-			t.Fatalf("sendWindow: exp=%d, got=%d", 0, wr.sendWindow)
-		}
-	}()
+		defer stream.Close()
 
-	stream, err := client.OpenStream()
-	if err != nil {
-		t.Fatalf("err: %v", err)
+		if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
 	}
-	defer stream.Close()
 
-	wg.Wait()
+	// Attempt to open a new stream
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.Open()
+		errCh <- err
+	}()
 
-	_, err = stream.Read(make([]byte, flood/2+1))
+	// Shutdown the server
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		server.Close()
+	}()
 
-	if exp := uint32(flood/2 + 1); wr.sendWindow != exp {
-		t.Errorf("sendWindow: exp=%d, got=%d", exp, wr.sendWindow)
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("open should fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
 	}
 }
 
-func TestSession_sendNoWait_Timeout(t *testing.T) {
-	client, server := testClientServerConfig(testConfNoKeepAlive())
+func TestBacklogExceeded_GoAway(t *testing.T) {
+	conf := testConf()
+	conf.AcceptBacklog = 2
+	conf.AcceptOverflowPolicy = AcceptOverflowGoAway
+	client, server := testClientServerConfig(conf)
 	defer client.Close()
 	defer server.Close()
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
+	_ = captureLogs(server)
 
-		stream, err := server.AcceptStream()
+	// Let the server see more streams than its backlog. The client is
+	// sized identically, so widen its SYN semaphore to be able to
+	// overflow the server.
+	client.synCh = make(chan struct{}, 2*conf.AcceptBacklog)
+	for i := 0; i <= conf.AcceptBacklog; i++ {
+		stream, err := client.Open()
 		if err != nil {
 			t.Fatalf("err: %v", err)
 		}
 		defer stream.Close()
-	}()
 
-	// The client will open the stream and then block outbound writes, we'll
-	// probe sendNoWait once it gets into that state.
-	go func() {
-		defer wg.Done()
+		if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
 
-		stream, err := client.OpenStream()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := client.Open(); err == ErrRemoteGoAway {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected remote go away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBacklogExceeded_LIFO(t *testing.T) {
+	conf := testConf()
+	conf.AcceptBacklog = 2
+	conf.AcceptOrder = AcceptLIFO
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	_ = captureLogs(server)
+
+	// Overflow the server's backlog by one stream
+	client.synCh = make(chan struct{}, 2*conf.AcceptBacklog)
+	var streams []*Stream
+	for i := 0; i <= conf.AcceptBacklog; i++ {
+		stream, err := client.Open()
 		if err != nil {
 			t.Fatalf("err: %v", err)
 		}
 		defer stream.Close()
+		streams = append(streams, stream.(*Stream))
+	}
 
-		conn := client.conn.(*pipeConn)
-		conn.writeBlocker.Lock()
+	// The oldest stream is reset to make room
+	streams[0].SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := streams[0].Read(make([]byte, 1)); err != ErrConnectionReset {
+		t.Fatalf("err: %v", err)
+	}
 
-		hdr := header(make([]byte, headerSize))
-		hdr.encode(typePing, flagACK, 0, 0)
-		for {
-			err = client.sendNoWait(hdr)
-			if err == nil {
-				continue
-			} else if err == ErrConnectionWriteTimeout {
-				break
-			} else {
-				t.Fatalf("err: %v", err)
-			}
+	// The newest stream is accepted first
+	for _, expect := range []uint32{streams[2].StreamID(), streams[1].StreamID()} {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
 		}
-	}()
-
-	wg.Wait()
+		defer stream.Close()
+		if id := stream.StreamID(); id != expect {
+			t.Fatalf("bad: %d, expected %d", id, expect)
+		}
+	}
+	if n := server.NumStreams(); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
 }
 
-func TestSession_PingOfDeath(t *testing.T) {
-	client, server := testClientServerConfig(testConfNoKeepAlive())
+func TestSession_OpenRetries(t *testing.T) {
+	serverConf := testConf()
+	serverConf.AcceptBacklog = 1
+	conf := testConf()
+	conf.OpenRetries = 2
+	conf.OpenRetryBackoff = 20 * time.Millisecond
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, conf)
+	server, _ := Server(conn2, serverConf)
 	defer client.Close()
 	defer server.Close()
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	var doPingOfDeath sync.Mutex
-	doPingOfDeath.Lock()
+	logs := captureLogs(client)
+	_ = captureLogs(server)
 
-	// This is used later to block outbound writes.
-	conn := server.conn.(*pipeConn)
+	// Fill the backlog without waiting for the stream to be accepted
+	if _, err := client.OpenStreamWithData(context.Background(), []byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
 
-	// The server will accept a stream, block outbound writes, and then
-	// flood its send channel so that no more headers can be queued.
+	// The open is retried until there is room
+	errCh := make(chan error, 1)
 	go func() {
-		defer wg.Done()
-
+		stream, err := client.OpenStream()
+		if err == nil {
+			stream.Close()
+		}
+		errCh <- err
+	}()
+	time.Sleep(30 * time.Millisecond)
+	for i := 0; i < 2; i++ {
 		stream, err := server.AcceptStream()
 		if err != nil {
 			t.Fatalf("err: %v", err)
 		}
 		defer stream.Close()
-
-		conn.writeBlocker.Lock()
-		for {
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(logs.String(), "stream rejected, retry 1 of 2") {
+		t.Fatalf("bad: %s", logs.String())
+	}
+
+	// Until the retries are used up
+	if _, err := client.OpenStreamWithData(context.Background(), []byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.OpenStream(); err != ErrStreamRejected {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_OpenRetries_GoAway(t *testing.T) {
+	serverConf := testConf()
+	serverConf.AcceptBacklog = 1
+	serverConf.AcceptOverflowPolicy = AcceptOverflowGoAway
+	conf := testConf()
+	conf.OpenRetries = 2
+	conf.OpenRetryBackoff = 20 * time.Millisecond
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, conf)
+	server, _ := Server(conn2, serverConf)
+	defer client.Close()
+	defer server.Close()
+
+	_ = captureLogs(client)
+	_ = captureLogs(server)
+
+	if _, err := client.OpenStreamWithData(context.Background(), []byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.OpenStream(); err != ErrRemoteGoAway {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_OpenRetries_Refusals(t *testing.T) {
+	serverConf := testConf()
+	serverConf.LoadMaxStreams = 1
+	serverConf.RequireStreamApproval = true
+	serverConf.ApprovalTimeout = 20 * time.Millisecond
+	conf := testConf()
+	conf.OpenRetries = 5
+	conf.OpenRetryBackoff = 20 * time.Millisecond
+	conf.ConnectionWriteTimeout = 100 * time.Millisecond
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, conf)
+	server, _ := Server(conn2, serverConf)
+	defer client.Close()
+	defer server.Close()
+
+	logs := captureLogs(client)
+	_ = captureLogs(server)
+
+	// A stream that is never accepted gives up after the timeout
+	start := time.Now()
+	if _, err := client.OpenStream(); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("took %v", d)
+	}
+	waitNoStreams := func() {
+		deadline := time.Now().Add(time.Second)
+		for server.NumStreams() > 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitNoStreams()
+
+	// A stream reset without a refusal code is not retried
+	var approve int32
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			if atomic.LoadInt32(&approve) == 1 {
+				stream.Approve()
+				go func() {
+					io.Copy(ioutil.Discard, stream)
+					stream.Close()
+				}()
+			}
+		}
+	}()
+	if _, err := client.OpenStream(); err != ErrStreamRejected {
+		t.Fatalf("err: %v", err)
+	}
+	if strings.Contains(logs.String(), "retry") {
+		t.Fatalf("bad: %s", logs.String())
+	}
+	waitNoStreams()
+
+	// A stream refused because of the load is retried
+	atomic.StoreInt32(&approve, 1)
+	stream, err := client.OpenStreamWithData(context.Background(), []byte("x"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		stream, err := client.OpenStream()
+		if err == nil {
+			stream.Close()
+		}
+		errCh <- err
+	}()
+	time.Sleep(30 * time.Millisecond)
+	stream.Close()
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(logs.String(), "stream rejected, retry 1 of 5") {
+		t.Fatalf("bad: %s", logs.String())
+	}
+}
+
+func TestSession_MaxPendingOutboundSYNs(t *testing.T) {
+	conf := testConf()
+	conf.MaxPendingOutboundSYNs = 2
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, conf)
+	server, _ := Server(conn2, testConf())
+	defer client.Close()
+	defer server.Close()
+
+	for i := 0; i < conf.MaxPendingOutboundSYNs; i++ {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+	}
+
+	// Further opens wait for the peer to accept
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.OpenStreamContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.OpenStreamWithData(ctx, nil); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream2, err := client.OpenStreamContext(ctx)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	conf.MaxPendingOutboundSYNs = -1
+	if err := VerifyConfig(conf); err == nil {
+		t.Fatalf("should reject a negative limit")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	time.Sleep(200 * time.Millisecond)
+
+	// Ping value should increase
+	client.pingLock.Lock()
+	defer client.pingLock.Unlock()
+	if client.pingID == 0 {
+		t.Fatalf("should ping")
+	}
+
+	server.pingLock.Lock()
+	defer server.pingLock.Unlock()
+	if server.pingID == 0 {
+		t.Fatalf("should ping")
+	}
+}
+
+func TestSendKeepAlive(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.ActiveLivenessCheck = true
+	client, server := testClientServerConfig(conf)
+	defer server.Close()
+
+	rtt, err := client.SendKeepAlive()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rtt == 0 {
+		t.Fatalf("bad: %v", rtt)
+	}
+	client.pingLock.Lock()
+	if n := client.pingID; n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	client.pingLock.Unlock()
+
+	client.Close()
+	if _, err := client.SendKeepAlive(); err != ErrSessionShutdown {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_MaxOutstandingPings(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.ConnectionWriteTimeout = 50 * time.Millisecond
+	conf.MaxOutstandingPings = 2
+
+	// Concurrent pings answered by the peer never trip the limit
+	client, server := testClientServerConfig(conf)
+	errCh := make(chan error, 10)
+	for i := 0; i < cap(errCh); i++ {
+		go func() {
+			_, err := client.Ping()
+			errCh <- err
+		}()
+	}
+	for i := 0; i < cap(errCh); i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if client.IsClosed() {
+		t.Fatalf("should not be closed")
+	}
+	client.Close()
+	server.Close()
+
+	// A peer that never answers is given up on after the limit
+	conn1, conn2 := testConn()
+	go io.Copy(ioutil.Discard, conn2)
+	client, _ = Client(conn1, conf)
+	defer client.Close()
+	for i := 0; i < conf.MaxOutstandingPings; i++ {
+		go func() {
+			_, err := client.Ping()
+			errCh <- err
+		}()
+	}
+	deadline := time.Now().Add(time.Second)
+	for client.Stats().OutstandingPings != conf.MaxOutstandingPings {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %d", client.Stats().OutstandingPings)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < conf.MaxOutstandingPings; i++ {
+		if err := <-errCh; err != ErrTimeout {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	stats := client.Stats()
+	if stats.OutstandingPings != 0 || stats.UnansweredPings != conf.MaxOutstandingPings {
+		t.Fatalf("bad: %+v", stats)
+	}
+	if client.IsClosed() {
+		t.Fatalf("should not be closed")
+	}
+
+	if _, err := client.Ping(); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-client.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatalf("should be closed")
+	}
+	if _, err := client.AcceptStream(); err != ErrPingsUnanswered {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKeepAlive_Heartbeat(t *testing.T) {
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, testConf())
+	defer client.Close()
+	server, _ := Server(conn2, testConfNoKeepAlive())
+	defer server.Close()
+
+	for i := 0; i < 15; i++ {
+		client.Heartbeat()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	client.pingLock.Lock()
+	pings := client.pingID
+	client.pingLock.Unlock()
+	if pings != 0 {
+		t.Fatalf("should not ping: %d", pings)
+	}
+
+	// Once idle, the keepalive resumes
+	time.Sleep(250 * time.Millisecond)
+	client.pingLock.Lock()
+	pings = client.pingID
+	client.pingLock.Unlock()
+	if pings == 0 {
+		t.Fatalf("should ping")
+	}
+}
+
+func TestKeepAlive_Timeout(t *testing.T) {
+	conn1, conn2 := testConn()
+
+	clientConf := testConf()
+	clientConf.ConnectionWriteTimeout = time.Hour // We're testing keep alives, not connection writes
+	clientConf.EnableKeepAlive = false            // Just test one direction, so it's deterministic who hangs up on whom
+	client, _ := Client(conn1, clientConf)
+	defer client.Close()
+
+	server, _ := Server(conn2, testConf())
+	defer server.Close()
+
+	_ = captureLogs(client) // Client logs aren't part of the test
+	serverLogs := captureLogs(server)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := server.Accept() // Wait until server closes
+		errCh <- err
+	}()
+
+	// Prevent the client from responding
+	clientConn := client.conn.(*pipeConn)
+	clientConn.writeBlocker.Lock()
+
+	select {
+	case err := <-errCh:
+		if err != ErrKeepAliveTimeout {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timeout waiting for timeout")
+	}
+
+	if !server.IsClosed() {
+		t.Fatalf("server should have closed")
+	}
+
+	if !serverLogs.match([]string{"[ERR] yamux: keepalive failed: i/o deadline reached"}) {
+		t.Fatalf("server log incorect: %v", serverLogs.logs())
+	}
+}
+
+func TestKeepAlive_Retries(t *testing.T) {
+	for _, recover := range []bool{true, false} {
+		conn1, conn2 := testConn()
+
+		clientConf := testConf()
+		clientConf.ConnectionWriteTimeout = time.Hour
+		clientConf.EnableKeepAlive = false
+		client, _ := Client(conn1, clientConf)
+
+		serverConf := testConf()
+		serverConf.KeepAliveRetries = 2
+		serverConf.KeepAliveBackoff = 20 * time.Millisecond
+		server, _ := Server(conn2, serverConf)
+
+		_ = captureLogs(client)
+		serverLogs := captureLogs(server)
+
+		// The first ping fails after 350ms, and the retries after
+		// another 270ms and 290ms
+		clientConn := client.conn.(*pipeConn)
+		clientConn.writeBlocker.Lock()
+		if recover {
+			time.Sleep(450 * time.Millisecond)
+			clientConn.writeBlocker.Unlock()
+		}
+
+		select {
+		case <-server.CloseChan():
+			if recover {
+				t.Fatalf("should not close")
+			}
+		case <-time.After(1500 * time.Millisecond):
+			if !recover {
+				t.Fatalf("should close")
+			}
+		}
+		if !recover {
+			clientConn.writeBlocker.Unlock()
+		}
+		client.Close()
+		server.Close()
+
+		logs := serverLogs.logs()
+		if !strings.HasPrefix(logs[0], "[WARN] yamux: keepalive failed, retry 1 of 2") {
+			t.Fatalf("bad: %v", logs)
+		}
+		if !recover && !strings.HasPrefix(logs[2], "[ERR] yamux: keepalive failed") {
+			t.Fatalf("bad: %v", logs)
+		}
+	}
+}
+
+func TestKeepAlive_DefaultBackoff(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.KeepAliveRetries = 2
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	// Retries don't spin without a backoff
+	if backoff := client.keepAliveBackoff(); backoff != conf.KeepAliveInterval/10 {
+		t.Fatalf("bad: %v", backoff)
+	}
+	client.config.KeepAliveBackoff = time.Second
+	if backoff := client.keepAliveBackoff(); backoff != time.Second {
+		t.Fatalf("bad: %v", backoff)
+	}
+}
+
+func TestKeepAlive_MaxRTT(t *testing.T) {
+	conn1, conn2 := testConn()
+
+	clientConf := testConf()
+	clientConf.MaxRTT = time.Nanosecond
+	clientConf.MaxRTTViolations = 2
+	client, _ := Client(conn1, clientConf)
+	defer client.Close()
+
+	server, _ := Server(conn2, testConfNoKeepAlive())
+	defer server.Close()
+
+	clientLogs := captureLogs(client)
+	_ = captureLogs(server)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.Accept() // Wait until client closes
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != ErrRTTExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for rtt violation")
+	}
+
+	if !strings.HasPrefix(clientLogs.String(), "[ERR] yamux: keepalive rtt") {
+		t.Fatalf("client log incorect: %v", clientLogs.logs())
+	}
+}
+
+func TestLargeWindow(t *testing.T) {
+	conf := DefaultConfig()
+	conf.MaxStreamWindowSize *= 2
+
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	stream2, err := server.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	stream.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	buf := make([]byte, conf.MaxStreamWindowSize)
+	n, err := stream.Write(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != len(buf) {
+		t.Fatalf("short write: %d", n)
+	}
+}
+
+type UnlimitedReader struct{}
+
+func (u *UnlimitedReader) Read(p []byte) (int, error) {
+	runtime.Gosched()
+	return len(p), nil
+}
+
+func TestSendData_VeryLarge(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	var n int64 = 1 * 1024 * 1024 * 1024
+	var workers int = 16
+
+	wg := &sync.WaitGroup{}
+	wg.Add(workers * 2)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			stream, err := server.AcceptStream()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer stream.Close()
+
+			buf := make([]byte, 4)
+			_, err = stream.Read(buf)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !bytes.Equal(buf, []byte{0, 1, 2, 3}) {
+				t.Fatalf("bad header")
+			}
+
+			recv, err := io.Copy(ioutil.Discard, stream)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if recv != n {
+				t.Fatalf("bad: %v", recv)
+			}
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			stream, err := client.Open()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer stream.Close()
+
+			_, err = stream.Write([]byte{0, 1, 2, 3})
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			unlimited := &UnlimitedReader{}
+			sent, err := io.Copy(stream, io.LimitReader(unlimited, n))
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if sent != n {
+				t.Fatalf("bad: %v", sent)
+			}
+		}()
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(20 * time.Second):
+		panic("timeout")
+	}
+}
+
+func TestBacklogExceeded_Accept(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	max := 5 * client.config.AcceptBacklog
+	go func() {
+		for i := 0; i < max; i++ {
+			stream, err := server.Accept()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer stream.Close()
+		}
+	}()
+
+	// Fill the backlog
+	for i := 0; i < max; i++ {
+		stream, err := client.Open()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+
+		if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestSession_WindowUpdateWriteDuringRead(t *testing.T) {
+	client, server := testClientServerConfig(testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Choose a huge flood size that we know will result in a window update.
+	flood := int64(client.config.MaxStreamWindowSize) - 1
+
+	// The server will accept a new stream and then flood data to it.
+	go func() {
+		defer wg.Done()
+
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+
+		n, err := stream.Write(make([]byte, flood))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if int64(n) != flood {
+			t.Fatalf("short write: %d", n)
+		}
+	}()
+
+	// The client will open a stream, block outbound writes, and then
+	// listen to the flood from the server, which should time out since
+	// it won't be able to send the window update.
+	go func() {
+		defer wg.Done()
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+
+		conn := client.conn.(*pipeConn)
+		conn.writeBlocker.Lock()
+
+		// The flood may arrive in several frames
+		buf := make([]byte, flood)
+		for err == nil {
+			_, err = stream.Read(buf)
+		}
+		if err != ErrConnectionWriteTimeout {
+			t.Fatalf("err: %v", err)
+		}
+	}()
+
+	wg.Wait()
+}
+
+func TestSession_PartialReadWindowUpdate(t *testing.T) {
+	client, server := testClientServerConfig(testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	// Choose a huge flood size that we know will result in a window update.
+	flood := int64(client.config.MaxStreamWindowSize)
+	var wr *Stream
+
+	// The server will accept a new stream and then flood data to it.
+	go func() {
+		defer wg.Done()
+
+		var err error
+		wr, err = server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer wr.Close()
+
+		if wr.sendWindow != client.config.MaxStreamWindowSize {
+			t.Fatalf("sendWindow: exp=%d, got=%d", client.config.MaxStreamWindowSize, wr.sendWindow)
+		}
+
+		n, err := wr.Write(make([]byte, flood))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if int64(n) != flood {
+			t.Fatalf("short write: %d", n)
+		}
+		if wr.sendWindow != 0 {
+			t.Fatalf("sendWindow: exp=%d, got=%d", 0, wr.sendWindow)
+		}
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	wg.Wait()
+
+	_, err = stream.Read(make([]byte, flood/2+1))
+
+	if exp := uint32(flood/2 + 1); wr.sendWindow != exp {
+		t.Errorf("sendWindow: exp=%d, got=%d", exp, wr.sendWindow)
+	}
+}
+
+func TestSession_sendNoWait_Timeout(t *testing.T) {
+	client, server := testClientServerConfig(testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+	}()
+
+	// The client will open the stream and then block outbound writes, we'll
+	// probe sendNoWait once it gets into that state.
+	go func() {
+		defer wg.Done()
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+
+		conn := client.conn.(*pipeConn)
+		conn.writeBlocker.Lock()
+
+		hdr := header(make([]byte, headerSize))
+		hdr.encode(typePing, flagACK, 0, 0)
+		for {
+			err = client.sendNoWait(hdr)
+			if err == nil {
+				continue
+			} else if err == ErrConnectionWriteTimeout {
+				break
+			} else {
+				t.Fatalf("err: %v", err)
+			}
+		}
+	}()
+
+	wg.Wait()
+}
+
+func TestSession_PingOfDeath(t *testing.T) {
+	client, server := testClientServerConfig(testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	var doPingOfDeath sync.Mutex
+	doPingOfDeath.Lock()
+
+	// This is used later to block outbound writes.
+	conn := server.conn.(*pipeConn)
+
+	// The server will accept a stream, block outbound writes, and then
+	// flood its send channel so that no more headers can be queued.
+	go func() {
+		defer wg.Done()
+
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+
+		conn.writeBlocker.Lock()
+		for {
+			hdr := header(make([]byte, headerSize))
+			hdr.encode(typePing, 0, 0, 0)
+			err = server.sendNoWait(hdr)
+			if err == nil {
+				continue
+			} else if err == ErrConnectionWriteTimeout {
+				break
+			} else {
+				t.Fatalf("err: %v", err)
+			}
+		}
+
+		doPingOfDeath.Unlock()
+	}()
+
+	// The client will open a stream and then send the server a ping once it
+	// can no longer write. This makes sure the server doesn't deadlock reads
+	// while trying to reply to the ping with no ability to write.
+	go func() {
+		defer wg.Done()
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+
+		// This ping will never unblock because the ping id will never
+		// show up in a response.
+		doPingOfDeath.Lock()
+		go func() { client.Ping() }()
+
+		// Wait for a while to make sure the previous ping times out,
+		// then turn writes back on and make sure a ping works again.
+		time.Sleep(2 * server.config.ConnectionWriteTimeout)
+		conn.writeBlocker.Unlock()
+		if _, err = client.Ping(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}()
+
+	wg.Wait()
+}
+
+func TestSession_ConnectionWriteTimeout(t *testing.T) {
+	client, server := testClientServerConfig(testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+	}()
+
+	// The client will open the stream and then block outbound writes, we'll
+	// tee up a write and make sure it eventually times out.
+	go func() {
+		defer wg.Done()
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+
+		conn := client.conn.(*pipeConn)
+		conn.writeBlocker.Lock()
+
+		// Since the write goroutine is blocked then this will return a
+		// timeout since it can't get feedback about whether the write
+		// worked.
+		n, err := stream.Write([]byte("hello"))
+		if err != ErrConnectionWriteTimeout {
+			t.Fatalf("err: %v", err)
+		}
+		if n != 0 {
+			t.Fatalf("lied about writes: %d", n)
+		}
+	}()
+
+	wg.Wait()
+}
+
+func TestSession_Reorder(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.ReorderWindow = 4
+
+	conn1, conn2 := testConn()
+	server, _ := Server(conn2, conf)
+	defer server.Close()
+
+	// Act as a raw peer that reorders its frames
+	go io.Copy(ioutil.Discard, conn1)
+
+	frame := func(msgType uint8, flags uint16, id uint32, seq uint32, body string) []byte {
+		hdr := header(make([]byte, headerSize))
+		length := uint32(len(body))
+		if msgType == typeWindowUpdate {
+			length = 0
+		}
+		hdr.encode(msgType, flags|flagSEQ, id, length)
+		buf := append([]byte(hdr), 0, 0, 0, 0)
+		buf[headerSize+3] = byte(seq)
+		return append(buf, body...)
+	}
+
+	ext := extensionsHeader(extReorder)
+	if _, err := conn1.Write(ext); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	frames := [][]byte{
+		frame(typeData, 0, 1, 2, "world"),
+		frame(typeWindowUpdate, flagSYN, 1, 0, ""),
+		frame(typeData, 0, 1, 1, "hello "),
+	}
+	for _, f := range frames {
+		if _, err := conn1.Write(f); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf) != "hello world" {
+		t.Fatalf("bad: %s", buf)
+	}
+	if !server.hasExtension(extReorder) {
+		t.Fatalf("reorder extension should be negotiated")
+	}
+}
+
+func TestSession_ReorderNegotiation(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.ReorderWindow = 4
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(stream2, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !client.hasExtension(extReorder) || !server.hasExtension(extReorder) {
+		t.Fatalf("reorder extension should be negotiated")
+	}
+}
+
+func TestSession_Trace(t *testing.T) {
+	var lock sync.Mutex
+	seen := make(map[TraceEventKind]int)
+
+	conf := testConfNoKeepAlive()
+	conf.MaxStreamWindowSize *= 2
+	clientConf := testConfNoKeepAlive()
+	clientConf.MaxStreamWindowSize *= 2
+	clientConf.TraceFunc = func(ev TraceEvent) {
+		lock.Lock()
+		seen[ev.Kind]++
+		lock.Unlock()
+	}
+
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, clientConf)
+	defer client.Close()
+	server, _ := Server(conn2, conf)
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream.Close()
+	stream2.Close()
+
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.GoAway(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expect := []TraceEventKind{
+		TraceStreamOpen, TraceStreamClose, TraceSYNSent, TraceACKReceived,
+		TraceFINSent, TraceFINReceived, TraceWindowUpdateSent,
+		TraceWindowUpdateReceived, TracePingSent, TracePongReceived,
+		TraceGoAwaySent,
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	for _, kind := range expect {
+		if seen[kind] == 0 {
+			t.Fatalf("missing trace event %v: %v", kind, seen)
+		}
+	}
+}
+
+func TestSession_ZeroLengthData(t *testing.T) {
+	conn1, conn2 := testConn()
+	server, _ := Server(conn2, testConfNoKeepAlive())
+	defer server.Close()
+
+	go io.Copy(ioutil.Discard, conn1)
+
+	frame := func(flags uint16, body string) []byte {
+		hdr := header(make([]byte, headerSize))
+		hdr.encode(typeData, flags, 1, uint32(len(body)))
+		return append([]byte(hdr), body...)
+	}
+	go func() {
+		conn1.Write(frame(flagSYN, ""))
+		conn1.Write(frame(0, ""))
+		conn1.Write(frame(0, "abc"))
+		conn1.Write(frame(0, ""))
+		conn1.Write(frame(flagFIN, ""))
+	}()
+
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+
+	var got []byte
+	buf := make([]byte, 8)
+	for {
+		n, err := stream.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if n == 0 {
+			t.Fatalf("empty read without error")
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "abc" {
+		t.Fatalf("bad: %s", got)
+	}
+}
+
+func TestSession_StreamHeader(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStreamWithHeader([]byte("route-a"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte("data")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	if string(stream2.Header()) != "route-a" {
+		t.Fatalf("bad: %s", stream2.Header())
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(stream2, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf) != "data" {
+		t.Fatalf("bad: %s", buf)
+	}
+	if stream.Header() != nil {
+		t.Fatalf("opener should not have a header")
+	}
+
+	if _, err := client.OpenStreamWithHeader(make([]byte, defaultStreamHeaderSize+1)); err != ErrStreamHeaderTooLarge {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_AcceptStreamWithHeader(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStreamWithHeader([]byte("route-a"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream2, meta, err := server.AcceptStreamWithHeader()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	if string(meta) != "route-a" {
+		t.Fatalf("bad: %s", meta)
+	}
+
+	// Streams without a header have no metadata
+	stream, err = client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream2, meta, err = server.AcceptStreamWithHeader()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	if meta != nil {
+		t.Fatalf("bad: %v", meta)
+	}
+
+	server.Close()
+	if _, _, err := server.AcceptStreamWithHeader(); err != ErrSessionShutdown {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_AcceptStreamMatching(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	// A waiter is not woken up for streams it doesn't match
+	type result struct {
+		stream *Stream
+		err    error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		stream, err := server.AcceptStreamMatching(func(id uint32) bool { return id >= 5 })
+		resultCh <- result{stream, err}
+	}()
+	for i := 0; i < 3; i++ {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+	}
+
+	for _, want := range []uint32{1, 3} {
+		stream, err := server.AcceptStreamMatching(func(id uint32) bool { return id < 5 })
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if stream.StreamID() != want {
+			t.Fatalf("bad: %d", stream.StreamID())
+		}
+	}
+	select {
+	case r := <-resultCh:
+		if r.err != nil {
+			t.Fatalf("err: %v", r.err)
+		}
+		if r.stream.StreamID() != 5 {
+			t.Fatalf("bad: %d", r.stream.StreamID())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+
+	server.Close()
+	if _, err := server.AcceptStreamMatching(func(uint32) bool { return true }); err != ErrSessionShutdown {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_StreamHeader_TooLarge(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	_ = captureLogs(server)
+
+	// Bypass the local check to make the server reject it
+	stream, err := client.openStream(make([]byte, defaultStreamHeaderSize+1))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for stream.State() != StreamReset {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream should be reset: %v", stream.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := server.NumStreams(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestSession_OpenStreamWithData(t *testing.T) {
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, testConfNoKeepAlive())
+	defer client.Close()
+
+	// The data goes out with the SYN
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.OpenStreamWithData(context.Background(), []byte("request"))
+		errCh <- err
+	}()
+	hdr := header(make([]byte, headerSize))
+	if _, err := io.ReadFull(conn2, hdr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if hdr.MsgType() != typeData || hdr.Flags() != flagSYN || hdr.Length() != 7 {
+		t.Fatalf("bad: %v", hdr)
+	}
+	body := make([]byte, hdr.Length())
+	if _, err := io.ReadFull(conn2, body); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(body) != "request" {
+		t.Fatalf("bad: %q", body)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Without window updates the rest of a large payload is stuck
+	go io.Copy(ioutil.Discard, conn2)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stream, err := client.OpenStreamWithData(ctx, make([]byte, initialStreamWindow+1))
+	if err != context.DeadlineExceeded || stream != nil {
+		t.Fatalf("bad: %v %v", stream, err)
+	}
+}
+
+func TestSession_OpenStreamWithData_Large(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	data := make([]byte, 2*initialStreamWindow+10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer stream.Close()
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(stream, got); err != nil {
+			errCh <- err
+			return
+		}
+		if !bytes.Equal(got, data) {
+			errCh <- fmt.Errorf("bad data")
+			return
+		}
+		errCh <- nil
+	}()
+
+	stream, err := client.OpenStreamWithData(context.Background(), data)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_StreamHeader_Limit(t *testing.T) {
+	conf := testConf()
+	conf.MaxStreamHeaderSize = 8
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	if _, err := client.OpenStreamWithHeader([]byte("012345678")); err != ErrStreamHeaderTooLarge {
+		t.Fatalf("err: %v", err)
+	}
+
+	stream, err := client.OpenStreamWithHeader([]byte("01234567"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	if string(stream2.Header()) != "01234567" {
+		t.Fatalf("bad: %s", stream2.Header())
+	}
+
+	conf.MaxStreamHeaderSize = initialStreamWindow + 1
+	if err := VerifyConfig(conf); err == nil {
+		t.Fatalf("should reject a header limit above the window")
+	}
+
+	// Zero uses the default limit
+	conf.MaxStreamHeaderSize = 0
+	client2, server2 := testClientServerConfig(conf)
+	defer client2.Close()
+	defer server2.Close()
+	if _, err := client2.OpenStreamWithHeader(make([]byte, defaultStreamHeaderSize+1)); err != ErrStreamHeaderTooLarge {
+		t.Fatalf("err: %v", err)
+	}
+	stream3, err := client2.OpenStreamWithHeader(make([]byte, defaultStreamHeaderSize))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream3.Close()
+	stream4, err := server2.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream4.Close()
+	if len(stream4.Header()) != int(defaultStreamHeaderSize) {
+		t.Fatalf("bad: %d", len(stream4.Header()))
+	}
+}
+
+type failingWriter struct {
+	io.ReadWriteCloser
+	err error
+}
+
+func (f *failingWriter) Write(b []byte) (int, error) {
+	return 0, f.err
+}
+
+func TestSession_SendError(t *testing.T) {
+	conn1, conn2 := testConn()
+	writeErr := fmt.Errorf("broken pipe")
+	client, _ := Client(&failingWriter{ReadWriteCloser: conn1, err: writeErr}, testConfNoKeepAlive())
+	defer client.Close()
+	server, _ := Server(conn2, testConfNoKeepAlive())
+	defer server.Close()
+
+	_ = captureLogs(client)
+	if err := client.SendError(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.Ping(); err != writeErr {
+		t.Fatalf("err: %v", err)
+	}
+
+	<-client.CloseChan()
+	if err := client.SendError(); err != writeErr {
+		t.Fatalf("err: %v", err)
+	}
+	if err := server.SendError(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_RecvError(t *testing.T) {
+	client, server := testClientServer()
+	defer server.Close()
+	if err := client.RecvError(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Closing the session is not an error of the recv loop, but the
+	// peer sees the connection go away
+	client.Close()
+	<-server.CloseChan()
+	if err := client.RecvError(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := server.RecvError(); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Protocol errors are reported as is
+	conn1, conn2 := testConn()
+	server2, _ := Server(conn2, testConfNoKeepAlive())
+	defer server2.Close()
+	_ = captureLogs(server2)
+	go io.Copy(ioutil.Discard, conn1)
+	conn1.Write([]byte{protoVersion + 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	<-server2.CloseChan()
+	if err := server2.RecvError(); err != ErrInvalidVersion {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_ReadAheadFactor(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.ReadAheadFactor = 0.125
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	// Consuming just over an eighth of the window returns the credit
+	chunk := int(conf.MaxStreamWindowSize/8) + 1
+	if _, err := stream.Write(make([]byte, chunk)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(stream2, make([]byte, chunk)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint32(&stream.sendWindow) != conf.MaxStreamWindowSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("window not restored: %d", atomic.LoadUint32(&stream.sendWindow))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSession_StreamIDExhausted(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.GoAwayOnStreamIDExhaustion = true
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	_ = captureLogs(client)
+
+	// Skip ahead to the last usable client ID
+	atomic.StoreUint32(&client.nextStreamID, math.MaxUint32-2)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	if id := stream.StreamID(); id != math.MaxUint32-2 {
+		t.Fatalf("bad: %d", id)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := client.OpenStream()
+		if !errors.Is(err, ErrStreamIDExhausted) || !errors.Is(err, ErrStreamsExhausted) {
+			t.Fatalf("err: %v", err)
+		}
+		serr, ok := err.(*StreamsExhaustedError)
+		if !ok || serr.Streams != 1 || serr.Max != math.MaxUint32/2 {
+			t.Fatalf("bad: %#v", err)
+		}
+	}
+	if id := atomic.LoadUint32(&client.nextStreamID); id != math.MaxUint32 {
+		t.Fatalf("id should not wrap: %d", id)
+	}
+
+	// The failed opens must not leak SYN credit
+	if n := len(client.synCh); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := server.OpenStream(); err == ErrRemoteGoAway {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server should see a go away")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSession_ActiveLivenessCheck(t *testing.T) {
+	conf := testConf()
+	conf.ActiveLivenessCheck = true
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	if err := client.checkLiveness(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Let a few keepalive rounds run the check
+	time.Sleep(350 * time.Millisecond)
+	if client.IsClosed() || server.IsClosed() {
+		t.Fatalf("sessions should be alive")
+	}
+
+	// Liveness streams are never handed to the application
+	acceptCh := make(chan error, 1)
+	go func() {
+		_, err := server.AcceptStream()
+		acceptCh <- err
+	}()
+	select {
+	case err := <-acceptCh:
+		t.Fatalf("unexpected accept: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSession_ActiveLivenessCheck_Limit(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.LogOutput = ioutil.Discard
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	// Liveness streams that never send their nonce are answered up to
+	// the limit, the rest is reset
+	for i := 0; i <= maxLivenessEchoes; i++ {
+		stream, err := client.OpenStreamWithHeader(livenessHeader)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err = stream.WaitEstablished(ctx)
+		cancel()
+		if i < maxLivenessEchoes && err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if i == maxLivenessEchoes && err != ErrStreamRejected {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&server.livenessEchoes); n != maxLivenessEchoes {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestSession_ActiveLivenessCheck_Wedged(t *testing.T) {
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, testConfNoKeepAlive())
+	defer client.Close()
+
+	// The peer drains the connection but never answers
+	go io.Copy(ioutil.Discard, conn2)
+
+	if err := client.checkLiveness(); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_StaleWindowUpdate(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		conf := testConfNoKeepAlive()
+		conf.StrictProtocol = strict
+
+		conn1, conn2 := testConn()
+		server, _ := Server(conn2, conf)
+		defer server.Close()
+		_ = captureLogs(server)
+
+		go io.Copy(ioutil.Discard, conn1)
+
+		send := func(flags uint16, id uint32) {
+			hdr := header(make([]byte, headerSize))
+			hdr.encode(typeWindowUpdate, flags, id, 0)
+			if _, err := conn1.Write(hdr); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+
+		// Open a stream and reset it
+		send(flagSYN, 1)
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		send(flagRST, 1)
+		<-stream.doneCh
+
+		// An update for the closed stream is discarded either way
+		send(0, 1)
+		send(0, 1)
+		deadline := time.Now().Add(time.Second)
+		for server.Stats().StaleWindowUpdates != 2 {
+			if time.Now().After(deadline) {
+				t.Fatalf("bad: %d", server.Stats().StaleWindowUpdates)
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		// One for a stream that was never opened is only fatal when
+		// strict
+		send(0, 3)
+		select {
+		case <-server.CloseChan():
+			if !strict {
+				t.Fatalf("session should not be closed")
+			}
+			if _, err := server.AcceptStream(); err != ErrUnknownStream {
+				t.Fatalf("err: %v", err)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if strict {
+				t.Fatalf("session should be closed")
+			}
+			if n := server.Stats().StaleWindowUpdates; n != 3 {
+				t.Fatalf("bad: %d", n)
+			}
+		}
+	}
+}
+
+func TestSession_HeaderReadTimeout(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.HeaderReadTimeout = 50 * time.Millisecond
+
+	conn1, conn2 := testConn()
+	server, _ := Server(conn2, conf)
+	defer server.Close()
+	_ = captureLogs(server)
+
+	go io.Copy(ioutil.Discard, conn1)
+
+	// A whole frame followed by half a header that never completes
+	hdr := header(make([]byte, headerSize))
+	hdr.encode(typeWindowUpdate, flagSYN, 1, 0)
+	if _, err := conn1.Write(hdr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	// Idle time between frames is fine
+	time.Sleep(2 * conf.HeaderReadTimeout)
+	if server.IsClosed() {
+		t.Fatalf("idle session should not be closed")
+	}
+
+	if _, err := conn1.Write(hdr[:6]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case <-server.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatalf("session should be closed")
+	}
+	if _, err := server.AcceptStream(); err != ErrFrameReadTimeout {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_Watchdog(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.Watchdog = 50 * time.Millisecond
+
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, conf)
+	server, _ := Server(conn2, testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+	logs := captureLogs(client)
+
+	// An idle session is fine
+	time.Sleep(2 * conf.Watchdog)
+	if client.IsClosed() {
+		t.Fatalf("idle session should not be closed")
+	}
+
+	// Wedge the send loop on a write
+	pipe := conn1.(*pipeConn)
+	pipe.writeBlocker.Lock()
+	defer pipe.writeBlocker.Unlock()
+	go client.Ping()
+
+	select {
+	case <-client.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatalf("session should be closed")
+	}
+	if _, err := client.OpenStream(); err != ErrSessionShutdown {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.AcceptStream(); err != ErrSessionStalled {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(logs.String(), "send loop stalled") || !strings.Contains(logs.String(), "goroutine ") {
+		t.Fatalf("bad: %s", logs.String())
+	}
+}
+
+type countingConn struct {
+	io.ReadWriteCloser
+	written int64
+	writes  int64
+	largest int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	atomic.AddInt64(&c.writes, 1)
+	for {
+		largest := atomic.LoadInt64(&c.largest)
+		if int64(len(b)) <= largest || atomic.CompareAndSwapInt64(&c.largest, largest, int64(len(b))) {
+			break
+		}
+	}
+	return n, err
+}
+
+func TestSession_FrameCodec(t *testing.T) {
+	for _, serverCodec := range []bool{true, false} {
+		conf := testConfNoKeepAlive()
+		conf.FrameCodec = &FlateCodec{Level: flate.BestSpeed}
+		serverConf := testConfNoKeepAlive()
+		if serverCodec {
+			serverConf.FrameCodec = conf.FrameCodec
+		}
+
+		conn1, conn2 := testConn()
+		counter := &countingConn{ReadWriteCloser: conn1}
+		client, _ := Client(counter, conf)
+		server, _ := Server(conn2, serverConf)
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		data := bytes.Repeat([]byte("compressible "), 8*1024)
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := stream.Write(data)
+			stream.Close()
+			errCh <- err
+		}()
+
+		got, err := ioutil.ReadAll(stream2)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("bad data")
+		}
+
+		written := atomic.LoadInt64(&counter.written)
+		if serverCodec && written >= int64(len(data)) {
+			t.Fatalf("payload should be compressed: %d", written)
+		}
+		if !serverCodec && written < int64(len(data)) {
+			t.Fatalf("payload should not be compressed: %d", written)
+		}
+
+		stream2.Close()
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestStream_WritableChan(t *testing.T) {
+	client, server := testClientServerConfig(testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	// Writable right away with an open window
+	select {
+	case <-stream.WritableChan():
+	default:
+		t.Fatalf("should be writable")
+	}
+
+	// Exhaust the window
+	if _, err := stream.Write(make([]byte, initialStreamWindow)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-stream.WritableChan():
+		t.Fatalf("should not be writable")
+	default:
+	}
+
+	// Reading returns credit, which makes it writable again
+	if _, err := io.ReadFull(stream2, make([]byte, initialStreamWindow)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-stream.WritableChan():
+	case <-time.After(time.Second):
+		t.Fatalf("should be writable")
+	}
+}
+
+func TestSession_MaxSendBuffer(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.MaxStreamWindowSize = 2 * initialStreamWindow
+	conf.MaxSendBuffer = int64(initialStreamWindow)
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	// The peer advertises a larger window but doesn't read
+	stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := stream.Write(make([]byte, conf.MaxStreamWindowSize))
+	if err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+	if n != int(initialStreamWindow) {
+		t.Fatalf("bad: %d", n)
+	}
+	if used := client.SendBufferUsage(); used != int64(initialStreamWindow) {
+		t.Fatalf("bad: %d", used)
+	}
+
+	// Fail fast instead of blocking
+	client.config.FailFastOnSendBufferFull = true
+	stream.SetWriteDeadline(time.Time{})
+	if _, err := stream.Write([]byte("x")); err != ErrSendBufferFull {
+		t.Fatalf("err: %v", err)
+	}
+	client.config.FailFastOnSendBufferFull = false
+
+	// Reading returns credit, which releases the buffer
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := stream.Write([]byte("more"))
+		errCh <- err
+	}()
+	if _, err := io.ReadFull(stream2, make([]byte, n+4)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_Fairness(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.MaxStreamWindowSize = 16 * 1024 * 1024
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	// The first stream offers much more data per write
+	var received [2]int64
+	for i, size := range []int{8 * 1024 * 1024, 1024 * 1024} {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+		go func(size int) {
+			buf := make([]byte, size)
+			for {
+				if _, err := stream.Write(buf); err != nil {
+					return
+				}
+			}
+		}(size)
+
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream2.Close()
+		go func(n *int64) {
+			buf := make([]byte, 64*1024)
+			for {
+				read, err := stream2.Read(buf)
+				if err != nil {
+					return
+				}
+				atomic.AddInt64(n, int64(read))
+			}
+		}(&received[i])
+	}
+
+	// Skip the first window of each stream, which is not scheduled
+	// against the other stream yet
+	time.Sleep(50 * time.Millisecond)
+	a0, b0 := atomic.LoadInt64(&received[0]), atomic.LoadInt64(&received[1])
+	time.Sleep(200 * time.Millisecond)
+	a, b := atomic.LoadInt64(&received[0])-a0, atomic.LoadInt64(&received[1])-b0
+
+	// Scheduling of the writers adds noise, the share would be far off
+	// without the scheduler though
+	if a == 0 || b == 0 {
+		t.Fatalf("starved: %d %d", a, b)
+	}
+	if ratio := float64(b) / float64(a); ratio < 0.5 || ratio > 2 {
+		t.Fatalf("unfair share: %d %d", a, b)
+	}
+}
+
+func TestSession_AcceptDeadline(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	server.SetAcceptDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	if _, err := server.Accept(); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("returned too early")
+	}
+	if _, err := server.AcceptStream(); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Clearing the deadline blocks until a stream arrives
+	server.SetAcceptDeadline(time.Time{})
+	errCh := make(chan error, 1)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err == nil {
+			stream.Close()
+		}
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("should block: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// corruptingConn flips a bit in the next write of the armed size
+type corruptingConn struct {
+	io.ReadWriteCloser
+	size int32
+}
+
+func (c *corruptingConn) Write(b []byte) (int, error) {
+	if size := atomic.LoadInt32(&c.size); size != 0 && len(b) == int(size) &&
+		atomic.CompareAndSwapInt32(&c.size, size, 0) {
+		b = append([]byte(nil), b...)
+		b[0] ^= 1
+	}
+	return c.ReadWriteCloser.Write(b)
+}
+
+func TestSession_Checksum(t *testing.T) {
+	for _, policy := range []ChecksumMismatchPolicy{ChecksumMismatchClose, ChecksumMismatchReset} {
+		conf := testConfNoKeepAlive()
+		conf.EnableChecksum = true
+		conf.ChecksumMismatchPolicy = policy
+
+		conn1, conn2 := testConn()
+		corrupter := &corruptingConn{ReadWriteCloser: conn1}
+		client, _ := Client(corrupter, conf)
+		server, _ := Server(conn2, conf)
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Intact frames pass
+		data := bytes.Repeat([]byte("x"), 100)
+		if _, err := stream.Write(data); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		buf := make([]byte, 200)
+		if n, err := stream2.Read(buf); err != nil || n != len(data) {
+			t.Fatalf("err: %v %d", err, n)
+		}
+		if !client.hasExtension(extChecksum) || !server.hasExtension(extChecksum) {
+			t.Fatalf("checksum should be negotiated")
+		}
+
+		// Corrupt the next payload, the write may race with the
+		// session shutdown
+		atomic.StoreInt32(&corrupter.size, int32(len(data)))
+		if _, err := stream.Write(data); err != nil && policy == ChecksumMismatchReset {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := stream2.Read(buf); err == nil {
+			t.Fatalf("corrupted data should not be read")
+		}
+
+		switch policy {
+		case ChecksumMismatchClose:
+			<-server.CloseChan()
+			server.shutdownLock.Lock()
+			err := server.shutdownErr
+			server.shutdownLock.Unlock()
+			if err != ErrChecksumMismatch {
+				t.Fatalf("err: %v", err)
+			}
+
+		case ChecksumMismatchReset:
+			if server.IsClosed() {
+				t.Fatalf("session should stay open")
+			}
+			if _, err := stream2.Read(buf); err != ErrConnectionReset {
+				t.Fatalf("err: %v", err)
+			}
+
+			// Other streams keep working
+			other, err := client.OpenStream()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			other2, err := server.AcceptStream()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if _, err := other.Write(data); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if n, err := other2.Read(buf); err != nil || n != len(data) {
+				t.Fatalf("err: %v %d", err, n)
+			}
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestSession_ChecksumNegotiation(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.EnableChecksum = true
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, conf)
+	server, _ := Server(conn2, testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(stream2, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("bad: %q", buf)
+	}
+	if client.hasExtension(extChecksum) {
+		t.Fatalf("checksum should not be negotiated")
+	}
+}
+
+func TestSession_EffectiveConfig(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.EnableChecksum = true
+	conf.ReorderWindow = 8
+	serverConf := testConfNoKeepAlive()
+	serverConf.EnableChecksum = true
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, conf)
+	server, _ := Server(conn2, serverConf)
+	defer client.Close()
+	defer server.Close()
+
+	// The exchange makes sure both advertisements arrived
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	if err := stream.WaitEstablished(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	effective := client.EffectiveConfig()
+	if !effective.EnableChecksum {
+		t.Fatalf("checksum should be in force")
+	}
+	if effective.ReorderWindow != 0 {
+		t.Fatalf("reordering should not be in force: %d", effective.ReorderWindow)
+	}
+	if expect := conf.MaxStreamWindowSize + sizeOfChecksum; effective.MaxFrameSize != expect {
+		t.Fatalf("bad: %d, expected %d", effective.MaxFrameSize, expect)
+	}
+	if conf.ReorderWindow != 8 || client.config.ReorderWindow != 8 {
+		t.Fatalf("requested config should be unchanged")
+	}
+	if w := stream.SendWindow(); w != initialStreamWindow {
+		t.Fatalf("bad: %d", w)
+	}
+}
+
+func TestStream_ReadWriteTimeout(t *testing.T) {
+	client, server := testClientServerConfig(testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	buf := make([]byte, 4)
+	if _, err := stream2.ReadTimeout(buf, 10*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The deadline is cleared again
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := stream2.Read(buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// An earlier deadline still applies and is restored
+	deadline := time.Now().Add(10 * time.Millisecond)
+	stream2.SetReadDeadline(deadline)
+	start := time.Now()
+	if _, err := stream2.ReadTimeout(buf, time.Minute); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("should use the earlier deadline")
+	}
+	if d := stream2.readDeadline.get(); !d.Equal(deadline) {
+		t.Fatalf("bad: %v", d)
+	}
+	stream2.SetReadDeadline(time.Time{})
+
+	// Fill the window, so the next write blocks
+	if _, err := stream.WriteTimeout(make([]byte, initialStreamWindow-4), time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.WriteTimeout([]byte("x"), 10*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+	if d := stream.writeDeadline.get(); !d.IsZero() {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestSession_Drain(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Drain times out while the stream is open
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := server.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	if !server.GoAwaySent() || stream2.State() != StreamEstablished {
+		t.Fatalf("stream should be left alone")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Drain(context.Background())
+	}()
+
+	// New streams are rejected, the existing one keeps working
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.OpenStream(); err != ErrRemoteGoAway {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(stream2, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stream.Close()
+	select {
+	case err := <-errCh:
+		t.Fatalf("should wait for both sides: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	stream2.Close()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("drain should finish")
+	}
+	if server.IsClosed() {
+		t.Fatalf("session should stay open")
+	}
+}
+
+func TestSession_Drain_Concurrent(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Every waiter sees the streams close
+	const waiters = 4
+	errCh := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		go func(i int) {
+			if i%2 == 0 {
+				errCh <- server.Drain(context.Background())
+			} else {
+				errCh <- server.WaitGoAwayDrained(context.Background())
+			}
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	stream.Close()
+	stream2.Close()
+	for i := 0; i < waiters; i++ {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("drain should finish")
+		}
+	}
+}
+
+func TestStream_WriteDeadlineQueued(t *testing.T) {
+	client, server := testClientServerConfig(testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+
+	blocking, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer blocking.Close()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	// Stall the send loop on a write to a slow peer
+	conn := client.conn.(*pipeConn)
+	conn.writeBlocker.Lock()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := blocking.Write([]byte("blocked"))
+		errCh <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// The queued data is dropped once the deadline passes
+	stream.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	n, err := stream.Write([]byte("dropped"))
+	if err != ErrTimeout || n != 0 {
+		t.Fatalf("err: %v %d", err, n)
+	}
+	if time.Since(start) > 200*time.Millisecond {
+		t.Fatalf("deadline should fire")
+	}
+	if w := atomic.LoadUint32(&stream.sendWindow); w != initialStreamWindow {
+		t.Fatalf("bad: %d", w)
+	}
+
+	conn.writeBlocker.Unlock()
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream.SetWriteDeadline(time.Time{})
+	if _, err := stream.Write([]byte("sent")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 16)
+	n, err = stream2.Read(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf[:n]) != "sent" {
+		t.Fatalf("bad: %q", buf[:n])
+	}
+}
+
+func TestStream_WaitEstablished(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	// Not acknowledged before it's accepted
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := stream.WaitEstablished(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	if err := stream2.WaitEstablished(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream.WaitEstablished(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A rejected stream fails early
+	rejected, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for server.NumStreams() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	server.resetStream(rejected.id)
+	if err := rejected.WaitEstablished(context.Background()); err != ErrStreamRejected {
+		t.Fatalf("err: %v", err)
+	}
+
+	// And so does a stream of a closed session
+	pending, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client.Close()
+	if err := pending.WaitEstablished(context.Background()); err != ErrStreamClosed {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_OpenEstablished(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	// A stream that isn't accepted in time is reset
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.OpenEstablished(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream2.Read(make([]byte, 1)); err != ErrConnectionReset {
+		t.Fatalf("err: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := server.AcceptStream()
+		errCh <- err
+	}()
+	stream, err := client.OpenEstablished(context.Background())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if state := stream.State(); state != StreamEstablished {
+		t.Fatalf("bad: %v", state)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Closing the session fails the wait
+	go func() {
+		for client.NumStreams() != 2 {
+			time.Sleep(time.Millisecond)
+		}
+		client.Close()
+	}()
+	if _, err := client.OpenEstablished(context.Background()); err != ErrSessionShutdown {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_RecvWorkers_Error(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.RecvWorkers = 2
+	conn1, conn2 := testConn()
+	server, _ := Server(conn2, conf)
+	defer server.Close()
+	logs := captureLogs(server)
+	go io.Copy(ioutil.Discard, conn1)
+
+	// The SYN is handled inline, the data frame exceeding the window by
+	// a worker
+	hdr := header(make([]byte, headerSize))
+	hdr.encode(typeWindowUpdate, flagSYN, 1, 0)
+	if _, err := conn1.Write(hdr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	length := conf.MaxStreamWindowSize + 1
+	hdr.encode(typeData, 0, 1, length)
+	go conn1.Write(append([]byte(hdr), make([]byte, length)...))
+
+	select {
+	case <-server.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatalf("session not closed")
+	}
+	closed := make(chan struct{})
+	go func() {
+		server.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("close blocked")
+	}
+	if !strings.Contains(logs.String(), "receive window exceeded") {
+		t.Fatalf("bad: %s", logs.String())
+	}
+}
+
+func TestSession_RecvWorkers(t *testing.T) {
+	conf := testConf()
+	conf.RecvWorkers = 4
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	const streams = 50
+	const writes = 200
+	errCh := make(chan error, 2*streams)
+
+	// Every stream writes an increasing sequence of its own id, so any
+	// reordering or mixing of frames shows up on the reading side
+	acceptor := func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer stream.Close()
+
+		data, err := ioutil.ReadAll(stream)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if len(data) != writes*16 {
+			errCh <- fmt.Errorf("stream %d: short read %d", stream.StreamID(), len(data))
+			return
+		}
+		id := data[:8]
+		for i := 0; i < writes; i++ {
+			msg := data[i*16 : (i+1)*16]
+			if !bytes.Equal(msg[:8], id) || string(msg[8:]) != fmt.Sprintf("%08d", i) {
+				errCh <- fmt.Errorf("stream %d: bad message %d: %q", stream.StreamID(), i, msg)
+				return
+			}
+		}
+		errCh <- nil
+	}
+	sender := func(n int) {
+		stream, err := client.Open()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer stream.Close()
+
+		for i := 0; i < writes; i++ {
+			msg := fmt.Sprintf("%08d%08d", n, i)
+			if _, err := stream.Write([]byte(msg)); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}
+
+	for i := 0; i < streams; i++ {
+		go acceptor()
+		go sender(i)
+	}
+	for i := 0; i < 2*streams; i++ {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+}
+
+func TestStream_SetRateLimit(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, stream)
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	// The first second worth of data is sent at once
+	const rate = 64 * 1024
+	stream.SetRateLimit(rate)
+	start := time.Now()
+	if _, err := stream.Write(make([]byte, 2*rate)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+
+	// Writes block up to the deadline
+	stream.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := stream.Write(make([]byte, rate))
+	if err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+	if n == 0 || n > rate/2 {
+		t.Fatalf("bad: %d", n)
+	}
+	stream.SetWriteDeadline(time.Time{})
+
+	// Removing the limit unblocks writes
+	stream.SetRateLimit(0)
+	start = time.Now()
+	if _, err := stream.Write(make([]byte, 4*rate)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+}
+
+func TestSession_SessionRateLimit(t *testing.T) {
+	const rate = 256 * 1024
+	conf := testConf()
+	conf.SessionRateLimit = rate
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, stream)
+		}
+	}()
+
+	// Two streams share the limit. After the initial burst, the rest
+	// takes about a second.
+	errCh := make(chan error, 2)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		go func() {
+			stream, err := client.OpenStream()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer stream.Close()
+			_, err = stream.Write(make([]byte, rate))
+			errCh <- err
+		}()
+	}
+
+	// Control frames are not held back
+	time.Sleep(100 * time.Millisecond)
+	if rtt, err := client.Ping(); err != nil || rtt > 200*time.Millisecond {
+		t.Fatalf("bad: %v %v", rtt, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+
+	stats := client.Stats()
+	if stats.BytesSent < 2*rate {
+		t.Fatalf("bad: %v", stats)
+	}
+	if stats.SendRate <= 0 || stats.SendRate > 2*rate {
+		t.Fatalf("bad: %v", stats)
+	}
+}
+
+func TestSession_DuplicateSYN(t *testing.T) {
+	for _, action := range []DuplicateSYNAction{DuplicateSYNClose, DuplicateSYNReset} {
+		conf := testConfNoKeepAlive()
+		conf.DuplicateSYNAction = action
+		client, server := testClientServerConfig(conf)
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := stream.Write([]byte("hello")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Open the same stream again
+		hdr := header(make([]byte, headerSize))
+		hdr.encode(typeWindowUpdate, flagSYN, stream.StreamID(), 0)
+		if err := client.sendNoWait(hdr); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// The stream is reset on both sides, not replaced
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(stream2, buf); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := stream2.Read(buf); err != ErrConnectionReset {
+			t.Fatalf("%d: err: %v", action, err)
+		}
+
+		switch action {
+		case DuplicateSYNClose:
+			select {
+			case <-server.CloseChan():
+			case <-time.After(time.Second):
+				t.Fatalf("should close")
+			}
+		case DuplicateSYNReset:
+			server.SetAcceptDeadline(time.Now().Add(50 * time.Millisecond))
+			if _, err := server.AcceptStream(); err != ErrTimeout {
+				t.Fatalf("err: %v", err)
+			}
+			if server.IsClosed() || server.NumStreams() != 0 {
+				t.Fatalf("bad: %v %d", server.IsClosed(), server.NumStreams())
+			}
+			if _, err := client.Ping(); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestSession_RecentlyClosed(t *testing.T) {
+	conf := testConf()
+	conf.ClosedStreamHistory = 2
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	if closed := client.RecentlyClosed(); len(closed) != 0 {
+		t.Fatalf("bad: %v", closed)
+	}
+
+	for i := 1; i <= 3; i++ {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := stream.Write(make([]byte, i)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := io.ReadFull(stream2, make([]byte, i)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if i == 3 {
+			server.resetStream(stream2.StreamID())
+		} else {
+			stream2.Close()
+			stream.Close()
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for client.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("streams not closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	closed := client.RecentlyClosed()
+	if len(closed) != 2 {
+		t.Fatalf("bad: %v", closed)
+	}
+	if closed[0].ID != 3 || closed[0].BytesSent != 2 || closed[0].State != StreamClosed {
+		t.Fatalf("bad: %v", closed[0])
+	}
+	if closed[1].ID != 5 || closed[1].BytesSent != 3 || closed[1].State != StreamReset {
+		t.Fatalf("bad: %v", closed[1])
+	}
+	if closed[1].Opened.IsZero() || closed[1].Duration <= 0 {
+		t.Fatalf("bad: %v", closed[1])
+	}
+	if closed := server.RecentlyClosed(); len(closed) != 2 || closed[1].BytesReceived != 3 {
+		t.Fatalf("bad: %v", closed)
+	}
+}
+
+type shortWriteConn struct {
+	io.ReadWriteCloser
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.ReadWriteCloser.Write(b[:1])
+}
+
+func TestSession_ShortWrites(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.EnableChecksum = true
+	conn1, conn2 := testConn()
+	client, _ := Client(&shortWriteConn{conn1}, conf)
+	server, _ := Server(&shortWriteConn{conn2}, conf)
+	defer client.Close()
+	defer server.Close()
+
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer stream.Close()
+		_, err = io.Copy(stream, io.LimitReader(stream, 64*1024))
+		errCh <- err
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go stream.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("bad data")
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestStream_SetContext(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(stream2, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream.SetContext(ctx)
+
+	// Cancelling unblocks a pending read
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := stream.Read(make([]byte, 1))
+		errCh <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("read not unblocked")
+	}
+	if _, err := stream.Write([]byte("x")); err != context.Canceled {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The peer sees a reset
+	stream2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stream2.Read(buf); err != ErrConnectionReset {
+		t.Fatalf("err: %v", err)
+	}
+	if client.NumStreams() != 0 {
+		t.Fatalf("bad: %d", client.NumStreams())
+	}
+
+	// Streams closed before the context is done are left alone
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stream3, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream3.SetContext(ctx)
+	stream3.Close()
+	stream4, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream4.Close()
+	for client.NumStreams() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	if stream3.State() != StreamClosed {
+		t.Fatalf("bad: %v", stream3.State())
+	}
+}
+
+func TestSession_MaxSessionLifetime(t *testing.T) {
+	conf := testConf()
+	conf.MaxSessionLifetime = 50 * time.Millisecond
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, testConf())
+	server, _ := Server(conn2, conf)
+	defer client.Close()
+	defer server.Close()
+
+	if age := server.Age(); age < 0 || age > conf.MaxSessionLifetime {
+		t.Fatalf("bad: %v", age)
+	}
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The open stream holds off the close
+	time.Sleep(100 * time.Millisecond)
+	if !server.GoAwaySent() || !client.GoAwayReceived() || server.IsClosed() {
+		t.Fatalf("should drain")
+	}
+
+	stream.Close()
+	stream2.Close()
+	select {
+	case <-server.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatalf("should close")
+	}
+}
+
+func TestSession_MaxSessionLifetimeGrace(t *testing.T) {
+	conf := testConf()
+	conf.MaxSessionLifetime = 50 * time.Millisecond
+	conf.MaxSessionLifetimeGrace = 50 * time.Millisecond
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	if _, err := client.OpenStream(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-client.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatalf("should close")
+	}
+	if age := client.Age(); age < 100*time.Millisecond {
+		t.Fatalf("bad: %v", age)
+	}
+}
+
+func TestStream_PeerClosedWrite(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("body")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stream2.PeerClosedWrite() {
+		t.Fatalf("should not be closed")
+	}
+
+	stream.Close()
+	data, err := ioutil.ReadAll(stream2)
+	if err != nil || string(data) != "body" {
+		t.Fatalf("bad: %q %v", data, err)
+	}
+	if !stream2.PeerClosedWrite() || stream.PeerClosedWrite() {
+		t.Fatalf("bad: %v %v", stream2.PeerClosedWrite(), stream.PeerClosedWrite())
+	}
+
+	// The stream can still be written to and closed
+	if _, err := stream2.Write([]byte("reply")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2.Close()
+
+	// Reads ending for other reasons are told apart
+	stream3, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client.Close()
+	if _, err := stream3.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("should fail")
+	}
+	if stream3.PeerClosedWrite() {
+		t.Fatalf("should not be closed by the peer")
+	}
+}
+
+func TestStream_PauseReads(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	if _, err := stream2.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Reading while paused doesn't return credit
+	stream2.PauseReads()
+	go io.Copy(ioutil.Discard, stream2)
+
+	written := make(chan int, 1)
+	go func() {
+		n, _ := stream.Write(make([]byte, 2*initialStreamWindow))
+		written <- n
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if window := atomic.LoadUint32(&stream.sendWindow); window != 0 {
+		t.Fatalf("bad: %d", window)
+	}
+	select {
+	case n := <-written:
+		t.Fatalf("write should block: %d", n)
+	default:
+	}
+
+	if err := stream2.ResumeReads(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case n := <-written:
+		if n != 2*int(initialStreamWindow) {
+			t.Fatalf("bad: %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("write should complete")
+	}
+}
+
+func TestStream_PauseReads_Extension(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.EnableStreamPause = true
+
+	for _, enabled := range []bool{true, false} {
+		serverConf := testConfNoKeepAlive()
+		serverConf.EnableStreamPause = enabled
+
+		conn1, conn2 := testConn()
+		client, _ := Client(conn1, conf)
+		server, _ := Server(conn2, serverConf)
+
+		// Wait for the extensions to be negotiated
+		if _, err := client.Ping(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if client.EffectiveConfig().EnableStreamPause != enabled {
+			t.Fatalf("bad: %v", enabled)
+		}
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := stream.Write([]byte("x")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2.PauseReads()
+
+		if enabled {
+			deadline := time.Now().Add(time.Second)
+			for !stream.PeerPaused() {
+				if time.Now().After(deadline) {
+					t.Fatalf("should be paused")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		// Writes block despite the window left, unless only the
+		// window is used for flow control
+		written := make(chan error, 1)
+		go func() {
+			_, err := stream.Write([]byte("y"))
+			written <- err
+		}()
+		if enabled {
+			select {
+			case err := <-written:
+				t.Fatalf("write should block: %v", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			if window := stream.SendWindow(); window == 0 {
+				t.Fatalf("bad: %d", window)
+			}
+			if state := client.FlowControlSnapshot()[0]; !state.PeerPaused || !state.Blocked {
+				t.Fatalf("bad: %#v", state)
+			}
+		}
+
+		if err := stream2.ResumeReads(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		select {
+		case err := <-written:
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("write should complete")
+		}
+		if stream.PeerPaused() {
+			t.Fatalf("should not be paused")
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestStream_PauseReads_HighWater(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.EnableStreamPause = true
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Pausing from the callback, which runs on the recv loop, doesn't
+	// wait for the pause to be sent
+	stream2.SetHighWaterCallback(0.5, stream2.PauseReads)
+	if _, err := stream.Write(make([]byte, initialStreamWindow/2)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !stream.PeerPaused() {
+		if time.Now().After(deadline) {
+			t.Fatalf("should be paused")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := server.Ping(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// gatedConn holds writes back while blocked until gate is closed
+type gatedConn struct {
+	io.ReadWriteCloser
+	blocked int32
+	gate    chan struct{}
+}
+
+func (c *gatedConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.blocked) == 1 {
+		<-c.gate
+	}
+	return c.ReadWriteCloser.Write(b)
+}
+
+func TestStream_PauseReads_QueueFull(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.EnableStreamPause = true
+	conn1, conn2 := testConn()
+	gated := &gatedConn{ReadWriteCloser: conn2, gate: make(chan struct{})}
+	client, _ := Client(conn1, conf)
+	server, _ := Server(gated, conf)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream.WaitEstablished(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Stall the send loop and fill its queue
+	atomic.StoreInt32(&gated.blocked, 1)
+	go server.Ping()
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&server.sendBusy) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("send loop not busy")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	hdr := header(make([]byte, headerSize))
+	hdr.encode(typeWindowUpdate, 0, stream2.StreamID(), 0)
+FILL:
+	for {
+		select {
+		case server.sendCh <- sendReady{Hdr: hdr}:
+		default:
+			break FILL
+		}
+	}
+
+	// Pausing doesn't wait for room in the queue
+	paused := make(chan struct{})
+	go func() {
+		stream2.PauseReads()
+		close(paused)
+	}()
+	select {
+	case <-paused:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("pause blocked")
+	}
+
+	// The pause is sent once the send loop catches up
+	atomic.StoreInt32(&gated.blocked, 0)
+	close(gated.gate)
+	deadline = time.Now().Add(time.Second)
+	for !stream.PeerPaused() {
+		if time.Now().After(deadline) {
+			t.Fatalf("should be paused")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := stream2.ResumeReads(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline = time.Now().Add(time.Second)
+	for stream.PeerPaused() {
+		if time.Now().After(deadline) {
+			t.Fatalf("should not be paused")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSession_MaxQueuedFramesPerStream(t *testing.T) {
+	for _, max := range []int{0, 4} {
+		conf := testConfNoKeepAlive()
+		serverConf := testConfNoKeepAlive()
+		serverConf.MaxQueuedFramesPerStream = max
+
+		conn1, conn2 := testConn()
+		client, _ := Client(conn1, conf)
+		server, _ := Server(conn2, serverConf)
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		chunk := make([]byte, initialStreamWindow/4)
+		for i := 0; i < 4; i++ {
+			if _, err := stream.Write(chunk); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for {
+			state := server.FlowControlSnapshot()[0]
+			if state.Buffered == int(initialStreamWindow) {
+				if state.QueuedFrames < 4 {
+					t.Fatalf("bad: %#v", state)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("bad: %#v", state)
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		// Reading part of the buffer returns credit unless there are
+		// too many frames queued
+		if _, err := io.ReadFull(stream2, make([]byte, 3*len(chunk))); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if window := stream.SendWindow(); (window == 0) != (max > 0) {
+			t.Fatalf("bad: %d %d", max, window)
+		}
+
+		// Reading the buffer empty returns the credit
+		if _, err := io.ReadFull(stream2, chunk); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		deadline = time.Now().Add(time.Second)
+		for stream.SendWindow() < uint32(3*len(chunk)) {
+			if time.Now().After(deadline) {
+				t.Fatalf("bad: %d", stream.SendWindow())
+			}
+			time.Sleep(time.Millisecond)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestSession_MaxFrameSize(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.MaxFrameSize = 1024
+
+	conn1, conn2 := testConn()
+	server, _ := Server(conn2, conf)
+	defer server.Close()
+	_ = captureLogs(server)
+
+	go io.Copy(ioutil.Discard, conn1)
+
+	// A frame within the limit is fine
+	hdr := header(make([]byte, headerSize))
+	hdr.encode(typeData, flagSYN, 1, 1024)
+	if _, err := conn1.Write(append(hdr, make([]byte, 1024)...)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	// A larger one closes the session without waiting for the body
+	hdr.encode(typeData, 0, 1, 1025)
+	if _, err := conn1.Write(hdr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-server.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatalf("session should be closed")
+	}
+	if _, err := server.AcceptStream(); err != ErrFrameTooLarge {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_MalformedFrames(t *testing.T) {
+	const sessions = 200
+	rnd := rand.New(rand.NewSource(1))
+	lengths := []uint32{0, 1, 12, initialStreamWindow, initialStreamWindow + 1, 1 << 30, math.MaxUint32}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	for i := 0; i < sessions; i++ {
+		conn1, conn2 := testConn()
+		server, _ := Server(conn2, testConfNoKeepAlive())
+		_ = captureLogs(server)
+		go io.Copy(ioutil.Discard, conn1)
+
+		// A few frames with random headers, oversized lengths and
+		// a short random body
+		var frames []byte
+		for n := rnd.Intn(4) + 1; n > 0; n-- {
+			length := rnd.Uint32()
+			if rnd.Intn(2) == 0 {
+				length = lengths[rnd.Intn(len(lengths))]
+			}
+			hdr := header(make([]byte, headerSize))
+			hdr.encode(uint8(rnd.Intn(6)), uint16(rnd.Intn(1<<9)), uint32(rnd.Intn(4)), length)
+			if rnd.Intn(8) == 0 {
+				hdr[0] = byte(rnd.Intn(256))
+			}
+			body := make([]byte, rnd.Intn(64))
+			rnd.Read(body)
+			frames = append(frames, hdr...)
+			frames = append(frames, body...)
+		}
+		conn1.Write(frames)
+		conn1.Close()
+
+		select {
+		case <-server.CloseChan():
+		case <-time.After(time.Second):
+			t.Fatalf("session %d should be closed", i)
+		}
+		server.Close()
+	}
+
+	// Nothing is allocated for the declared lengths
+	runtime.ReadMemStats(&after)
+	if perSession := (after.TotalAlloc - before.TotalAlloc) / sessions; perSession > 4*uint64(initialStreamWindow) {
+		t.Fatalf("allocated %d bytes per session", perSession)
+	}
+}
+
+func TestStream_SetHighWaterCallback(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	var calls int32
+	stream2.SetHighWaterCallback(0.5, func() { atomic.AddInt32(&calls, 1) })
+
+	// send writes n bytes and waits until they are buffered
+	recv := uint64(1)
+	send := func(n int) {
+		if _, err := stream.Write(make([]byte, n)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		recv += uint64(n)
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadUint64(&stream2.bytesRecv) != recv {
+			if time.Now().After(deadline) {
+				t.Fatalf("data not received")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	half := int(initialStreamWindow / 2)
+	send(half - 2)
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+	send(1)
+	send(10)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Draining the buffer re-arms the callback
+	if _, err := io.ReadFull(stream2, make([]byte, recv)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	send(half)
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	stream2.SetHighWaterCallback(0.5, nil)
+	if _, err := io.ReadFull(stream2, make([]byte, half)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	send(half)
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestSession_Token(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.ExchangeSessionToken = true
+	conf.EnableChecksum = true
+
+	waitToken := func(s *Session) []byte {
+		deadline := time.Now().Add(time.Second)
+		for s.Token() == nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("missing token")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return s.Token()
+	}
+
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+	token := waitToken(client)
+	if len(token) != 2*sessionTokenSize || !bytes.Equal(token, waitToken(server)) {
+		t.Fatalf("bad: %x %x", token, server.Token())
+	}
+
+	// Each session gets its own token
+	client2, server2 := testClientServerConfig(conf)
+	defer client2.Close()
+	defer server2.Close()
+	if bytes.Equal(token, waitToken(client2)) {
+		t.Fatalf("token reused")
+	}
+
+	// No token unless both sides enable it
+	conn1, conn2 := testConn()
+	client3, _ := Client(conn1, conf)
+	server3, _ := Server(conn2, testConfNoKeepAlive())
+	defer client3.Close()
+	defer server3.Close()
+	if _, err := client3.Ping(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if client3.Token() != nil || server3.Token() != nil {
+		t.Fatalf("unexpected token")
+	}
+}
+
+func TestSession_GoAwayWithMessage(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.EnableGoAwayMessage = true
+
+	cases := []struct {
+		serverConf *Config
+		msg, want  string
+	}{
+		{conf, "rolling restart", "rolling restart"},
+		{conf, strings.Repeat("\u20ac", 100), strings.Repeat("\u20ac", 85)},
+		{testConfNoKeepAlive(), "rolling restart", ""},
+	}
+	for _, c := range cases {
+		conn1, conn2 := testConn()
+		client, _ := Client(conn1, conf)
+		server, _ := Server(conn2, c.serverConf)
+		logs := captureLogs(client)
+
+		// Wait for the extensions to be negotiated
+		if _, err := server.Ping(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := server.GoAwayWithMessage(c.msg); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for !client.GoAwayReceived() {
+			if time.Now().After(deadline) {
+				t.Fatalf("go away not received")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if msg := client.RemoteGoAwayMessage(); msg != c.want {
+			t.Fatalf("bad: %q", msg)
+		}
+
+		// The reason is logged by the recv loop, which is done once
+		// the session is closed
+		client.Close()
+		server.Close()
+		if c.want != "" && !logs.match([]string{"[WARN] yamux: received go away: " + c.want}) {
+			t.Fatalf("bad: %v", logs.logs())
+		}
+	}
+}
+
+func TestStream_LastReadFlags(t *testing.T) {
+	for _, expose := range []bool{false, true} {
+		conf := testConfNoKeepAlive()
+		conf.ExposeSpareFlags = expose
+
+		conn1, conn2 := testConn()
+		server, _ := Server(conn2, conf)
+		defer server.Close()
+
+		go io.Copy(ioutil.Discard, conn1)
+
+		frame := func(flags uint16, body string) []byte {
+			hdr := header(make([]byte, headerSize))
+			hdr.encode(typeData, flags, 1, uint32(len(body)))
+			return append([]byte(hdr), body...)
+		}
+		if _, err := conn1.Write(frame(flagSYN|0x200, "a")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer stream.Close()
+
+		expect := func(flags uint16) {
+			t.Helper()
+			if _, err := stream.Read(make([]byte, 8)); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !expose {
+				flags = 0
+			}
+			if got := stream.LastReadFlags(); got != flags {
+				t.Fatalf("bad: %x, expected %x", got, flags)
+			}
+		}
+		expect(0x200)
+
+		// Flags accumulate until the next read
+		if _, err := conn1.Write(append(frame(0x400, "b"), frame(0x8000|flagFIN, "c")...)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for !stream.PeerClosedWrite() {
+			if time.Now().After(deadline) {
+				t.Fatalf("missing fin")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		expect(0x8400)
+	}
+}
+
+func TestStream_Age(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	before := time.Now()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if created := stream.CreatedAt(); created.Before(before) || created.After(time.Now()) {
+		t.Fatalf("bad: %v", created)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if age := stream.Age(); age < 20*time.Millisecond {
+		t.Fatalf("bad: %v", age)
+	}
+
+	// The age stops once the stream is closed
+	stream.Close()
+	stream2.Close()
+	<-stream.doneCh
+	age := stream.Age()
+	time.Sleep(20 * time.Millisecond)
+	if stream.Age() != age {
+		t.Fatalf("bad: %v, expected %v", stream.Age(), age)
+	}
+}
+
+func TestStream_ReadAfterSessionClose(t *testing.T) {
+	for _, local := range []bool{false, true} {
+		client, server := testClientServer()
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := stream.Write([]byte("hello")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := stream.Write([]byte(" world")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadUint64(&stream2.bytesRecv) != 11 {
+			if time.Now().After(deadline) {
+				t.Fatalf("data not received")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		// Either session going away keeps the delivered data readable
+		if local {
+			server.Close()
+		} else {
+			client.Close()
+			<-server.CloseChan()
+		}
+		got, err := ioutil.ReadAll(stream2)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(got) != "hello world" {
+			t.Fatalf("bad: %q", got)
+		}
+		if _, err := stream2.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("err: %v", err)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestStream_Closed(t *testing.T) {
+	type step struct {
+		name string
+		do   func(local, remote *Stream) error
+	}
+	closeWrite := step{"CloseWrite", func(local, remote *Stream) error { return local.CloseWrite() }}
+	closeRead := step{"CloseRead", func(local, remote *Stream) error { return local.CloseRead() }}
+	peerFIN := step{"peer FIN", func(local, remote *Stream) error {
+		if err := remote.Close(); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(time.Second)
+		for !local.PeerClosedWrite() {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("FIN not received")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	}}
+
+	cases := []struct {
+		first, second step
+		read, write   bool
+		reset         bool
+	}{
+		{closeWrite, peerFIN, false, true, false},
+		{peerFIN, closeWrite, true, false, false},
+		{closeRead, closeWrite, true, false, true},
+		{closeWrite, closeRead, false, true, true},
+	}
+	for _, c := range cases {
+		client, server := testClientServer()
+
+		remote, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := remote.Write([]byte("hello")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		local, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if read, write := local.Closed(); read || write {
+			t.Fatalf("%s: bad: %v %v", c.first.name, read, write)
+		}
+
+		if err := c.first.do(local, remote); err != nil {
+			t.Fatalf("%s: err: %v", c.first.name, err)
+		}
+		if read, write := local.Closed(); read != c.read || write != c.write {
+			t.Fatalf("%s: bad: %v %v", c.first.name, read, write)
+		}
+		if server.NumStreams() != 1 {
+			t.Fatalf("%s: stream removed early", c.first.name)
+		}
+
+		if err := c.second.do(local, remote); err != nil {
+			t.Fatalf("%s then %s: err: %v", c.first.name, c.second.name, err)
+		}
+		if read, write := local.Closed(); !read || !write {
+			t.Fatalf("%s then %s: bad: %v %v", c.first.name, c.second.name, read, write)
+		}
+		if local.State() != StreamClosed {
+			t.Fatalf("%s then %s: bad state: %v", c.first.name, c.second.name, local.State())
+		}
+		select {
+		case <-local.doneCh:
+		case <-time.After(time.Second):
+			t.Fatalf("%s then %s: stream not removed", c.first.name, c.second.name)
+		}
+		if server.NumStreams() != 0 {
+			t.Fatalf("%s then %s: stream not removed", c.first.name, c.second.name)
+		}
+
+		// The peer sees a FIN, or a reset if it was still writing
+		if !c.reset {
+			if got, err := ioutil.ReadAll(remote); err != nil || len(got) != 0 {
+				t.Fatalf("%s then %s: bad: %q %v", c.first.name, c.second.name, got, err)
+			}
+		}
+		deadline := time.Now().Add(time.Second)
+		for client.NumStreams() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s then %s: peer stream not removed", c.first.name, c.second.name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if c.reset && remote.State() != StreamReset {
+			t.Fatalf("%s then %s: bad peer state: %v", c.first.name, c.second.name, remote.State())
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestStream_CloseRead_DiscardsData(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream2.CloseRead(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream2.Read(make([]byte, 5)); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The credit of discarded data is returned, so the peer can keep
+	// writing past its window
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(make([]byte, 4*initialStreamWindow))
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("writer blocked")
+	}
+
+	// Writing still works until closed for writing
+	if _, err := stream2.Write([]byte("world")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "world" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
+}
+
+func TestStream_Approve(t *testing.T) {
+	conf := testConf()
+	conf.RequireStreamApproval = true
+	conf.MaxUnapprovedData = 1024
+	conf.ApprovalTimeout = 50 * time.Millisecond
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	// open writes data on a new stream and accepts it
+	open := func(n int) (*Stream, *Stream) {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := stream.Write(make([]byte, n)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return stream, stream2
+	}
+	waitEstablished := func(stream *Stream, d time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		defer cancel()
+		return stream.WaitEstablished(ctx)
+	}
+
+	// An accepted stream is held until approved
+	stream, stream2 := open(100)
+	if err := waitEstablished(stream, 10*time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream2.Read(make([]byte, 100)); err != ErrStreamNotApproved {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream2.Write([]byte("test")); err != ErrStreamNotApproved {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream2.Approve(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := waitEstablished(stream, time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(stream2, make([]byte, 100)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Approval is not withdrawn by the timeout, and lifts the limit
+	time.Sleep(2 * conf.ApprovalTimeout)
+	if _, err := stream.Write(make([]byte, 4*conf.MaxUnapprovedData)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(stream2, make([]byte, 4*conf.MaxUnapprovedData)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream2.Approve(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Closing a held stream rejects it
+	stream, stream2 = open(0)
+	if err := stream2.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := waitEstablished(stream, time.Second); err != ErrStreamRejected {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream2.Approve(); err != ErrConnectionReset {
+		t.Fatalf("err: %v", err)
+	}
+
+	// So is a stream that is not approved in time
+	start := time.Now()
+	stream, _ = open(0)
+	if err := waitEstablished(stream, time.Second); err != ErrStreamRejected {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d < conf.ApprovalTimeout {
+		t.Fatalf("rejected early: %v", d)
+	}
+
+	// Or one that was sent too much data before approval
+	stream, stream2 = open(int(conf.MaxUnapprovedData) + 1)
+	if err := waitEstablished(stream, time.Second); err != ErrStreamRejected {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream2.Approve(); err != ErrConnectionReset {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Other streams are unaffected
+	if server.NumStreams() != 1 {
+		t.Fatalf("bad: %d", server.NumStreams())
+	}
+
+	conf = testConf()
+	conf.MaxUnapprovedData = conf.MaxStreamWindowSize + 1
+	if err := VerifyConfig(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSession_LockContention(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Writers queue on the write lock while one waits for the window
+	const writers, size = 8, 64 * 1024
+	errCh := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			_, err := stream.Write(make([]byte, size))
+			errCh <- err
+		}()
+	}
+	if _, err := io.ReadFull(stream2, make([]byte, 1+writers*size)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < writers; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	stats := client.Stats()
+	if lockStats && stats.WriteLockContended == 0 {
+		t.Fatalf("bad: %+v", stats)
+	}
+	if !lockStats && (stats.StreamLockContended != 0 || stats.WriteLockContended != 0 || stats.ReadLockContended != 0) {
+		t.Fatalf("bad: %+v", stats)
+	}
+}
+
+func TestStream_SetNoDelay(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(stream2, make([]byte, 1)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sent := func() uint64 { return atomic.LoadUint64(&stream.bytesSent) }
+
+	// Small writes are buffered until flushed
+	if err := stream.SetNoDelay(false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if n, err := stream.Write([]byte("a")); err != nil || n != 1 {
+			t.Fatalf("bad: %d %v", n, err)
+		}
+	}
+	if n := sent(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if err := stream.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := sent(); n != 11 {
+		t.Fatalf("bad: %d", n)
+	}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(stream2, buf); err != nil || string(buf) != "aaaaaaaaaa" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
+
+	// Or until a short delay passed
+	if _, err := stream.Write([]byte("b")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(stream2, buf[:1]); err != nil || buf[0] != 'b' {
+		t.Fatalf("bad: %q %v", buf[:1], err)
+	}
+
+	// A full frame is sent right away
+	frame := make([]byte, initialStreamWindow)
+	if _, err := stream.Write(frame[:len(frame)-1]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := sent(); n != 12 {
+		t.Fatalf("bad: %d", n)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(stream2, frame)
+		errCh <- err
+	}()
+	if _, err := stream.Write([]byte("e")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := sent(); n != 12+uint64(initialStreamWindow) {
+		t.Fatalf("bad: %d", n)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Buffered data goes out before the FIN
+	if _, err := stream.Write([]byte("c")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, err := ioutil.ReadAll(stream2); err != nil || string(got) != "c" {
+		t.Fatalf("bad: %q %v", got, err)
+	}
+	if _, err := stream.Write([]byte("d")); err != ErrStreamClosedForWriting {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Close reports buffered data it failed to send
+	other, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := other.SetNoDelay(false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := other.Write([]byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	other.SetWriteDeadline(time.Now().Add(-time.Second))
+	if err := other.Close(); err != ErrTimeout {
+		t.Fatalf("err: %v", err)
+	}
+	if state := other.State(); state != StreamLocalClose {
+		t.Fatalf("bad: %v", state)
+	}
+}
+
+func TestStream_WriteWithAck(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The first write fits the window and leaves right away, the next
+	// ones are acked once the peer reads
+	size := int(initialStreamWindow)
+	var acks []<-chan error
+	for i := 0; i < maxPendingAcks+1; i++ {
+		b := bytes.Repeat([]byte{byte(i)}, size)
+		n, acked := stream.WriteWithAck(b)
+		if n != size {
+			t.Fatalf("bad: %d", n)
+		}
+		b[0] = 0xff // may be reused
+		acks = append(acks, acked)
+	}
+	select {
+	case err := <-acks[0]:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("write not acked")
+	}
+	select {
+	case err := <-acks[1]:
+		t.Fatalf("acked early: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Further writes wait for an ack
+	queuedCh := make(chan (<-chan error), 1)
+	go func() {
+		_, acked := stream.WriteWithAck([]byte("x"))
+		queuedCh <- acked
+	}()
+	select {
+	case <-queuedCh:
+		t.Fatalf("queued beyond the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The queued writes arrive in order
+	buf := make([]byte, size)
+	for i := range acks {
+		if _, err := io.ReadFull(stream2, buf); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(buf, bytes.Repeat([]byte{byte(i)}, size)) {
+			t.Fatalf("bad data in write %d", i)
+		}
+	}
+	for i, acked := range acks[1:] {
+		if err := <-acked; err != nil {
+			t.Fatalf("%d: err: %v", i, err)
+		}
+	}
+	if err := <-<-queuedCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(stream2, buf[:1]); err != nil || buf[0] != 'x' {
+		t.Fatalf("bad: %q %v", buf[:1], err)
+	}
+
+	// Queued writes follow buffered data and go out before the FIN
+	if err := stream.SetNoDelay(false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("a")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream.WriteWithAck(bytes.Repeat([]byte("b"), size))
+	stream.WriteWithAck([]byte("c"))
+	readCh := make(chan []byte, 1)
+	go func() {
+		got, _ := ioutil.ReadAll(stream2)
+		readCh <- got
+	}()
+	if err := stream.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := "a" + strings.Repeat("b", size) + "c"
+	if got := <-readCh; string(got) != want {
+		t.Fatalf("bad: %d bytes", len(got))
+	}
+
+	// Writes fail once the stream is gone
+	n, acked := stream.WriteWithAck([]byte("x"))
+	if err := <-acked; n != 1 || err != ErrStreamClosedForWriting {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+}
+
+func TestSession_FlowControlViolation(t *testing.T) {
+	for _, action := range []FlowControlViolationAction{FlowControlViolationClose, FlowControlViolationReset} {
+		conf := testConfNoKeepAlive()
+		conf.FlowControlViolationAction = action
+		conn1, conn2 := testConn()
+		server, _ := Server(conn2, conf)
+		logs := captureLogs(server)
+		go io.Copy(ioutil.Discard, conn1)
+
+		frame := func(flags uint16, id uint32, length uint32) []byte {
 			hdr := header(make([]byte, headerSize))
-			hdr.encode(typePing, 0, 0, 0)
-			err = server.sendNoWait(hdr)
+			hdr.encode(typeData, flags, id, length)
+			return append([]byte(hdr), make([]byte, length)...)
+		}
+		if _, err := conn1.Write(frame(flagSYN, 1, 1)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Overrun the window by a single byte. Closing the session
+		// leaves the frame unread.
+		_, err = conn1.Write(frame(0, 1, initialStreamWindow))
+		if action == FlowControlViolationClose {
+			if _, err := server.AcceptStream(); err != ErrRecvWindowExceeded {
+				t.Fatalf("err: %v", err)
+			}
+			server.Close()
+			if !strings.Contains(logs.String(), "receive window exceeded (stream: 1, remain: 262143, recv: 262144)") {
+				t.Fatalf("bad: %v", logs.logs())
+			}
+			conn1.Close()
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// The stream is reset without holding up the session
+		if _, err := conn1.Write(frame(flagSYN, 3, 1)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := io.ReadFull(stream2, make([]byte, 1)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := stream.Read(make([]byte, 1)); err != ErrConnectionReset {
+			t.Fatalf("err: %v", err)
+		}
+		if server.IsClosed() || server.NumStreams() != 1 {
+			t.Fatalf("bad: %v %d", server.IsClosed(), server.NumStreams())
+		}
+		server.Close()
+		conn1.Close()
+	}
+
+	conf := testConf()
+	conf.FlowControlViolationAction = 2
+	if err := VerifyConfig(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSession_ResetLeakedStreams(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.ResetLeakedStreams = true
+	conf.LeakedStreamStacks = true
+	conf.LogOutput = ioutil.Discard
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	// Open and write to streams, leaking one of them
+	open := func(close bool) error {
+		conn, err := client.Open()
+		if err != nil {
+			return err
+		}
+		if _, ok := conn.(*StreamHandle); !ok {
+			return fmt.Errorf("bad: %T", conn)
+		}
+		if _, err := conn.Write([]byte("a")); err != nil {
+			return err
+		}
+		if close {
+			return conn.Close()
+		}
+		return nil
+	}
+	for _, close := range []bool{true, false} {
+		if err := open(close); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	closed, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	leaked, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for leaked.State() != StreamReset {
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked stream not reset")
+		}
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	if buf, err := ioutil.ReadAll(closed); err != nil || string(buf) != "a" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
+
+	// Without ResetLeakedStreams, Open returns the Stream itself
+	conf.ResetLeakedStreams = false
+	client2, server2 := testClientServerConfig(conf)
+	defer client2.Close()
+	defer server2.Close()
+	conn, err := client2.Open()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*Stream); !ok {
+		t.Fatalf("bad: %T", conn)
+	}
+}
+
+func TestStream_SetIdleTimeout(t *testing.T) {
+	conf := testConf()
+	conf.DefaultStreamIdleTimeout = time.Hour
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("a")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := atomic.LoadInt64(&stream2.idleTimeout); time.Duration(d) != time.Hour {
+		t.Fatalf("bad: %v", time.Duration(d))
+	}
+
+	// Activity keeps the stream alive
+	const timeout = 50 * time.Millisecond
+	stream2.SetIdleTimeout(timeout)
+	buf := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		if _, err := stream2.Read(buf); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		time.Sleep(timeout / 2)
+		if _, err := stream.Write([]byte("a")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if _, err := stream2.Read(buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// An idle stream is reset, unblocking the reader
+	start := time.Now()
+	if _, err := stream2.Read(buf); err != ErrStreamIdle {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d < timeout {
+		t.Fatalf("reset early: %v", d)
+	}
+	if _, err := stream2.Write([]byte("a")); err != ErrStreamIdle {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Read(buf); err != ErrConnectionReset {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Zero disables the timeout
+	stream, err = client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream.SetIdleTimeout(timeout)
+	stream.SetIdleTimeout(0)
+	time.Sleep(2 * timeout)
+	if _, err := stream.Write([]byte("a")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_FlowControlSnapshot(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	if states := client.FlowControlSnapshot(); len(states) != 0 {
+		t.Fatalf("bad: %v", states)
+	}
+
+	idle, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Write past the window of a stream the peer doesn't read
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(make([]byte, initialStreamWindow+1))
+		errCh <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	var states []StreamFlowState
+	for {
+		states = client.FlowControlSnapshot()
+		if len(states) == 2 && states[1].Blocked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not blocked: %v", states)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if states[0].ID != idle.StreamID() || states[1].ID != stream.StreamID() {
+		t.Fatalf("bad order: %v", states)
+	}
+	if s := states[0]; s.Blocked || s.SendWindow != initialStreamWindow {
+		t.Fatalf("bad: %v", s)
+	}
+	if s := states[1]; s.SendWindow != 0 {
+		t.Fatalf("bad: %v", s)
+	}
+
+	// The peer buffered the data and has no credit left to grant
+	var remote StreamFlowState
+	for {
+		for _, s := range server.FlowControlSnapshot() {
+			if s.ID == stream.StreamID() {
+				remote = s
+			}
+		}
+		if remote.Buffered == int(initialStreamWindow) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not buffered: %v", remote)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if remote.RecvWindow != 0 || remote.Blocked {
+		t.Fatalf("bad: %v", remote)
+	}
+
+	// Reading unblocks the writer
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stream2.StreamID() == idle.StreamID() {
+		if stream2, err = server.AcceptStream(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if _, err := io.ReadFull(stream2, make([]byte, initialStreamWindow+1)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, s := range client.FlowControlSnapshot() {
+		if s.Blocked {
+			t.Fatalf("bad: %v", s)
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("no randomness")
+}
+
+func TestSession_Rand(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.Rand = rand.New(rand.NewSource(1))
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	// Ping IDs are drawn from the source
+	expect := rand.New(rand.NewSource(1))
+	b := make([]byte, 4)
+	for i := 0; i < 3; i++ {
+		expect.Read(b)
+		client.pingLock.Lock()
+		id, err := client.nextPingID()
+		client.pingLock.Unlock()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if want := binary.BigEndian.Uint32(b); id != want {
+			t.Fatalf("bad: %d %d", id, want)
+		}
+	}
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A failing source fails the ping
+	client.config.Rand = failingReader{}
+	if _, err := client.Ping(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Without a source, IDs are sequential
+	client.config.Rand = nil
+	client.pingLock.Lock()
+	id, _ := client.nextPingID()
+	id2, _ := client.nextPingID()
+	client.pingLock.Unlock()
+	if id2 != id+1 {
+		t.Fatalf("bad: %d %d", id, id2)
+	}
+}
+
+func TestSession_Rand_Shared(t *testing.T) {
+	// Sessions of cloned configs share the source, which math/rand
+	// sources are not safe for
+	conf := testConfNoKeepAlive()
+	conf.Rand = rand.New(rand.NewSource(1))
+	errCh := make(chan error, 4)
+	for i := 0; i < 2; i++ {
+		client, server := testClientServerConfig(conf.Clone())
+		defer client.Close()
+		defer server.Close()
+		for _, session := range []*Session{client, server} {
+			go func(session *Session) {
+				var err error
+				for i := 0; i < 50 && err == nil; i++ {
+					_, err = session.Ping()
+				}
+				errCh <- err
+			}(session)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestSession_LoadShedding(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.LoadMaxStreams = 2
+	conf.LoadMaxMemory = 1000
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Buffered data counts towards the memory mark
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Stats().LoadFactor < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %v", server.Stats().LoadFactor)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	refused, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := refused.WaitEstablished(ctx); err != ErrPeerOverloaded {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := refused.Write([]byte("a")); err != ErrPeerOverloaded {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Reading the data lowers the load
+	if _, err := io.ReadFull(stream2, make([]byte, 1000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f := server.Stats().LoadFactor; f != 0.5 {
+		t.Fatalf("bad: %v", f)
+	}
+	stream, err = client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The stream count reached the mark
+	if f := server.Stats().LoadFactor; f != 1 {
+		t.Fatalf("bad: %v", f)
+	}
+	refused, err = client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := refused.WaitEstablished(ctx); err != ErrPeerOverloaded {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestStream_DrainInbound(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The writer needs the credit returned while draining
+	size := 3 * int64(initialStreamWindow)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(make([]byte, size))
+		if err == nil {
+			err = stream.Close()
+		}
+		errCh <- err
+	}()
+
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	if n, err := stream2.DrainInbound(0); n != 0 || err != nil {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	if n, err := stream2.DrainInbound(1000); n != 1000 || err != nil {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	if n, err := stream2.DrainInbound(-1); n != size-1000 || err != nil {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A deadline stops the drain
+	stream, err = client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte("abc")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err = server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	stream2.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := stream2.DrainInbound(-1); n != 3 || err != ErrTimeout {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+}
+
+func TestStream_Close_Idempotent(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	open := func() (*Stream, *Stream) {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := stream.Write([]byte("a")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream2, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return stream, stream2
+	}
+	reset := func(stream *Stream) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		stream.SetContext(ctx)
+	}
+	waitReset := func(stream *Stream) {
+		deadline := time.Now().Add(5 * time.Second)
+		for stream.State() != StreamReset {
+			if time.Now().After(deadline) {
+				t.Fatalf("not reset: %v", stream.State())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Close then close
+	stream, stream2 := open()
+	for i := 0; i < 3; i++ {
+		if err := stream.Close(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if _, err := stream.Write([]byte("a")); err != ErrStreamClosedForWriting {
+		t.Fatalf("err: %v", err)
+	}
+	stream2.Close()
+
+	// Reset then close
+	stream, stream2 = open()
+	reset(stream2)
+	waitReset(stream)
+	if err := stream.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream2.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Close then reset
+	stream, stream2 = open()
+	if err := stream.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reset(stream2)
+	waitReset(stream)
+	if err := stream.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Close after the session closed
+	stream, _ = open()
+	client.Close()
+	if err := stream.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestStream_UserData(t *testing.T) {
+	client, server := testClientServer()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+
+	if v := stream.UserData(); v != nil {
+		t.Fatalf("bad: %v", v)
+	}
+	stream.SetUserData("principal")
+	if v := stream.UserData(); v != "principal" {
+		t.Fatalf("bad: %v", v)
+	}
+
+	// Values of different types and nil can be stored
+	stream.SetUserData(42)
+	if v := stream.UserData(); v != 42 {
+		t.Fatalf("bad: %v", v)
+	}
+	stream.SetUserData(nil)
+	if v := stream.UserData(); v != nil {
+		t.Fatalf("bad: %v", v)
+	}
+}
+
+// writeFrames writes data from as many streams as frames at once,
+// reading it on the server
+func writeFrames(t *testing.T, client, server *Session, frames int, data []byte) {
+	errCh := make(chan error, frames)
+	for i := 0; i < frames; i++ {
+		go func() {
+			stream, err := client.OpenStreamWithData(context.Background(), data)
 			if err == nil {
-				continue
-			} else if err == ErrConnectionWriteTimeout {
-				break
-			} else {
+				err = stream.Close()
+			}
+			errCh <- err
+		}()
+	}
+	for i := 0; i < frames; i++ {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := io.ReadFull(stream, make([]byte, len(data))); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stream.Close()
+	}
+	for i := 0; i < frames; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestSession_MaxCoalesceBytes(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.CoalesceDelay = time.Millisecond
+	if err := VerifyConfig(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+	conf.MaxCoalesceBytes = headerSize - 1
+	if err := VerifyConfig(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	conf.MaxCoalesceBytes = 1024
+	conf.CoalesceDelay = 20 * time.Millisecond
+	conn1, conn2 := testConn()
+	counter := &countingConn{ReadWriteCloser: conn1}
+	client, _ := Client(counter, conf)
+	server, _ := Server(conn2, testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(stream2, make([]byte, 0)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Small frames of concurrent writers are written together, up to
+	// the cap
+	const frames = 100
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	start := atomic.LoadInt64(&counter.writes)
+	writeFrames(t, client, server, frames, data)
+	wire := frames * (2*headerSize + len(data))
+	if writes := atomic.LoadInt64(&counter.writes) - start; writes > int64(2*wire/conf.MaxCoalesceBytes) {
+		t.Fatalf("too many writes: %d", writes)
+	}
+	if largest := atomic.LoadInt64(&counter.largest); largest > int64(conf.MaxCoalesceBytes) {
+		t.Fatalf("write above cap: %d", largest)
+	}
+
+	// A single frame is written after the delay
+	if _, err := stream.Write([]byte("a")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(stream2, make([]byte, 1)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Pings are answered without a delay on an idle loop
+	conf.CoalesceDelay = 0
+	client2, server2 := testClientServerConfig(conf)
+	defer client2.Close()
+	defer server2.Close()
+	if _, err := client2.Ping(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_Coalesce_Close(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.MaxCoalesceBytes = 1024
+	conf.CoalesceDelay = 200 * time.Millisecond
+	conn1, conn2 := testConn()
+	counter := &countingConn{ReadWriteCloser: conn1}
+	client, _ := Client(counter, conf)
+	server, _ := Server(conn2, testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(stream2, make([]byte, 0)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A write completes once its frame left the buffer
+	writes := atomic.LoadInt64(&counter.writes)
+	if _, err := stream.Write([]byte("a")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := atomic.LoadInt64(&counter.writes); n == writes {
+		t.Fatalf("write completed while buffered")
+	}
+
+	// Closing the session writes the buffered frames first
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := stream.Write([]byte("b"))
+		errCh <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	client.Close()
+	if err := <-errCh; err != nil && err != ErrSessionShutdown {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(stream2, buf); err != nil || string(buf) != "ab" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
+}
+
+// failingConn fails writes once fail is set, after waiting for gate
+// to be closed
+type failingConn struct {
+	io.ReadWriteCloser
+	fail int32
+	gate chan struct{}
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.fail) == 1 {
+		<-c.gate
+		return 0, fmt.Errorf("write failed")
+	}
+	return c.ReadWriteCloser.Write(b)
+}
+
+func TestSession_Coalesce_CloseWriteError(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.MaxCoalesceBytes = 1024
+	conf.CoalesceDelay = 10 * time.Millisecond
+	conf.ConnectionWriteTimeout = 5 * time.Second
+	conn1, conn2 := testConn()
+	failing := &failingConn{ReadWriteCloser: conn1, gate: make(chan struct{})}
+	client, _ := Client(failing, conf)
+	server, _ := Server(conn2, testConfNoKeepAlive())
+	defer server.Close()
+	_ = captureLogs(client)
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The send loop is writing when the session closes, and fails
+	atomic.StoreInt32(&failing.fail, 1)
+	go stream.Write(make([]byte, 8*conf.MaxCoalesceBytes))
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(failing.gate)
+
+	// Close doesn't wait out the timeout
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("close blocked")
+	}
+	if err := client.SendError(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSession_CoalesceStats(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.MaxCoalesceBytes = 1024
+	conf.CoalesceDelay = 20 * time.Millisecond
+	conn1, conn2 := testConn()
+	counter := &countingConn{ReadWriteCloser: conn1}
+	client, _ := Client(counter, conf)
+	server, _ := Server(conn2, testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+
+	const frames = 100
+	writeFrames(t, client, server, frames, bytes.Repeat([]byte("0123456789"), 10))
+
+	// A write may still be in progress
+	deadline := time.Now().Add(time.Second)
+	stats := client.Stats()
+	for stats.CoalesceFlushes != uint64(atomic.LoadInt64(&counter.writes)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %d %d", stats.CoalesceFlushes, atomic.LoadInt64(&counter.writes))
+		}
+		time.Sleep(time.Millisecond)
+		stats = client.Stats()
+	}
+	if stats.FramesCoalesced < frames {
+		t.Fatalf("bad: %d", stats.FramesCoalesced)
+	}
+	if avg := float64(stats.FramesCoalesced) / float64(stats.CoalesceFlushes); stats.AvgFramesPerFlush != avg || avg <= 1 {
+		t.Fatalf("bad: %v", stats.AvgFramesPerFlush)
+	}
+
+	// Nothing is counted without coalescing
+	if stats := server.Stats(); stats.FramesCoalesced != 0 || stats.CoalesceFlushes != 0 || stats.AvgFramesPerFlush != 0 {
+		t.Fatalf("bad: %#v", stats)
+	}
+}
+
+func TestSession_BufferPool(t *testing.T) {
+	for _, strategy := range []RecvBufferStrategy{RecvBufferContiguous, RecvBufferRing} {
+		pool := NewBufferPool(0)
+		conf := testConfNoKeepAlive()
+		conf.RecvBufferStrategy = strategy
+		conf.BufferPool = pool
+		client, server := testClientServerConfig(conf)
+
+		for i := 0; i < 3; i++ {
+			stream, err := client.OpenStream()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if _, err := stream.Write(make([]byte, 1000)); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			stream.Close()
+			stream2, err := server.AcceptStream()
+			if err != nil {
 				t.Fatalf("err: %v", err)
 			}
+			if got, err := ioutil.ReadAll(stream2); err != nil || len(got) != 1000 {
+				t.Fatalf("bad: %d %v", len(got), err)
+			}
+			stream2.Close()
 		}
 
-		doPingOfDeath.Unlock()
-	}()
+		// The buffer handed back at EOF is reused by the next stream
+		s := pool.Stats()
+		if s.Gets != 3 || s.Puts != 3 || s.Misses != 1 || s.Retained == 0 {
+			t.Fatalf("bad: %+v", s)
+		}
+		client.Close()
+		server.Close()
+	}
+}
 
-	// The client will open a stream and then send the server a ping once it
-	// can no longer write. This makes sure the server doesn't deadlock reads
-	// while trying to reply to the ping with no ability to write.
-	go func() {
-		defer wg.Done()
+func TestSession_WaitGoAwayDrained(t *testing.T) {
+	client, server := testClientServerConfig(testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
 
-		stream, err := client.OpenStream()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Write([]byte("a")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Streams we opened don't hold up the wait
+	outbound, err := server.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer outbound.Close()
+
+	if err := server.GoAway(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.WaitGoAwayDrained(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		errCh <- server.WaitGoAwayDrained(context.Background())
+	}()
+	stream.Close()
+	stream2.Close()
+	select {
+	case err := <-errCh:
 		if err != nil {
 			t.Fatalf("err: %v", err)
 		}
-		defer stream.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not drained")
+	}
+	if d := time.Since(start); d < goAwayQuietPeriod {
+		t.Fatalf("quiet period not awaited: %v", d)
+	}
+}
 
-		// This ping will never unblock because the ping id will never
-		// show up in a response.
-		doPingOfDeath.Lock()
-		go func() { client.Ping() }()
+func TestSession_MinWindowUpdate(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.MinWindowUpdate = conf.MaxStreamWindowSize + 1
+	if err := VerifyConfig(conf); err == nil {
+		t.Fatalf("expected error")
+	}
 
-		// Wait for a while to make sure the previous ping times out,
-		// then turn writes back on and make sure a ping works again.
-		time.Sleep(2 * server.config.ConnectionWriteTimeout)
-		conn.writeBlocker.Unlock()
-		if _, err = client.Ping(); err != nil {
+	var lock sync.Mutex
+	var updates []uint32
+	serverConf := testConfNoKeepAlive()
+	serverConf.ReadAheadFactor = 1.0 / float64(serverConf.MaxStreamWindowSize)
+	serverConf.MinWindowUpdate = 1024
+	serverConf.TraceFunc = func(ev TraceEvent) {
+		if ev.Kind == TraceWindowUpdateSent && ev.StreamID != 0 && ev.Size != 0 {
+			lock.Lock()
+			updates = append(updates, ev.Size)
+			lock.Unlock()
+		}
+	}
+	conn1, conn2 := testConn()
+	client, _ := Client(conn1, testConfNoKeepAlive())
+	server, _ := Server(conn2, serverConf)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	const size = 10000
+	if _, err := stream.Write(make([]byte, size)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+
+	// Tiny reads return the credit in updates of at least the minimum
+	buf := make([]byte, 1)
+	for i := 0; i < size; i++ {
+		if _, err := stream2.Read(buf); err != nil {
 			t.Fatalf("err: %v", err)
 		}
-	}()
+	}
+	lock.Lock()
+	if len(updates) != size/1024 {
+		t.Fatalf("bad: %v", updates)
+	}
+	for _, u := range updates {
+		if u < 1024 {
+			t.Fatalf("bad: %v", updates)
+		}
+	}
+	lock.Unlock()
+}
 
-	wg.Wait()
+func TestSession_MinWindowUpdate_NoStall(t *testing.T) {
+	// Credit held back up to the whole window is still returned
+	conf := testConfNoKeepAlive()
+	conf.MinWindowUpdate = conf.MaxStreamWindowSize
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data := make([]byte, 3*conf.MaxStreamWindowSize)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(data)
+		stream.Close()
+		errCh <- err
+	}()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
+	buf := make([]byte, 100)
+	total := 0
+	for {
+		n, err := stream2.Read(buf)
+		total += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if total != len(data) {
+		t.Fatalf("bad: %d", total)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
 }
 
-func TestSession_ConnectionWriteTimeout(t *testing.T) {
-	client, server := testClientServerConfig(testConfNoKeepAlive())
+func TestStream_SetMaxReadChunk(t *testing.T) {
+	client, server := testClientServer()
 	defer client.Close()
 	defer server.Close()
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := stream.Write(data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream2.Close()
 
-	go func() {
-		defer wg.Done()
+	// Wait for all of the data to be buffered
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stream2.recvLock.Lock()
+		buffered := stream2.recvBuf != nil && stream2.recvBuf.Len() == len(data)
+		stream2.recvLock.Unlock()
+		if buffered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not buffered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
 
-		stream, err := server.AcceptStream()
+	stream2.SetMaxReadChunk(10)
+	var got []byte
+	buf := make([]byte, 64)
+	n, err := stream2.Read(buf)
+	if err != nil || n != 10 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	got = append(got, buf[:n]...)
+	n, more, err := stream2.ReadAvailable(buf)
+	if err != nil || n != 10 || !more {
+		t.Fatalf("bad: %d %v %v", n, more, err)
+	}
+	got = append(got, buf[:n]...)
+	bufs := [][]byte{make([]byte, 6), make([]byte, 6)}
+	if n, err := stream2.ReadVectored(bufs); err != nil || n != 10 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	got = append(got, bufs[0]...)
+	got = append(got, bufs[1][:4]...)
+
+	// Zero disables the cap
+	stream2.SetMaxReadChunk(0)
+	n, err = stream2.Read(buf)
+	if err != nil || n != 64 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	got = append(got, buf[:n]...)
+	n, err = stream2.Read(buf)
+	if err != nil || n != 6 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	got = append(got, buf[:n]...)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("bad: %v", got)
+	}
+}
+
+var errTransient = errors.New("resource temporarily unavailable")
+
+// flakyWriter writes half of every other write before failing it with
+// errTransient, or fails all writes once broken is set
+type flakyWriter struct {
+	io.ReadWriteCloser
+	calls  int32
+	broken int32
+}
+
+func (f *flakyWriter) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&f.broken) == 1 {
+		return 0, errTransient
+	}
+	if atomic.AddInt32(&f.calls, 1)%2 == 1 {
+		n, err := f.ReadWriteCloser.Write(b[:len(b)/2])
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			return n, err
 		}
-		defer stream.Close()
-	}()
+		return n, errTransient
+	}
+	return f.ReadWriteCloser.Write(b)
+}
 
-	// The client will open the stream and then block outbound writes, we'll
-	// tee up a write and make sure it eventually times out.
+func TestSession_WriteErrorClassifier(t *testing.T) {
+	conf := testConfNoKeepAlive()
+	conf.WriteErrorClassifier = func(err error) bool {
+		return err == errTransient
+	}
+	conn1, conn2 := testConn()
+	flaky := &flakyWriter{ReadWriteCloser: conn1}
+	client, _ := Client(flaky, conf)
+	server, _ := Server(conn2, testConfNoKeepAlive())
+	defer client.Close()
+	defer server.Close()
+	_ = captureLogs(client)
+
+	// Transient errors are retried
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	errCh := make(chan error, 1)
 	go func() {
-		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if _, err := stream.Write(data[i*1000 : (i+1)*1000]); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- stream.Close()
+	}()
+	stream2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	got, err := ioutil.ReadAll(stream2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("bad data")
+	}
+	if client.IsClosed() {
+		t.Fatalf("session closed")
+	}
 
-		stream, err := client.OpenStream()
-		if err != nil {
-			t.Fatalf("err: %v", err)
+	// Errors persisting past ConnectionWriteTimeout close the session
+	atomic.StoreInt32(&flaky.broken, 1)
+	if _, err := client.Ping(); err == nil {
+		t.Fatalf("expected error")
+	}
+	select {
+	case <-client.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session not closed")
+	}
+	if err := client.SendError(); err != errTransient {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSession_KeepAliveStats(t *testing.T) {
+	conf := testConf()
+	conf.KeepAliveInterval = 10 * time.Millisecond
+	client, server := testClientServerConfig(conf)
+	defer client.Close()
+	defer server.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.Stats().KeepAlivesSent < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no keepalives")
 		}
-		defer stream.Close()
+		time.Sleep(5 * time.Millisecond)
+	}
+	stats := client.Stats()
+	if stats.KeepAlivesFailed != 0 || stats.LastKeepAliveRTT <= 0 {
+		t.Fatalf("bad: %+v", stats)
+	}
+	if d := time.Since(stats.LastKeepAliveTime); d < 0 || d > time.Second {
+		t.Fatalf("bad: %v", stats.LastKeepAliveTime)
+	}
 
-		conn := client.conn.(*pipeConn)
-		conn.writeBlocker.Lock()
+	// Unanswered pings are counted as failures
+	conf.KeepAliveRetries = 1
+	conf.KeepAliveBackoff = time.Millisecond
+	conf.ConnectionWriteTimeout = 20 * time.Millisecond
+	conf.LogOutput = ioutil.Discard
+	conn1, conn2 := testConn()
+	go io.Copy(ioutil.Discard, conn2)
+	client2, _ := Client(conn1, conf)
+	defer client2.Close()
+	select {
+	case <-client2.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not closed")
+	}
+	stats = client2.Stats()
+	if stats.KeepAlivesSent != 2 || stats.KeepAlivesFailed != 2 {
+		t.Fatalf("bad: %+v", stats)
+	}
+	if stats.LastKeepAliveRTT != 0 || !stats.LastKeepAliveTime.IsZero() {
+		t.Fatalf("bad: %+v", stats)
+	}
+}
 
-		// Since the write goroutine is blocked then this will return a
-		// timeout since it can't get feedback about whether the write
-		// worked.
-		n, err := stream.Write([]byte("hello"))
-		if err != ErrConnectionWriteTimeout {
+func TestSession_KeepAliveMode(t *testing.T) {
+	conf := testConf()
+	conf.KeepAliveMode = KeepAliveOnIdleBoth + 1
+	if err := VerifyConfig(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	for _, mode := range []KeepAliveMode{KeepAliveAlways, KeepAliveOnIdleRecv, KeepAliveOnIdleBoth} {
+		conf := testConf()
+		conf.KeepAliveInterval = 50 * time.Millisecond
+		conf.KeepAliveMode = mode
+		conn1, conn2 := testConn()
+		client, _ := Client(conn1, conf)
+		server, _ := Server(conn2, testConfNoKeepAlive())
+
+		stream, err := server.OpenStream()
+		if err != nil {
 			t.Fatalf("err: %v", err)
 		}
-		if n != 0 {
-			t.Fatalf("lied about writes: %d", n)
+		go io.Copy(ioutil.Discard, stream)
+		stream2, err := client.AcceptStream()
+		if err != nil {
+			t.Fatalf("err: %v", err)
 		}
-	}()
+		go io.Copy(ioutil.Discard, stream2)
 
-	wg.Wait()
+		// Steady inbound traffic makes pings unnecessary
+		for i := 0; i < 60; i++ {
+			if _, err := stream.Write([]byte("x")); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if sent := client.Stats().KeepAlivesSent; (sent == 0) != (mode != KeepAliveAlways) {
+			t.Fatalf("bad: %d %d", mode, sent)
+		}
+
+		// Idle sessions are pinged in any mode
+		deadline := time.Now().Add(5 * time.Second)
+		for start := client.Stats().KeepAlivesSent; client.Stats().KeepAlivesSent == start; {
+			if time.Now().After(deadline) {
+				t.Fatalf("no keepalives: %d", mode)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		client.Close()
+		server.Close()
+	}
 }
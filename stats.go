@@ -0,0 +1,320 @@
+package yamux
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds counters of a session
+type Stats struct {
+	// BytesSent is the number of payload bytes sent
+	BytesSent uint64
+
+	// SendRate is the rate payload bytes were sent at during the
+	// last second, in bytes per second
+	SendRate int64
+
+	// StaleWindowUpdates is the number of window updates discarded
+	// because their stream was already closed
+	StaleWindowUpdates uint64
+
+	// OutstandingPings is the number of pings awaiting an answer, and
+	// UnansweredPings the number that timed out since the peer last
+	// answered one, see MaxOutstandingPings
+	OutstandingPings int
+	UnansweredPings  int
+
+	// StreamLockContended is how often the lock of the stream map was
+	// found held, and WriteLockContended and ReadLockContended how
+	// often that happened to the write and read locks of the streams,
+	// summed over all streams. High counts suggest spreading the
+	// traffic over more sessions. They are only counted if built with
+	// the yamux_lockstats tag, and are zero otherwise.
+	StreamLockContended uint64
+	WriteLockContended  uint64
+	ReadLockContended   uint64
+
+	// KeepAlivesSent is the number of keep alive pings sent by the
+	// keep alive loop, and KeepAlivesFailed the number of its rounds
+	// that failed, including retries and failed liveness checks
+	KeepAlivesSent   uint64
+	KeepAlivesFailed uint64
+
+	// LastKeepAliveRTT and LastKeepAliveTime are the RTT and time of
+	// the last keep alive ping that was answered, or zero if none was
+	LastKeepAliveRTT  time.Duration
+	LastKeepAliveTime time.Time
+
+	// FramesCoalesced is the number of frames sent with
+	// MaxCoalesceBytes set, and CoalesceFlushes the number of writes
+	// to the connection they took. AvgFramesPerFlush is the ratio of
+	// the two, the higher the more writes coalescing saved.
+	FramesCoalesced   uint64
+	CoalesceFlushes   uint64
+	AvgFramesPerFlush float64
+
+	// LoadFactor is the load of the session relative to the closest
+	// of LoadMaxStreams and LoadMaxMemory, or zero without them.
+	// Streams opened by the peer are refused from 1 on.
+	LoadFactor float64
+}
+
+// Stats returns the current counters of the session
+func (s *Session) Stats() Stats {
+	s.pingLock.Lock()
+	outstanding, unanswered := len(s.pings), s.missedPings
+	s.pingLock.Unlock()
+	frames, flushes := atomic.LoadUint64(&s.framesCoalesced), atomic.LoadUint64(&s.coalesceFlushes)
+	var avgFrames float64
+	if flushes > 0 {
+		avgFrames = float64(frames) / float64(flushes)
+	}
+	var lastKeepAlive time.Time
+	if last := atomic.LoadInt64(&s.lastKeepAliveTime); last != 0 {
+		lastKeepAlive = time.Unix(0, last)
+	}
+	return Stats{
+		BytesSent:           atomic.LoadUint64(&s.bytesSent),
+		SendRate:            s.sendMeter.rate(),
+		StaleWindowUpdates:  atomic.LoadUint64(&s.staleWindowUpdates),
+		OutstandingPings:    outstanding,
+		UnansweredPings:     unanswered,
+		StreamLockContended: atomic.LoadUint64(&s.streamLockContended),
+		WriteLockContended:  atomic.LoadUint64(&s.writeLockContended),
+		ReadLockContended:   atomic.LoadUint64(&s.readLockContended),
+		KeepAlivesSent:      atomic.LoadUint64(&s.keepAlivesSent),
+		KeepAlivesFailed:    atomic.LoadUint64(&s.keepAlivesFailed),
+		LastKeepAliveRTT:    time.Duration(atomic.LoadInt64(&s.lastKeepAliveRTT)),
+		LastKeepAliveTime:   lastKeepAlive,
+		FramesCoalesced:     frames,
+		CoalesceFlushes:     flushes,
+		AvgFramesPerFlush:   avgFrames,
+		LoadFactor:          s.loadFactor(),
+	}
+}
+
+// loadFactor measures the load of the session against the high-water
+// marks of the config, see LoadMaxStreams
+func (s *Session) loadFactor() float64 {
+	maxStreams, maxMemory := s.config.LoadMaxStreams, s.config.LoadMaxMemory
+	if maxStreams == 0 && maxMemory == 0 {
+		return 0
+	}
+
+	lockCounted(&s.streamLock, &s.streamLockContended)
+	var streams []*Stream
+	if maxMemory > 0 {
+		streams = make([]*Stream, 0, len(s.streams))
+		for _, stream := range s.streams {
+			streams = append(streams, stream)
+		}
+	}
+	num := len(s.streams)
+	s.streamLock.Unlock()
+
+	var factor float64
+	if maxStreams > 0 {
+		factor = float64(num) / float64(maxStreams)
+	}
+	if maxMemory > 0 {
+		var buffered int64
+		for _, stream := range streams {
+			stream.recvLock.Lock()
+			if stream.recvBuf != nil {
+				buffered += int64(stream.recvBuf.Len())
+			}
+			stream.recvLock.Unlock()
+		}
+		if f := float64(buffered) / float64(maxMemory); f > factor {
+			factor = f
+		}
+	}
+	return factor
+}
+
+// rateMeter measures the rate over the last second. It counts in
+// intervals of a second and weighs in the previous interval by how much
+// of it is within the last second.
+type rateMeter struct {
+	mu    sync.Mutex
+	start time.Time // start of the current interval
+	count int64     // bytes in the current interval
+	prev  int64     // bytes in the previous interval
+}
+
+// add records n bytes
+func (m *rateMeter) add(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roll(time.Now())
+	m.count += n
+}
+
+// rate returns the bytes per second over the last second
+func (m *rateMeter) rate() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.roll(now)
+	frac := now.Sub(m.start).Seconds()
+	return m.count + int64(float64(m.prev)*(1-frac))
+}
+
+// roll starts a new interval once the current one is over. The lock
+// must be held.
+func (m *rateMeter) roll(now time.Time) {
+	switch elapsed := now.Sub(m.start); {
+	case elapsed < time.Second:
+	case elapsed < 2*time.Second:
+		m.prev = m.count
+		m.count = 0
+		m.start = m.start.Add(time.Second)
+	default:
+		m.prev = 0
+		m.count = 0
+		m.start = now
+	}
+}
+
+// StreamSummary describes a closed stream
+type StreamSummary struct {
+	ID uint32
+
+	// BytesSent and BytesReceived are the payload bytes of the stream
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// Opened is the time the stream was opened or accepted, and
+	// Duration how long it was open
+	Opened   time.Time
+	Duration time.Duration
+
+	// State is the state the stream ended in, StreamClosed if both
+	// sides closed it or StreamReset if it was reset
+	State StreamState
+}
+
+// RecentlyClosed returns the summaries of the last closed streams, as
+// many as ClosedStreamHistory, in the order they were closed.
+func (s *Session) RecentlyClosed() []StreamSummary {
+	if s.closed == nil {
+		return nil
+	}
+	return s.closed.list()
+}
+
+// summary returns the summary of the stream
+func (s *Stream) summary() StreamSummary {
+	return StreamSummary{
+		ID:            s.id,
+		BytesSent:     atomic.LoadUint64(&s.bytesSent),
+		BytesReceived: atomic.LoadUint64(&s.bytesRecv),
+		Opened:        s.created,
+		Duration:      s.Age(),
+		State:         s.State(),
+	}
+}
+
+// StreamFlowState is the flow control state of a stream
+type StreamFlowState struct {
+	ID uint32
+
+	// SendWindow is the credit the peer granted us, and RecvWindow the
+	// credit we granted the peer
+	SendWindow uint32
+	RecvWindow uint32
+
+	// Buffered is the number of received bytes not read yet
+	Buffered int
+
+	// Blocked is set while a write waits for the peer to extend the
+	// send window
+	Blocked bool
+
+	// ReadsPaused is set while PauseReads holds back credit
+	ReadsPaused bool
+
+	// QueuedFrames is the number of data frames buffered since the
+	// receive buffer was last empty, see MaxQueuedFramesPerStream
+	QueuedFrames int
+
+	// PeerPaused is set while the peer paused the stream, see
+	// EnableStreamPause
+	PeerPaused bool
+}
+
+// FlowControlSnapshot returns the flow control state of the open
+// streams, ordered by stream ID
+func (s *Session) FlowControlSnapshot() []StreamFlowState {
+	lockCounted(&s.streamLock, &s.streamLockContended)
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.streamLock.Unlock()
+
+	states := make([]StreamFlowState, len(streams))
+	for i, stream := range streams {
+		states[i] = stream.flowState()
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	return states
+}
+
+func (s *Stream) flowState() StreamFlowState {
+	state := StreamFlowState{
+		ID:         s.id,
+		SendWindow: atomic.LoadUint32(&s.sendWindow),
+		Blocked:    atomic.LoadInt32(&s.windowWaiters) > 0,
+		PeerPaused: s.PeerPaused(),
+	}
+	s.recvLock.Lock()
+	state.RecvWindow = s.recvWindow
+	if s.recvBuf != nil {
+		state.Buffered = s.recvBuf.Len()
+	}
+	state.ReadsPaused = s.readsPaused
+	state.QueuedFrames = s.queuedFrames
+	s.recvLock.Unlock()
+	return state
+}
+
+// streamHistory is a ring buffer of stream summaries
+type streamHistory struct {
+	mu    sync.Mutex
+	ring  []StreamSummary
+	next  int
+	count int
+}
+
+func newStreamHistory(n int) *streamHistory {
+	return &streamHistory{ring: make([]StreamSummary, n)}
+}
+
+// add records a summary, replacing the oldest one if full
+func (h *streamHistory) add(sum StreamSummary) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ring[h.next] = sum
+	h.next = (h.next + 1) % len(h.ring)
+	if h.count < len(h.ring) {
+		h.count++
+	}
+}
+
+// list returns a copy of the summaries, oldest first
+func (h *streamHistory) list() []StreamSummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]StreamSummary, 0, h.count)
+	start := h.next - h.count
+	if start < 0 {
+		start += len(h.ring)
+	}
+	for i := 0; i < h.count; i++ {
+		out = append(out, h.ring[(start+i)%len(h.ring)])
+	}
+	return out
+}
@@ -2,40 +2,175 @@ package yamux
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-type streamState int
+// StreamState is the state of a stream in its lifecycle.
+type StreamState int
 
 const (
-	streamInit streamState = iota
-	streamSYNSent
-	streamSYNReceived
-	streamEstablished
-	streamLocalClose
-	streamRemoteClose
-	streamClosed
-	streamReset
+	StreamInit StreamState = iota
+	StreamSYNSent
+	StreamSYNReceived
+	StreamEstablished
+	StreamLocalClose
+	StreamRemoteClose
+	StreamClosed
+	StreamReset
 )
 
+var streamStateNames = []string{
+	StreamInit:        "Init",
+	StreamSYNSent:     "SYNSent",
+	StreamSYNReceived: "SYNReceived",
+	StreamEstablished: "Established",
+	StreamLocalClose:  "LocalClose",
+	StreamRemoteClose: "RemoteClose",
+	StreamClosed:      "Closed",
+	StreamReset:       "Reset",
+}
+
+func (s StreamState) String() string {
+	if s < 0 || int(s) >= len(streamStateNames) {
+		return fmt.Sprintf("StreamState(%d)", int(s))
+	}
+	return streamStateNames[s]
+}
+
 // Stream is used to represent a logical stream
 // within a session.
 type Stream struct {
+	// bytesSent and bytesRecv count the payload bytes of the stream.
+	// Must be first for alignment.
+	bytesSent uint64
+	bytesRecv uint64
+
+	// idleTimeout and lastActive are the idle timeout of the stream
+	// and the UnixNano time of its last read or write while one is
+	// set, see SetIdleTimeout. Both are accessed atomically.
+	idleTimeout int64
+	lastActive  int64
+
 	recvWindow uint32
 	sendWindow uint32
 
+	// unacked is the number of sent bytes that the peer has not
+	// returned credit for, tracked if MaxSendBuffer is set.
+	unacked uint32
+
+	// weight is the share of the connection bandwidth of the stream
+	// relative to other streams, see SetWeight.
+	weight uint32
+
+	// maxReadChunk caps the bytes returned by a read, see
+	// SetMaxReadChunk. It is accessed atomically.
+	maxReadChunk int32
+
+	// windowWaiters is the number of writes waiting for the peer to
+	// extend the send window, accessed atomically.
+	windowWaiters int32
+
+	// peerPaused is set while the peer paused the stream, accessed
+	// atomically.
+	peerPaused int32
+
+	// pauseLock orders the pause frames we send, see sendPause
+	pauseLock sync.Mutex
+
 	id      uint32
 	session *Session
 
-	state     streamState
+	// created is the time the stream was opened or accepted
+	created time.Time
+
+	// limiter caps the send rate of the stream, see SetRateLimit
+	limiter rateLimiter
+
+	// header is the metadata sent by the peer when opening the
+	// stream. It is set before the stream is accepted.
+	header []byte
+
+	// userData holds a userData set by SetUserData
+	userData atomic.Value
+
+	state     StreamState
 	stateLock sync.Mutex
 
-	recvBuf  *bytes.Buffer
+	// writeClosed is set once we sent a FIN, and peerClosed once we
+	// received one. readClosed is set by CloseRead. All are protected
+	// by stateLock.
+	writeClosed bool
+	peerClosed  bool
+	readClosed  bool
+
+	// discardRecv is set if the data buffered when the session closed
+	// is dropped, see PreserveDataOnClose. It is protected by
+	// stateLock.
+	discardRecv bool
+
+	// acked is set once the stream is established with the peer, and
+	// establishCh is closed once it is or the handshake failed. Both
+	// are protected by stateLock.
+	acked       bool
+	establishCh chan struct{}
+
+	// approvalPending is set while the stream awaits Approve, which
+	// has to happen before approvalTimer fires. Both are protected by
+	// stateLock.
+	approvalPending bool
+	approvalTimer   *time.Timer
+
+	// ctxErr is the error of the context that reset the stream, see
+	// SetContext, ErrStreamIdle or ErrPeerOverloaded. It is protected
+	// by stateLock.
+	ctxErr error
+
+	// rstCode is the length of the RST window update that reset the
+	// stream, e.g. rstBacklog. It is protected by stateLock.
+	rstCode uint32
+
+	// idleTimer fires once the stream may be idle, protected by
+	// idleLock
+	idleTimer *time.Timer
+	idleLock  sync.Mutex
+
+	// doneCh is closed once the stream is removed from the session,
+	// which happened at removed
+	doneCh   chan struct{}
+	doneOnce sync.Once
+	removed  time.Time
+
+	recvBuf  recvBuffer
 	recvLock sync.Mutex
 
+	// readsPaused holds back window updates, see PauseReads. It is
+	// protected by recvLock.
+	readsPaused bool
+
+	// queuedFrames is the number of data frames buffered since the
+	// receive buffer was last empty, see MaxQueuedFramesPerStream. It
+	// is protected by recvLock.
+	queuedFrames int
+
+	// highWater is the number of buffered bytes at which highWaterFn
+	// is called, see SetHighWaterCallback. Both are protected by
+	// recvLock.
+	highWater   uint32
+	highWaterFn func()
+
+	// spareFlags accumulates the spare flags of received data frames
+	// until the next read moves them to readFlags, see LastReadFlags.
+	// Both are protected by recvLock.
+	spareFlags uint16
+	readFlags  uint16
+
 	controlHdr     header
 	controlErr     chan error
 	controlHdrLock sync.Mutex
@@ -44,8 +179,24 @@ type Stream struct {
 	sendErr  chan error
 	sendLock sync.Mutex
 
+	// delayWrites is set to buffer small writes, see SetNoDelay. It
+	// is accessed atomically. writeBuf holds the buffered data until
+	// flushTimer fires, and flushErr the error of a failed background
+	// flush. They are protected by sendLock.
+	delayWrites int32
+	writeBuf    []byte
+	flushTimer  *time.Timer
+	flushErr    error
+
+	// ackSem bounds the writes queued by WriteWithAck, and ackTail is
+	// closed once the last one is done. Both are protected by ackLock.
+	ackSem  chan struct{}
+	ackTail chan struct{}
+	ackLock sync.Mutex
+
 	recvNotifyCh chan struct{}
 	sendNotifyCh chan struct{}
+	writableCh   chan struct{}
 
 	readDeadline  pipeDeadline
 	writeDeadline pipeDeadline
@@ -53,10 +204,11 @@ type Stream struct {
 
 // newStream is used to construct a new stream within
 // a given session for an ID
-func newStream(session *Session, id uint32, state streamState) *Stream {
+func newStream(session *Session, id uint32, state StreamState) *Stream {
 	s := &Stream{
 		id:            id,
 		session:       session,
+		created:       time.Now(),
 		state:         state,
 		controlHdr:    header(make([]byte, headerSize)),
 		controlErr:    make(chan error, 1),
@@ -66,9 +218,20 @@ func newStream(session *Session, id uint32, state streamState) *Stream {
 		sendWindow:    initialStreamWindow,
 		recvNotifyCh:  make(chan struct{}, 1),
 		sendNotifyCh:  make(chan struct{}, 1),
+		writableCh:    make(chan struct{}, 1),
+		establishCh:   make(chan struct{}),
+		doneCh:        make(chan struct{}),
 		readDeadline:  makePipeDeadline(),
 		writeDeadline: makePipeDeadline(),
 	}
+	if state == StreamSYNReceived {
+		// We are acknowledging the stream
+		s.acked = true
+		close(s.establishCh)
+	}
+	if d := session.config.DefaultStreamIdleTimeout; d > 0 {
+		s.SetIdleTimeout(d)
+	}
 	return s
 }
 
@@ -82,8 +245,292 @@ func (s *Stream) StreamID() uint32 {
 	return s.id
 }
 
-// Read is used to read from the stream
+// CreatedAt returns the time the stream was opened or accepted
+func (s *Stream) CreatedAt() time.Time {
+	return s.created
+}
+
+// Age returns how long ago the stream was opened or accepted. Once the
+// stream is closed, it is the time the stream lived.
+func (s *Stream) Age() time.Duration {
+	if isClosedChan(s.doneCh) {
+		return s.removed.Sub(s.created)
+	}
+	return time.Since(s.created)
+}
+
+// SendWindow returns how many bytes the peer currently allows us to
+// send before it grants more window
+func (s *Stream) SendWindow() uint32 {
+	return atomic.LoadUint32(&s.sendWindow)
+}
+
+// userData wraps the value of SetUserData, since an atomic.Value
+// can't hold nil or values of different types
+type userData struct {
+	value interface{}
+}
+
+// SetUserData attaches an arbitrary value to the stream, for instance
+// state parsed by a routing layer, which UserData returns. It is safe
+// to call concurrently with UserData.
+func (s *Stream) SetUserData(v interface{}) {
+	s.userData.Store(userData{v})
+}
+
+// UserData returns the value set by SetUserData, or nil
+func (s *Stream) UserData() interface{} {
+	if v, ok := s.userData.Load().(userData); ok {
+		return v.value
+	}
+	return nil
+}
+
+// Header returns the metadata the peer attached when opening the
+// stream with OpenStreamWithHeader, or nil if there was none.
+func (s *Stream) Header() []byte {
+	return s.header
+}
+
+// State returns the current state of the stream. It reflects
+// transitions caused by FIN and RST frames as soon as they have
+// been processed.
+func (s *Stream) State() StreamState {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.state
+}
+
+// SetWeight sets the share of the connection bandwidth the stream
+// gets when other streams are sending as well. A stream of weight 2
+// is sent twice as much data as a stream of weight 1. A weight of 0
+// resets it to the default of 1.
+func (s *Stream) SetWeight(w uint32) {
+	atomic.StoreUint32(&s.weight, w)
+}
+
+// Weight returns the weight of the stream, see SetWeight.
+func (s *Stream) Weight() uint32 {
+	if w := atomic.LoadUint32(&s.weight); w != 0 {
+		return w
+	}
+	return 1
+}
+
+// SetRateLimit limits the rate the stream sends data at to bytesPerSec,
+// so Write blocks, up to the write deadline, while the stream exceeds
+// it. Bursts of up to one second worth of data are allowed after the
+// stream was idle. Zero removes the limit.
+func (s *Stream) SetRateLimit(bytesPerSec int64) {
+	s.limiter.set(bytesPerSec)
+	asyncNotify(s.sendNotifyCh)
+}
+
+// PauseReads stops returning window credit to the peer, so it can only
+// send what's left of the window it was granted, while reading the
+// buffered data continues. This applies backpressure to a single
+// stream, e.g. while the consumer of its data is saturated. If
+// EnableStreamPause is in use, the peer is told to stop writing
+// altogether until ResumeReads. It doesn't block, so it may be called
+// from the callback set with SetHighWaterCallback.
+func (s *Stream) PauseReads() {
+	s.recvLock.Lock()
+	paused := s.readsPaused
+	s.readsPaused = true
+	s.recvLock.Unlock()
+	if !paused {
+		if err := s.sendPause(pauseStream); err != nil {
+			s.session.logger.Printf("[WARN] yamux: failed to pause stream %d: %v", s.id, err)
+		}
+	}
+}
+
+// ResumeReads returns the credit held back since PauseReads, so the
+// peer can send again.
+func (s *Stream) ResumeReads() error {
+	s.recvLock.Lock()
+	paused := s.readsPaused
+	s.readsPaused = false
+	s.recvLock.Unlock()
+	if paused {
+		if err := s.sendPause(resumeStream); err != nil {
+			return err
+		}
+	}
+	return s.sendWindowUpdate()
+}
+
+// PeerPaused checks if the peer paused the stream with PauseReads.
+// Writes block until it resumes, so a writer may as well release its
+// resources in the meantime. It is always false unless
+// EnableStreamPause is in use with the peer.
+func (s *Stream) PeerPaused() bool {
+	return atomic.LoadInt32(&s.peerPaused) == 1
+}
+
+// sendPause tells the peer to pause or resume writing, if extPause is
+// in use. It doesn't block, as PauseReads may be called by the recv
+// loop from the high-water callback: if the send queue is full, the
+// frame is left to the send loop.
+func (s *Stream) sendPause(code uint32) error {
+	if !s.session.hasExtension(extPause) {
+		return nil
+	}
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	// Keep the frames in order behind one still pending
+	if s.session.pauses.update(s.id, code) {
+		return nil
+	}
+	flags := s.sendFlags()
+	hdr := header(make([]byte, headerSize))
+	hdr.encode(typeWindowUpdate, flags|flagEXT, s.id, code)
+	select {
+	case s.session.sendCh <- sendReady{Hdr: hdr}:
+	case <-s.session.shutdownCh:
+		return ErrSessionShutdown
+	default:
+		s.session.pauses.add(s.id, flags, code)
+	}
+	return nil
+}
+
+// SetHighWaterCallback sets cb to be called whenever the buffered
+// inbound data reaches the given fraction of the receive window, e.g.
+// to detect slow consumers before the peer stalls on the window. It's
+// called again after the buffer drained below the mark and reached it
+// again. The callback is run by the recv loop, so it must not block. A
+// nil cb or a fraction of zero removes the callback.
+func (s *Stream) SetHighWaterCallback(fraction float64, cb func()) {
+	if fraction > 1 {
+		fraction = 1
+	}
+	s.recvLock.Lock()
+	defer s.recvLock.Unlock()
+	if cb == nil || fraction <= 0 {
+		s.highWater, s.highWaterFn = 0, nil
+		return
+	}
+	s.highWater = uint32(math.Ceil(fraction * float64(s.session.config.MaxStreamWindowSize)))
+	s.highWaterFn = cb
+}
+
+// LastReadFlags returns the spare flags, i.e. bits 9 to 15, of the data
+// frames that arrived between the previous and the last successful
+// Read, for experimental protocols signaling on top of yamux. Reads
+// don't follow frame boundaries, so the flags may belong to data that
+// is still buffered. The other flags are consumed by yamux and never
+// reported. It is always zero unless ExposeSpareFlags is set.
+func (s *Stream) LastReadFlags() uint16 {
+	s.recvLock.Lock()
+	defer s.recvLock.Unlock()
+	return s.readFlags
+}
+
+// Read is used to read from the stream. Data that was received before
+// the stream or its session was closed is still returned, followed by
+// io.EOF. A reset stream drops its buffered data, as does a closed
+// session unless PreserveDataOnClose is set.
 func (s *Stream) Read(b []byte) (n int, err error) {
+	b = s.readChunk(b)
+	return s.read(func(buf recvBuffer) int {
+		n, _ := buf.Read(b)
+		return n
+	})
+}
+
+// SetMaxReadChunk caps the bytes a single read returns at n, however
+// much is buffered and fits into the buffers passed to it. This lets a
+// proxy copying many streams in turn interleave them evenly. Zero or
+// a negative n disables the cap.
+func (s *Stream) SetMaxReadChunk(n int) {
+	if n < 0 || n > math.MaxInt32 {
+		n = 0
+	}
+	atomic.StoreInt32(&s.maxReadChunk, int32(n))
+}
+
+// readChunk shortens b to the cap set by SetMaxReadChunk
+func (s *Stream) readChunk(b []byte) []byte {
+	if max := int(atomic.LoadInt32(&s.maxReadChunk)); max > 0 && len(b) > max {
+		return b[:max]
+	}
+	return b
+}
+
+// ReadAvailable reads like Read, and also reports whether more data
+// is buffered, so a following call returns without blocking. This
+// allows draining a burst of data in a loop without blocking at its
+// end.
+func (s *Stream) ReadAvailable(b []byte) (n int, more bool, err error) {
+	b = s.readChunk(b)
+	n, err = s.read(func(buf recvBuffer) int {
+		n, _ := buf.Read(b)
+		more = buf.Len() > 0
+		return n
+	})
+	return n, more, err
+}
+
+// ReadVectored is used to read from the stream into multiple
+// buffers. The buffers are filled in order from the receive buffer
+// in a single locked operation, so a single call may span several
+// frames worth of data. Deadlines and EOF are handled as in Read.
+func (s *Stream) ReadVectored(bufs [][]byte) (n int, err error) {
+	max := int(atomic.LoadInt32(&s.maxReadChunk))
+	return s.read(func(buf recvBuffer) int {
+		total := 0
+		for _, b := range bufs {
+			if buf.Len() == 0 {
+				break
+			}
+			if max > 0 {
+				if total == max {
+					break
+				}
+				if len(b) > max-total {
+					b = b[:max-total]
+				}
+			}
+			n, _ := buf.Read(b)
+			total += n
+		}
+		return total
+	})
+}
+
+// DrainInbound reads and discards up to limit bytes, or until EOF if
+// limit is negative, returning credit to the peer as it goes so it
+// isn't stalled. It returns the number of discarded bytes and a nil
+// error once it reached EOF or the limit. The read deadline applies.
+// This consumes a request body before answering with an error
+// without holding it in memory.
+func (s *Stream) DrainInbound(limit int64) (int64, error) {
+	var total int64
+	for limit < 0 || total < limit {
+		n, err := s.read(func(buf recvBuffer) int {
+			n := int64(buf.Len())
+			if limit >= 0 && n > limit-total {
+				n = limit - total
+			}
+			n, _ = io.CopyN(ioutil.Discard, buf, n)
+			return int(n)
+		})
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// read blocks until data is available in the receive buffer and then
+// invokes fill with the recvLock held to copy it out.
+func (s *Stream) read(fill func(recvBuffer) int) (n int, err error) {
 	defer asyncNotify(s.recvNotifyCh)
 
 	if isClosedChan(s.readDeadline.wait()) {
@@ -92,33 +539,51 @@ func (s *Stream) Read(b []byte) (n int, err error) {
 
 	for {
 		s.stateLock.Lock()
+		if s.readClosed {
+			s.stateLock.Unlock()
+			return 0, io.EOF
+		}
+		if s.approvalPending {
+			s.stateLock.Unlock()
+			return 0, ErrStreamNotApproved
+		}
 		switch s.state {
-		case streamLocalClose:
+		case StreamLocalClose:
 			fallthrough
-		case streamRemoteClose:
+		case StreamRemoteClose:
 			fallthrough
-		case streamClosed:
+		case StreamClosed:
 			s.recvLock.Lock()
-			if s.recvBuf == nil || s.recvBuf.Len() == 0 {
+			if s.discardRecv || s.recvBuf == nil || s.recvBuf.Len() == 0 {
+				s.dropRecvBuf()
 				s.recvLock.Unlock()
 				s.stateLock.Unlock()
 				return 0, io.EOF
 			}
 			s.recvLock.Unlock()
-		case streamReset:
+		case StreamReset:
+			s.recvLock.Lock()
+			s.dropRecvBuf()
+			s.recvLock.Unlock()
+			err := s.resetErr()
 			s.stateLock.Unlock()
-			return 0, ErrConnectionReset
+			return 0, err
 		}
 		s.stateLock.Unlock()
 
 		// If there is no data available, block
-		s.recvLock.Lock()
+		lockCounted(&s.recvLock, &s.session.readLockContended)
 		if s.recvBuf == nil || s.recvBuf.Len() == 0 {
 			s.recvLock.Unlock()
 		} else {
 			// Read any bytes
-			n, _ = s.recvBuf.Read(b)
+			n = fill(s.recvBuf)
+			s.readFlags, s.spareFlags = s.spareFlags, 0
+			if s.recvBuf.Len() == 0 {
+				s.queuedFrames = 0
+			}
 			s.recvLock.Unlock()
+			s.active()
 
 			// Send a window update potentially
 			err = s.sendWindowUpdate()
@@ -134,10 +599,20 @@ func (s *Stream) Read(b []byte) (n int, err error) {
 	}
 }
 
-// Write is used to write to the stream
+// Write is used to write to the stream. With SetNoDelay(false), small
+// writes are buffered and reported as written right away, see
+// SetNoDelay.
 func (s *Stream) Write(b []byte) (n int, err error) {
-	s.sendLock.Lock()
+	lockCounted(&s.sendLock, &s.session.writeLockContended)
 	defer s.sendLock.Unlock()
+	if atomic.LoadInt32(&s.delayWrites) == 1 {
+		return s.bufferWrite(b)
+	}
+	return s.writeAll(b)
+}
+
+// writeAll writes all of b, or fails. The sendLock must be held.
+func (s *Stream) writeAll(b []byte) (int, error) {
 	total := 0
 	for total < len(b) {
 		n, err := s.write(b[total:])
@@ -149,6 +624,162 @@ func (s *Stream) Write(b []byte) (n int, err error) {
 	return total, nil
 }
 
+// SetNoDelay controls whether writes are sent right away, which is
+// the default. With noDelay false, small writes are buffered into
+// larger frames like with Nagle's algorithm, which suits bulk
+// transfers. Buffered data is sent once the initial stream window of
+// 256KB is collected, after a short delay, or on Flush and Close. An
+// error sending it is returned by the next Write, Flush or Close.
+// Setting noDelay flushes the buffered data.
+func (s *Stream) SetNoDelay(noDelay bool) error {
+	lockCounted(&s.sendLock, &s.session.writeLockContended)
+	defer s.sendLock.Unlock()
+	if !noDelay {
+		atomic.StoreInt32(&s.delayWrites, 1)
+		return nil
+	}
+	atomic.StoreInt32(&s.delayWrites, 0)
+	return s.flushWrites()
+}
+
+// Flush sends the data buffered because of SetNoDelay(false). It
+// returns once the data is written, or with the error of a background
+// flush that failed.
+func (s *Stream) Flush() error {
+	lockCounted(&s.sendLock, &s.session.writeLockContended)
+	defer s.sendLock.Unlock()
+	return s.flushWrites()
+}
+
+// WriteWithAck queues b to be written in the background, returning a
+// channel that receives the result once all of b was handed to the
+// underlying connection, or writing failed. This allows pipelining
+// writes while still learning when each of them left. b is copied, so
+// it can be reused right away. Writes queued by WriteWithAck are sent
+// in order after data buffered by earlier Writes, but plain Writes may
+// get ahead of queued ones. The write deadline applies while queued
+// writes are sent, and Close waits for them before sending the FIN.
+//
+// At most 64 writes may await their result; further calls block until
+// one completes, the write deadline passes or the stream is removed.
+// If b couldn't be queued, n is zero and the channel holds the error.
+func (s *Stream) WriteWithAck(b []byte) (n int, acked <-chan error) {
+	ackCh := make(chan error, 1)
+	s.ackLock.Lock()
+	if s.ackSem == nil {
+		s.ackSem = make(chan struct{}, maxPendingAcks)
+	}
+	sem := s.ackSem
+	s.ackLock.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+	case <-s.writeDeadline.wait():
+		ackCh <- ErrTimeout
+		return 0, ackCh
+	case <-s.doneCh:
+		ackCh <- ErrStreamClosed
+		return 0, ackCh
+	}
+
+	// Send after the previously queued write
+	data := append([]byte(nil), b...)
+	done := make(chan struct{})
+	s.ackLock.Lock()
+	prev := s.ackTail
+	s.ackTail = done
+	s.ackLock.Unlock()
+	go func() {
+		defer func() { <-sem }()
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		lockCounted(&s.sendLock, &s.session.writeLockContended)
+		err := s.flushWrites()
+		if err == nil {
+			_, err = s.writeAll(data)
+		}
+		s.sendLock.Unlock()
+		ackCh <- err
+	}()
+	return len(b), ackCh
+}
+
+// bufferWrite buffers b, sending the buffer once it holds a full
+// frame. The sendLock must be held.
+func (s *Stream) bufferWrite(b []byte) (int, error) {
+	if err := s.flushErr; err != nil {
+		s.flushErr = nil
+		return 0, err
+	}
+	s.stateLock.Lock()
+	err := s.writeErr()
+	s.stateLock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	buffered := len(s.writeBuf)
+	s.writeBuf = append(s.writeBuf, b...)
+	// Send a frame as large as any peer's initial window
+	if uint32(len(s.writeBuf)) < initialStreamWindow {
+		if s.flushTimer == nil {
+			s.flushTimer = time.AfterFunc(writeFlushDelay, s.flushLater)
+		}
+		return len(b), nil
+	}
+
+	// Report the buffered bytes as written by earlier calls
+	buf := s.writeBuf
+	s.stopFlushTimer()
+	n, err := s.writeAll(buf)
+	if n -= buffered; n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// flushWrites sends the buffered data, if any. The sendLock must be
+// held.
+func (s *Stream) flushWrites() error {
+	if err := s.flushErr; err != nil {
+		s.flushErr = nil
+		return err
+	}
+	if len(s.writeBuf) == 0 {
+		return nil
+	}
+	buf := s.writeBuf
+	s.stopFlushTimer()
+	_, err := s.writeAll(buf)
+	return err
+}
+
+// stopFlushTimer stops the flush timer and releases the write buffer
+// to be sent. The sendLock must be held.
+func (s *Stream) stopFlushTimer() {
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	s.writeBuf = nil
+}
+
+// flushLater is invoked by the flush timer
+func (s *Stream) flushLater() {
+	lockCounted(&s.sendLock, &s.session.writeLockContended)
+	defer s.sendLock.Unlock()
+	if len(s.writeBuf) == 0 {
+		return
+	}
+	buf := s.writeBuf
+	s.stopFlushTimer()
+	if _, err := s.writeAll(buf); err != nil {
+		s.flushErr = err
+	}
+}
+
 // write is used to write to the stream, may return on
 // a short write.
 func (s *Stream) write(b []byte) (n int, err error) {
@@ -162,48 +793,162 @@ func (s *Stream) write(b []byte) (n int, err error) {
 
 	for {
 		s.stateLock.Lock()
-		switch s.state {
-		case streamLocalClose:
-			fallthrough
-		case streamClosed:
-			s.stateLock.Unlock()
-			return 0, ErrStreamClosed
-		case streamReset:
-			s.stateLock.Unlock()
-			return 0, ErrConnectionReset
-		}
+		err = s.writeErr()
 		s.stateLock.Unlock()
+		if err != nil {
+			return 0, err
+		}
 
 		// If there is no data available, block
-		window := atomic.LoadUint32(&s.sendWindow)
+		var bufferCh <-chan struct{}
+		var limitCh <-chan time.Time
+		avail := atomic.LoadUint32(&s.sendWindow)
+		if s.PeerPaused() {
+			avail = 0
+		}
+		window, wait := s.limiter.allow(min(avail, uint32(len(b))))
+		if wait > 0 {
+			limitCh = time.After(wait)
+		}
 		if window != 0 {
+			max, bufferCh = s.session.reserveSendBuffer(window)
+		}
+		if window != 0 && max == 0 && s.session.config.FailFastOnSendBufferFull {
+			return 0, ErrSendBufferFull
+		}
+		if max != 0 {
 			// Determine the flags if any
 			flags = s.sendFlags()
 
-			// Send up to our send window
-			max = min(window, uint32(len(b)))
-			body = bytes.NewReader(b[:max])
+			// Track the bytes until the peer credits them back
+			if s.session.config.MaxSendBuffer > 0 {
+				atomic.AddUint32(&s.unacked, max)
+			}
+
+			// Send up to our send window and send buffer
+			payload, encoded := s.session.encodePayload(b[:max])
+			if encoded {
+				flags |= flagCMP
+			}
+			body = bytes.NewReader(payload)
 
 			// Send the header
-			s.sendHdr.encode(typeData, flags, s.id, max)
-			if err = s.session.waitForSendErr(s.sendHdr, body, s.sendErr); err != nil {
-				return 0, err
+			s.sendHdr.encode(typeData, flags, s.id, uint32(len(payload)))
+			ticket := &sendTicket{}
+			ready := sendReady{
+				Hdr:      s.sendHdr,
+				Body:     body,
+				Err:      s.sendErr,
+				Weight:   s.Weight(),
+				Ticket:   ticket,
+				Deadline: s.writeDeadline.wait(),
+			}
+			if err = s.session.waitForSendReady(ready); err != nil {
+				// The send loop may still hold the header
+				s.sendHdr = header(make([]byte, headerSize))
+
+				// Account for the parts sent before the frame was
+				// canceled. Encoded frames are never split.
+				var sent uint32
+				if atomic.LoadInt32(&ticket.state) == ticketCanceled {
+					if sent = atomic.LoadUint32(&ticket.sent); sent != 0 && encoded {
+						sent = max
+					}
+				}
+				if sent != 0 {
+					atomic.AddUint32(&s.sendWindow, ^uint32(sent-1))
+					atomic.AddUint64(&s.bytesSent, uint64(sent))
+					s.limiter.consume(sent)
+				}
+				s.session.releaseSendBuffer(s.releaseUnacked(max - sent))
+				return int(sent), err
 			}
 
 			// Reduce our send window
 			atomic.AddUint32(&s.sendWindow, ^uint32(max-1))
+			atomic.AddUint64(&s.bytesSent, uint64(max))
+			s.limiter.consume(max)
+			s.active()
 
 			// Unlock
 			return int(max), err
 		}
 
+		// Flag the wait on the send window for FlowControlSnapshot
+		blocked := avail == 0
+		if blocked {
+			atomic.AddInt32(&s.windowWaiters, 1)
+		}
 		select {
 		case <-s.sendNotifyCh:
-			continue
+		case <-bufferCh:
+		case <-limitCh:
 		case <-s.writeDeadline.wait():
-			return 0, ErrTimeout
+			err = ErrTimeout
+		}
+		if blocked {
+			atomic.AddInt32(&s.windowWaiters, -1)
 		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// writeErr returns why the stream can't be written, if it can't. The
+// stateLock must be held.
+func (s *Stream) writeErr() error {
+	switch {
+	case s.state == StreamReset:
+		return s.resetErr()
+	case s.writeClosed:
+		return ErrStreamClosedForWriting
+	case s.approvalPending:
+		return ErrStreamNotApproved
+	case s.state == StreamClosed:
+		return ErrStreamClosed
 	}
+	return nil
+}
+
+// creditHeld checks if window updates are held back, because of
+// PauseReads or MaxQueuedFramesPerStream. The recvLock must be held.
+func (s *Stream) creditHeld() bool {
+	max := s.session.config.MaxQueuedFramesPerStream
+	return s.readsPaused || (max > 0 && s.queuedFrames >= max)
+}
+
+// belowMinWindowUpdate checks if credit is to be held back because of
+// MinWindowUpdate, which it isn't once the peer used up its window.
+// The recvLock must be held.
+func (s *Stream) belowMinWindowUpdate(delta uint32) bool {
+	return delta < s.session.config.MinWindowUpdate && s.recvWindow != 0
+}
+
+// releaseUnacked is used to account for up to n bytes of returned
+// credit, returning how many unacknowledged bytes were released.
+func (s *Stream) releaseUnacked(n uint32) uint32 {
+	for {
+		unacked := atomic.LoadUint32(&s.unacked)
+		released := min(unacked, n)
+		if atomic.CompareAndSwapUint32(&s.unacked, unacked, unacked-released) {
+			return released
+		}
+	}
+}
+
+// WritableChan returns a channel that receives a value when the
+// stream may be written to without blocking on flow control. A value
+// is delivered whenever the peer grants send window, or immediately if
+// window is available when WritableChan is called. At most one value
+// is pending at a time, so the channel re-arms once it is drained.
+// A value is also delivered when the stream is closed or reset, in
+// which case Write reports the error.
+func (s *Stream) WritableChan() <-chan struct{} {
+	if atomic.LoadUint32(&s.sendWindow) > 0 && !s.PeerPaused() {
+		asyncNotify(s.writableCh)
+	}
+	return s.writableCh
 }
 
 // sendFlags determines any flags that are appropriate
@@ -213,12 +958,12 @@ func (s *Stream) sendFlags() uint16 {
 	defer s.stateLock.Unlock()
 	var flags uint16
 	switch s.state {
-	case streamInit:
+	case StreamInit:
 		flags |= flagSYN
-		s.state = streamSYNSent
-	case streamSYNReceived:
+		s.state = StreamSYNSent
+	case StreamSYNReceived:
 		flags |= flagACK
-		s.state = streamEstablished
+		s.state = StreamEstablished
 	}
 	return flags
 }
@@ -226,24 +971,57 @@ func (s *Stream) sendFlags() uint16 {
 // sendWindowUpdate potentially sends a window update enabling
 // further writes to take place. Must be invoked with the lock.
 func (s *Stream) sendWindowUpdate() error {
+	// Neither acknowledge nor credit the stream before approval
+	s.stateLock.Lock()
+	pending := s.approvalPending
+	s.stateLock.Unlock()
+	if pending {
+		return nil
+	}
+
 	s.controlHdrLock.Lock()
 	defer s.controlHdrLock.Unlock()
 
 	// Determine the delta update
 	max := s.session.config.MaxStreamWindowSize
 	var bufLen uint32
-	s.recvLock.Lock()
+	lockCounted(&s.recvLock, &s.session.readLockContended)
 	if s.recvBuf != nil {
 		bufLen = uint32(s.recvBuf.Len())
 	}
 	delta := (max - bufLen) - s.recvWindow
+	if s.creditHeld() {
+		delta = 0
+	}
 
 	// Determine the flags if any
 	flags := s.sendFlags()
 
+	// Hold back credit below the minimum
+	if flags == 0 && s.belowMinWindowUpdate(delta) {
+		s.recvLock.Unlock()
+		return nil
+	}
+
 	// Check if we can omit the update
-	if delta < (max/2) && flags == 0 {
+	threshold := max / 2
+	if factor := s.session.config.ReadAheadFactor; factor > 0 {
+		threshold = uint32(float64(max) * factor)
+	}
+	if delta < threshold && flags == 0 {
 		s.recvLock.Unlock()
+
+		// Return the rest of the credit in a while when batching
+		if delta > 0 && s.session.batch != nil && s.session.config.WindowUpdateInterval > 0 {
+			s.session.batch.addDelayed(s)
+		}
+		return nil
+	}
+
+	// Leave plain credit to the send loop when batching
+	if flags == 0 && s.session.batch != nil {
+		s.recvLock.Unlock()
+		s.session.batch.add(s)
 		return nil
 	}
 
@@ -259,6 +1037,22 @@ func (s *Stream) sendWindowUpdate() error {
 	return nil
 }
 
+// sendHeader is used to open the stream with a header frame. Stream
+// headers are not part of the flow control window.
+func (s *Stream) sendHeader(meta []byte) error {
+	lockCounted(&s.sendLock, &s.session.writeLockContended)
+	flags := s.sendFlags() | flagHDR
+	s.sendHdr.encode(typeData, flags, s.id, uint32(len(meta)))
+	err := s.session.waitForSendErr(s.sendHdr, bytes.NewReader(meta), s.sendErr)
+	s.sendLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Advertise a larger window if we have one
+	return s.sendWindowUpdate()
+}
+
 // sendClose is used to send a FIN
 func (s *Stream) sendClose() error {
 	s.controlHdrLock.Lock()
@@ -273,33 +1067,79 @@ func (s *Stream) sendClose() error {
 	return nil
 }
 
-// Close is used to close the stream
+// sendReset is used to send a RST
+func (s *Stream) sendReset() error {
+	s.controlHdrLock.Lock()
+	defer s.controlHdrLock.Unlock()
+
+	s.controlHdr.encode(typeWindowUpdate, flagRST, s.id, 0)
+	if err := s.session.waitForSendErr(s.controlHdr, nil, s.controlErr); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close is used to close the stream for writing. Once the stream is
+// also closed for reading, by the peer or CloseRead, it is removed
+// from the session.
+// Closing a stream that is already closed for writing, reset or whose
+// session is closed does nothing and returns nil, so Close is safe to
+// defer after other cleanup. Close first waits for the writes queued
+// by WriteWithAck. An error sending the data buffered because of
+// SetNoDelay(false) is returned, but the stream is closed regardless.
 func (s *Stream) Close() error {
+	// Let the writes queued by WriteWithAck go first
+	s.ackLock.Lock()
+	tail := s.ackTail
+	s.ackLock.Unlock()
+	if tail != nil {
+		select {
+		case <-tail:
+		case <-s.doneCh:
+		}
+	}
+
+	var err error
+	if atomic.LoadInt32(&s.delayWrites) == 1 {
+		err = s.Flush()
+	}
+
 	closeStream := false
 	s.stateLock.Lock()
+	if s.approvalPending {
+		s.reject()
+		return err
+	}
 	switch s.state {
 	// Opened means we need to signal a close
-	case streamSYNSent:
+	case StreamSYNSent:
 		fallthrough
-	case streamSYNReceived:
+	case StreamSYNReceived:
 		fallthrough
-	case streamEstablished:
-		s.state = streamLocalClose
+	case StreamEstablished:
+		if s.readClosed {
+			s.writeClosed = true
+			s.closeUnread()
+			return err
+		}
+		s.state = StreamLocalClose
+		s.writeClosed = true
 		goto SEND_CLOSE
 
-	case streamLocalClose:
-	case streamRemoteClose:
-		s.state = streamClosed
+	case StreamLocalClose:
+	case StreamRemoteClose:
+		s.state = StreamClosed
+		s.writeClosed = true
 		closeStream = true
 		goto SEND_CLOSE
 
-	case streamClosed:
-	case streamReset:
+	case StreamClosed:
+	case StreamReset:
 	default:
 		panic("unhandled state")
 	}
 	s.stateLock.Unlock()
-	return nil
+	return err
 SEND_CLOSE:
 	s.stateLock.Unlock()
 	s.sendClose()
@@ -307,15 +1147,195 @@ SEND_CLOSE:
 	if closeStream {
 		s.session.closeStream(s.id)
 	}
-	return nil
+	return err
+}
+
+// PeerClosedWrite returns whether the peer closed the stream for
+// writing, so once the buffered data is read, reads return io.EOF. It
+// tells a FIN from the peer apart from other reasons reads end, such
+// as a reset or the session closing.
+func (s *Stream) PeerClosedWrite() bool {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.peerClosed
+}
+
+// CloseWrite closes the stream for writing by sending a FIN, while
+// reading continues until the remote side closes as well. It is the
+// same as Close, which also only half-closes the stream. Writes after
+// closing fail with ErrStreamClosedForWriting.
+func (s *Stream) CloseWrite() error {
+	return s.Close()
+}
+
+// CloseRead closes the stream for reading. Buffered data is dropped
+// and reads return io.EOF, while data the peer still sends is
+// discarded and its credit returned, so the peer is not blocked.
+// Writing continues until the stream is closed for writing as well.
+//
+// A stream that is closed in both directions is removed from the
+// session. If the peer did not close its side by then, the stream is
+// reset, like a TCP socket closed with unread data.
+func (s *Stream) CloseRead() error {
+	s.stateLock.Lock()
+	switch s.state {
+	case StreamClosed, StreamReset:
+		s.stateLock.Unlock()
+		return nil
+	case StreamLocalClose:
+		s.readClosed = true
+		s.closeUnread()
+		return nil
+	}
+	s.readClosed = true
+	s.stateLock.Unlock()
+	s.notifyWaiting()
+
+	// Drop the buffered data and return its credit
+	s.recvLock.Lock()
+	s.dropRecvBuf()
+	s.recvLock.Unlock()
+	return s.sendWindowUpdate()
+}
+
+// closeUnread finishes a stream closed in both directions while the
+// peer may still be writing, by resetting it on the peer. The
+// stateLock must be held, and is released.
+func (s *Stream) closeUnread() {
+	s.state = StreamClosed
+	s.endHandshake()
+	s.stateLock.Unlock()
+	s.notifyWaiting()
+	s.session.closeStream(s.id)
+	if err := s.sendReset(); err != nil {
+		s.session.logger.Printf("[WARN] yamux: failed to send RST: %v", err)
+	}
+}
+
+// Closed reports whether the stream is closed for reading and for
+// writing. Reading is closed by CloseRead or once the peer closed its
+// side, although data buffered before a FIN can still be read.
+// Writing is closed by Close or CloseWrite. A stream that was reset or
+// whose session was closed is closed in both directions.
+func (s *Stream) Closed() (readClosed, writeClosed bool) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	if s.state == StreamClosed || s.state == StreamReset {
+		return true, true
+	}
+	return s.readClosed || s.peerClosed, s.writeClosed
 }
 
 // forceClose is used for when the session is exiting
 func (s *Stream) forceClose() {
 	s.stateLock.Lock()
-	s.state = streamClosed
+	s.state = StreamClosed
+	s.discardRecv = !s.session.config.PreserveDataOnClose
+	s.endHandshake()
 	s.stateLock.Unlock()
 	s.notifyWaiting()
+	s.done()
+}
+
+// done signals that the stream was removed from the session
+func (s *Stream) done() {
+	s.doneOnce.Do(func() {
+		s.removed = time.Now()
+		close(s.doneCh)
+		s.stopIdleTimer()
+	})
+}
+
+// SetContext ties the stream to ctx, so the stream is reset once ctx
+// is done. Blocked and later reads and writes then fail with ctx.Err().
+func (s *Stream) SetContext(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.cancel(ctx.Err())
+		case <-s.doneCh:
+		}
+	}()
+}
+
+// SetIdleTimeout resets the stream once it had no successful read or
+// write for d, e.g. to reap streams abandoned by the peer. Blocked and
+// later reads and writes then fail with ErrStreamIdle. Zero disables
+// the timeout, see also DefaultStreamIdleTimeout.
+func (s *Stream) SetIdleTimeout(d time.Duration) {
+	s.idleLock.Lock()
+	defer s.idleLock.Unlock()
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+	atomic.StoreInt64(&s.idleTimeout, int64(d))
+	if d <= 0 || isClosedChan(s.doneCh) {
+		return
+	}
+	s.active()
+	s.idleTimer = time.AfterFunc(d, s.checkIdle)
+}
+
+// active records a successful read or write for the idle timeout
+func (s *Stream) active() {
+	if atomic.LoadInt64(&s.idleTimeout) > 0 {
+		atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+	}
+}
+
+// checkIdle is invoked by the idle timer. It resets the stream if it
+// was idle for the timeout, and otherwise waits for the rest of it.
+func (s *Stream) checkIdle() {
+	s.idleLock.Lock()
+	d := time.Duration(atomic.LoadInt64(&s.idleTimeout))
+	if d <= 0 || s.idleTimer == nil {
+		s.idleLock.Unlock()
+		return
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+	if idle < d {
+		s.idleTimer.Reset(d - idle)
+		s.idleLock.Unlock()
+		return
+	}
+	s.idleTimer = nil
+	s.idleLock.Unlock()
+	s.cancel(ErrStreamIdle)
+}
+
+// stopIdleTimer stops the idle timeout once the stream is removed
+func (s *Stream) stopIdleTimer() {
+	s.idleLock.Lock()
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+	s.idleLock.Unlock()
+}
+
+// cancel resets the stream because its context is done
+func (s *Stream) cancel(err error) {
+	s.stateLock.Lock()
+	if s.state == StreamClosed || s.state == StreamReset {
+		s.stateLock.Unlock()
+		return
+	}
+	s.ctxErr = err
+	s.stateLock.Unlock()
+	s.session.resetStream(s.id)
+}
+
+// resetErr is the error returned by reads and writes once the stream
+// was reset. The stateLock must be held.
+func (s *Stream) resetErr() error {
+	if s.ctxErr != nil {
+		return s.ctxErr
+	}
+	return ErrConnectionReset
 }
 
 // processFlags is used to update the state of the stream
@@ -332,22 +1352,25 @@ func (s *Stream) processFlags(flags uint16) error {
 	s.stateLock.Lock()
 	defer s.stateLock.Unlock()
 	if flags&flagACK == flagACK {
-		if s.state == streamSYNSent {
-			s.state = streamEstablished
+		if s.state == StreamSYNSent {
+			s.state = StreamEstablished
 		}
+		s.acked = true
+		s.endHandshake()
 		s.session.establishStream(s.id)
 	}
 	if flags&flagFIN == flagFIN {
+		s.peerClosed = true
 		switch s.state {
-		case streamSYNSent:
+		case StreamSYNSent:
 			fallthrough
-		case streamSYNReceived:
+		case StreamSYNReceived:
 			fallthrough
-		case streamEstablished:
-			s.state = streamRemoteClose
+		case StreamEstablished:
+			s.state = StreamRemoteClose
 			s.notifyWaiting()
-		case streamLocalClose:
-			s.state = streamClosed
+		case StreamLocalClose:
+			s.state = StreamClosed
 			closeStream = true
 			s.notifyWaiting()
 		default:
@@ -356,39 +1379,173 @@ func (s *Stream) processFlags(flags uint16) error {
 		}
 	}
 	if flags&flagRST == flagRST {
-		s.state = streamReset
+		s.state = StreamReset
 		closeStream = true
+		s.endHandshake()
 		s.notifyWaiting()
 	}
 	return nil
 }
 
+// endHandshake wakes up WaitEstablished. The stateLock must be held.
+func (s *Stream) endHandshake() {
+	if !isClosedChan(s.establishCh) {
+		close(s.establishCh)
+	}
+}
+
+// WaitEstablished blocks until the peer acknowledged the stream, or
+// ctx is done. It returns ErrStreamRejected if the peer reset the
+// stream instead, or ErrPeerOverloaded if it did so because of its
+// load. Streams opened by the peer are established as soon
+// as they are accepted.
+func (s *Stream) WaitEstablished(ctx context.Context) error {
+	select {
+	case <-s.establishCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	switch {
+	case s.acked:
+		return nil
+	case s.state == StreamReset && s.ctxErr == ErrPeerOverloaded:
+		return ErrPeerOverloaded
+	case s.state == StreamReset:
+		return ErrStreamRejected
+	default:
+		return ErrStreamClosed
+	}
+}
+
+// refused reports whether the peer reset the stream because its accept
+// backlog was full or it was overloaded, so opening it may be retried
+func (s *Stream) refused() bool {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.state == StreamReset && (s.rstCode == rstBacklog || s.rstCode == rstOverloaded)
+}
+
+// Approve admits a stream accepted with RequireStreamApproval. It
+// acknowledges the stream to the peer, which may then send a full
+// window, and reading and writing can start. Approving a stream that
+// doesn't await approval does nothing.
+func (s *Stream) Approve() error {
+	s.stateLock.Lock()
+	if s.state == StreamReset {
+		err := s.resetErr()
+		s.stateLock.Unlock()
+		return err
+	}
+	if !s.approvalPending {
+		s.stateLock.Unlock()
+		return nil
+	}
+	s.approvalPending = false
+	if s.approvalTimer != nil {
+		s.approvalTimer.Stop()
+	}
+	s.stateLock.Unlock()
+	s.notifyWaiting()
+	return s.sendWindowUpdate()
+}
+
+// awaitApproval starts the approval timeout once the stream is
+// accepted
+func (s *Stream) awaitApproval() {
+	timeout := s.session.config.ApprovalTimeout
+	if timeout == 0 {
+		timeout = defaultApprovalTimeout
+	}
+	s.stateLock.Lock()
+	if s.approvalPending {
+		s.approvalTimer = time.AfterFunc(timeout, func() {
+			s.stateLock.Lock()
+			if !s.approvalPending {
+				s.stateLock.Unlock()
+				return
+			}
+			s.session.logger.Printf("[WARN] yamux: stream %d not approved in time, resetting", s.id)
+			s.reject()
+		})
+	}
+	s.stateLock.Unlock()
+}
+
+// reject resets a stream that awaits approval. The stateLock must be
+// held, and is released. Clearing approvalPending under the same lock
+// as checking it makes sure the stream is rejected only once.
+func (s *Stream) reject() {
+	s.approvalPending = false
+	if s.approvalTimer != nil {
+		s.approvalTimer.Stop()
+	}
+	s.stateLock.Unlock()
+	s.session.resetStream(s.id)
+}
+
 // notifyWaiting notifies all the waiting channels
 func (s *Stream) notifyWaiting() {
 	asyncNotify(s.recvNotifyCh)
 	asyncNotify(s.sendNotifyCh)
+	asyncNotify(s.writableCh)
 }
 
 // incrSendWindow updates the size of our send window
 func (s *Stream) incrSendWindow(hdr header, flags uint16) error {
+	if flags&flagRST == flagRST {
+		s.stateLock.Lock()
+		s.rstCode = hdr.Length()
+		if s.rstCode == rstOverloaded {
+			s.ctxErr = ErrPeerOverloaded
+		}
+		s.stateLock.Unlock()
+	}
 	if err := s.processFlags(flags); err != nil {
 		return err
 	}
 
+	// Pause or resume writes, which doesn't affect the window
+	if flags&flagEXT == flagEXT && s.session.hasExtension(extPause) {
+		switch hdr.Length() {
+		case pauseStream:
+			atomic.StoreInt32(&s.peerPaused, 1)
+		case resumeStream:
+			atomic.StoreInt32(&s.peerPaused, 0)
+			asyncNotify(s.sendNotifyCh)
+			if atomic.LoadUint32(&s.sendWindow) > 0 {
+				asyncNotify(s.writableCh)
+			}
+		}
+		return nil
+	}
+
 	// Increase window, unblock a sender
 	atomic.AddUint32(&s.sendWindow, hdr.Length())
+	s.session.releaseSendBuffer(s.releaseUnacked(hdr.Length()))
 	asyncNotify(s.sendNotifyCh)
+	if hdr.Length() > 0 && !s.PeerPaused() {
+		asyncNotify(s.writableCh)
+	}
 	return nil
 }
 
 // readData is used to handle a data frame
-func (s *Stream) readData(hdr header, flags uint16, conn io.Reader) error {
+func (s *Stream) readData(length uint32, flags uint16, conn io.Reader) error {
 	if err := s.processFlags(flags); err != nil {
 		return err
 	}
+	if spare := flags & flagSpare; spare != 0 && s.session.config.ExposeSpareFlags {
+		s.recvLock.Lock()
+		s.spareFlags |= spare
+		s.recvLock.Unlock()
+	}
 
-	// Check that our recv window is not exceeded
-	length := hdr.Length()
+	// Zero length frames only carry flags. They never wake up readers
+	// on their own, so they can't surface as an empty Read; a FIN has
+	// already notified readers, which will see io.EOF.
 	if length == 0 {
 		return nil
 	}
@@ -396,34 +1553,105 @@ func (s *Stream) readData(hdr header, flags uint16, conn io.Reader) error {
 	// Wrap in a limited reader
 	conn = &io.LimitedReader{R: conn, N: int64(length)}
 
+	// Discard the data once closed for reading, returning its credit
+	s.stateLock.Lock()
+	if s.approvalPending && s.unapprovedExceeded(length) {
+		s.session.logger.Printf("[WARN] yamux: too much data before approval (stream: %d), resetting", s.id)
+		s.reject()
+		_, err := io.Copy(ioutil.Discard, conn)
+		return err
+	}
+	readClosed := s.readClosed
+	s.stateLock.Unlock()
+	if readClosed {
+		s.recvLock.Lock()
+		if remain := s.recvWindow; length > remain {
+			s.recvLock.Unlock()
+			return s.windowExceeded(remain, length, conn)
+		}
+		s.recvWindow -= length
+		s.recvLock.Unlock()
+		if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+			return err
+		}
+		go s.sendWindowUpdate()
+		return nil
+	}
+
 	// Copy into buffer
-	s.recvLock.Lock()
+	lockCounted(&s.recvLock, &s.session.readLockContended)
 
-	if length > s.recvWindow {
-		s.session.logger.Printf("[ERR] yamux: receive window exceeded (stream: %d, remain: %d, recv: %d)", s.id, s.recvWindow, length)
-		return ErrRecvWindowExceeded
+	// Check that our recv window is not exceeded
+	if remain := s.recvWindow; length > remain {
+		s.recvLock.Unlock()
+		return s.windowExceeded(remain, length, conn)
 	}
 
+	var buffered uint32
 	if s.recvBuf == nil {
 		// Allocate the receive buffer just-in-time to fit the full data frame.
 		// This way we can read in the whole packet without further allocations.
-		s.recvBuf = bytes.NewBuffer(make([]byte, 0, length))
+		s.recvBuf = newRecvBuffer(s.session.config.RecvBufferStrategy, s.session.config.BufferPool, int(length))
+	} else {
+		buffered = uint32(s.recvBuf.Len())
+		s.recvBuf.Grow(int(length))
 	}
-	if _, err := io.Copy(s.recvBuf, conn); err != nil {
+	if _, err := s.recvBuf.ReadFrom(conn); err != nil {
 		s.session.logger.Printf("[ERR] yamux: Failed to read stream data: %v", err)
 		s.recvLock.Unlock()
 		return err
 	}
 
+	// Check if the buffer crossed the high-water mark
+	var highWaterFn func()
+	if s.highWaterFn != nil && buffered < s.highWater && uint32(s.recvBuf.Len()) >= s.highWater {
+		highWaterFn = s.highWaterFn
+	}
+
 	// Decrement the receive window
 	s.recvWindow -= length
+	s.queuedFrames++
 	s.recvLock.Unlock()
+	atomic.AddUint64(&s.bytesRecv, uint64(length))
+	if highWaterFn != nil {
+		highWaterFn()
+	}
 
 	// Unblock any readers
 	asyncNotify(s.recvNotifyCh)
 	return nil
 }
 
+// windowExceeded handles a data frame of length bytes with only
+// remain left in the receive window, according to the
+// FlowControlViolationAction. It returns an error if the session
+// should be closed.
+func (s *Stream) windowExceeded(remain, length uint32, conn io.Reader) error {
+	s.session.logger.Printf("[ERR] yamux: receive window exceeded (stream: %d, remain: %d, recv: %d)", s.id, remain, length)
+	if s.session.config.FlowControlViolationAction != FlowControlViolationReset {
+		return ErrRecvWindowExceeded
+	}
+	s.session.resetStream(s.id)
+	_, err := io.Copy(ioutil.Discard, conn)
+	return err
+}
+
+// unapprovedExceeded returns whether receiving length more bytes
+// exceeds the data allowed before approval
+func (s *Stream) unapprovedExceeded(length uint32) bool {
+	max := s.session.config.MaxUnapprovedData
+	if max == 0 {
+		max = defaultMaxUnapprovedData
+	}
+	s.recvLock.Lock()
+	defer s.recvLock.Unlock()
+	var buffered uint32
+	if s.recvBuf != nil {
+		buffered = uint32(s.recvBuf.Len())
+	}
+	return uint64(buffered)+uint64(length) > uint64(max)
+}
+
 // SetDeadline sets the read and write deadlines
 func (s *Stream) SetDeadline(t time.Time) error {
 	if err := s.SetReadDeadline(t); err != nil {
@@ -435,13 +1663,46 @@ func (s *Stream) SetDeadline(t time.Time) error {
 	return nil
 }
 
-// SetReadDeadline sets the deadline for future Read calls.
+// SetReadDeadline sets the deadline for future Read calls. As with
+// net.Conn, a deadline in the past unblocks pending reads with
+// ErrTimeout, and later reads fail right away until the deadline is
+// moved to the future or cleared with the zero time.
 func (s *Stream) SetReadDeadline(t time.Time) error {
 	s.readDeadline.set(t)
 	return nil
 }
 
-// SetWriteDeadline sets the deadline for future Write calls
+// ReadTimeout is like Read, but times out with ErrTimeout if no data
+// is read within d. The read deadline is restored afterwards, and
+// still applies if it is earlier.
+func (s *Stream) ReadTimeout(b []byte, d time.Duration) (int, error) {
+	prev := s.readDeadline.get()
+	s.readDeadline.set(earliest(prev, time.Now().Add(d)))
+	defer s.readDeadline.set(prev)
+	return s.Read(b)
+}
+
+// WriteTimeout is like Write, but times out with ErrTimeout if b can't
+// be written within d. The write deadline is restored afterwards, and
+// still applies if it is earlier.
+func (s *Stream) WriteTimeout(b []byte, d time.Duration) (int, error) {
+	prev := s.writeDeadline.get()
+	s.writeDeadline.set(earliest(prev, time.Now().Add(d)))
+	defer s.writeDeadline.set(prev)
+	return s.Write(b)
+}
+
+// earliest returns the earlier of the deadline and t, where a zero
+// deadline is no deadline at all
+func earliest(deadline, t time.Time) time.Time {
+	if deadline.IsZero() || t.Before(deadline) {
+		return t
+	}
+	return deadline
+}
+
+// SetWriteDeadline sets the deadline for future Write calls. A
+// deadline in the past behaves as for SetReadDeadline.
 func (s *Stream) SetWriteDeadline(t time.Time) error {
 	s.writeDeadline.set(t)
 	return nil
@@ -453,7 +1714,17 @@ func (s *Stream) SetWriteDeadline(t time.Time) error {
 func (s *Stream) Shrink() {
 	s.recvLock.Lock()
 	if s.recvBuf != nil && s.recvBuf.Len() == 0 {
-		s.recvBuf = nil
+		s.dropRecvBuf()
 	}
 	s.recvLock.Unlock()
 }
+
+// dropRecvBuf drops the receive buffer, handing it back to the
+// BufferPool if there is one. The recvLock must be held.
+func (s *Stream) dropRecvBuf() {
+	if s.recvBuf != nil && s.session.config.BufferPool != nil {
+		releaseRecvBuffer(s.session.config.BufferPool, s.recvBuf)
+	}
+	s.recvBuf = nil
+	s.queuedFrames = 0
+}
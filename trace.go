@@ -0,0 +1,120 @@
+package yamux
+
+import "fmt"
+
+// TraceEventKind identifies the state transition of a TraceEvent.
+type TraceEventKind int
+
+const (
+	TraceStreamOpen TraceEventKind = iota
+	TraceStreamClose
+	TraceSYNSent
+	TraceSYNReceived
+	TraceACKSent
+	TraceACKReceived
+	TraceFINSent
+	TraceFINReceived
+	TraceRSTSent
+	TraceRSTReceived
+	TraceWindowUpdateSent
+	TraceWindowUpdateReceived
+	TracePingSent
+	TracePongReceived
+	TraceGoAwaySent
+	TraceGoAwayReceived
+)
+
+var traceEventKindNames = []string{
+	TraceStreamOpen:           "StreamOpen",
+	TraceStreamClose:          "StreamClose",
+	TraceSYNSent:              "SYNSent",
+	TraceSYNReceived:          "SYNReceived",
+	TraceACKSent:              "ACKSent",
+	TraceACKReceived:          "ACKReceived",
+	TraceFINSent:              "FINSent",
+	TraceFINReceived:          "FINReceived",
+	TraceRSTSent:              "RSTSent",
+	TraceRSTReceived:          "RSTReceived",
+	TraceWindowUpdateSent:     "WindowUpdateSent",
+	TraceWindowUpdateReceived: "WindowUpdateReceived",
+	TracePingSent:             "PingSent",
+	TracePongReceived:         "PongReceived",
+	TraceGoAwaySent:           "GoAwaySent",
+	TraceGoAwayReceived:       "GoAwayReceived",
+}
+
+func (k TraceEventKind) String() string {
+	if k < 0 || int(k) >= len(traceEventKindNames) {
+		return fmt.Sprintf("TraceEventKind(%d)", int(k))
+	}
+	return traceEventKindNames[k]
+}
+
+// TraceEvent describes a single state transition of a session
+// or one of its streams.
+type TraceEvent struct {
+	// Kind is the transition that took place
+	Kind TraceEventKind
+
+	// StreamID is the affected stream, or 0 for session level events
+	StreamID uint32
+
+	// Size is the window delta for window updates, the ping ID for
+	// pings and the error code for GoAways. Otherwise it is zero.
+	Size uint32
+}
+
+// trace emits an event if tracing is enabled
+func (s *Session) trace(kind TraceEventKind, id uint32, size uint32) {
+	if fn := s.config.TraceFunc; fn != nil {
+		fn(TraceEvent{Kind: kind, StreamID: id, Size: size})
+	}
+}
+
+// traceFrame emits the events described by a frame header
+// that was sent or received.
+func (s *Session) traceFrame(hdr header, sent bool) {
+	if s.config.TraceFunc == nil {
+		return
+	}
+
+	pick := func(send, recv TraceEventKind) TraceEventKind {
+		if sent {
+			return send
+		}
+		return recv
+	}
+
+	id, flags, length := hdr.StreamID(), hdr.Flags(), hdr.Length()
+	switch hdr.MsgType() {
+	case typePing:
+		if sent && flags&flagSYN == flagSYN {
+			s.trace(TracePingSent, 0, length)
+		} else if !sent && flags&flagACK == flagACK {
+			s.trace(TracePongReceived, 0, length)
+		}
+		return
+	case typeGoAway:
+		s.trace(pick(TraceGoAwaySent, TraceGoAwayReceived), 0, length)
+		return
+	}
+
+	if id == 0 {
+		return
+	}
+	if flags&flagSYN == flagSYN {
+		s.trace(pick(TraceSYNSent, TraceSYNReceived), id, 0)
+	}
+	if flags&flagACK == flagACK {
+		s.trace(pick(TraceACKSent, TraceACKReceived), id, 0)
+	}
+	if flags&flagFIN == flagFIN {
+		s.trace(pick(TraceFINSent, TraceFINReceived), id, 0)
+	}
+	if flags&flagRST == flagRST {
+		s.trace(pick(TraceRSTSent, TraceRSTReceived), id, 0)
+	}
+	if hdr.MsgType() == typeWindowUpdate && length > 0 {
+		s.trace(pick(TraceWindowUpdateSent, TraceWindowUpdateReceived), id, length)
+	}
+}
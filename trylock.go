@@ -0,0 +1,13 @@
+//go:build go1.18
+// +build go1.18
+
+package yamux
+
+import (
+	"sync"
+)
+
+// tryLock locks mu if it is free, reporting whether it did
+func tryLock(mu *sync.Mutex) bool {
+	return mu.TryLock()
+}
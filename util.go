@@ -1,7 +1,9 @@
 package yamux
 
 import (
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -34,6 +36,67 @@ func asyncNotify(ch chan struct{}) {
 	}
 }
 
+// fullWriter writes all of a buffer to w, looping on short writes.
+// Some conns return short writes without an error, which would
+// otherwise desynchronize the framing. Errors that retryable accepts
+// are retried with a backoff for up to timeout, unless done is closed,
+// see WriteErrorClassifier.
+type fullWriter struct {
+	w io.Writer
+
+	retryable func(error) bool
+	timeout   time.Duration
+	done      <-chan struct{}
+	logf      func(format string, v ...interface{})
+}
+
+func (f fullWriter) Write(b []byte) (int, error) {
+	sent := 0
+	var retryUntil time.Time
+	backoff := writeRetryBackoff
+	for sent < len(b) {
+		n, err := f.w.Write(b[sent:])
+		sent += n
+		if err != nil && f.retryable != nil && f.retryable(err) {
+			now := time.Now()
+			if retryUntil.IsZero() {
+				retryUntil = now.Add(f.timeout)
+			}
+			if now.Before(retryUntil) {
+				f.logf("[WARN] yamux: retrying write in %v: %v", backoff, err)
+				select {
+				case <-time.After(backoff):
+				case <-f.done:
+					return sent, err
+				}
+				if backoff *= 2; backoff > maxWriteRetryBackoff {
+					backoff = maxWriteRetryBackoff
+				}
+				continue
+			}
+		}
+		if err != nil {
+			return sent, err
+		}
+		if n == 0 {
+			return sent, io.ErrShortWrite
+		}
+	}
+	return sent, nil
+}
+
+// countingWriter counts the writes to w in n, which is accessed
+// atomically
+type countingWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	atomic.AddUint64(c.n, 1)
+	return c.w.Write(b)
+}
+
 // min computes the minimum of two values
 func min(a, b uint32) uint32 {
 	if a < b {
@@ -0,0 +1,70 @@
+package yamux
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// watchdogDumpSize bounds the size of the goroutine dump logged when
+// a loop stalls
+const watchdogDumpSize = 1 << 20
+
+// loopMonitor tracks the progress of a session loop
+type loopMonitor struct {
+	beats uint64
+	since time.Time
+}
+
+// stalled checks if the loop has been busy without progress for
+// longer than timeout
+func (m *loopMonitor) stalled(beats uint64, busy bool, now time.Time, timeout time.Duration) bool {
+	if beats != m.beats || !busy {
+		m.beats = beats
+		m.since = now
+		return false
+	}
+	return now.Sub(m.since) > timeout
+}
+
+// watchdog is a long running goroutine that tears down the session if
+// the send or recv loop stalls for longer than the Watchdog timeout,
+// e.g. because of a deadlock. Closing the session may block on the
+// stalled recv loop, but the connection is closed first.
+func (s *Session) watchdog() {
+	timeout := s.config.Watchdog
+	interval := timeout / 4
+	if interval == 0 {
+		interval = timeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	now := time.Now()
+	send := loopMonitor{since: now}
+	recv := loopMonitor{since: now}
+	for {
+		select {
+		case now := <-ticker.C:
+			sendBusy := len(s.sendCh) > 0 || atomic.LoadInt32(&s.sendBusy) == 1
+			recvBusy := atomic.LoadInt32(&s.recvBusy) == 1
+			loop := ""
+			if send.stalled(atomic.LoadUint64(&s.sendBeats), sendBusy, now, timeout) {
+				loop = "send"
+			} else if recv.stalled(atomic.LoadUint64(&s.recvBeats), recvBusy, now, timeout) {
+				loop = "recv"
+			}
+			if loop == "" {
+				continue
+			}
+
+			buf := make([]byte, watchdogDumpSize)
+			n := runtime.Stack(buf, true)
+			s.logger.Printf("[ERR] yamux: %s loop stalled for more than %v, goroutines:\n%s", loop, timeout, buf[:n])
+			s.exitErr(ErrSessionStalled)
+			return
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}